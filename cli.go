@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"time"
+)
+
+const commandUsage = `Usage:
+  chirpy                            serve the API
+  chirpy grant-role <email> <role>  grant moderator or admin to a user
+  chirpy revoke-role <email> <role> revoke a role from a user`
+
+// runCommand runs the administrative command given on the command line
+// instead of serving. grant-role is how the first admin is created: sign up
+// through the API, then grant the account admin from a shell on the server.
+func (cfg *apiConfig) runCommand(ctx context.Context, args []string) error {
+	if len(args) != 3 || (args[0] != "grant-role" && args[0] != "revoke-role") {
+		return errors.New(commandUsage)
+	}
+
+	email, role := args[1], args[2]
+	if !isGrantableRole(role) {
+		return fmt.Errorf("Unknown role %q, expected %s or %s", role, roleModerator, roleAdmin)
+	}
+
+	user, err := cfg.db.GetUserByEmail(ctx, lookupEmail(email))
+	if err != nil {
+		return fmt.Errorf("Error querying database for user %s: %w", email, err)
+	}
+
+	if args[0] == "revoke-role" {
+		_, err = cfg.db.RevokeUserRole(ctx, database.RevokeUserRoleParams{
+			UserID: user.ID,
+			Role:   role,
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Revoked %s from %s", role, email)
+		return nil
+	}
+
+	err = cfg.db.GrantUserRole(ctx, database.GrantUserRoleParams{
+		UserID:    user.ID,
+		Role:      role,
+		GrantedAt: time.Now(),
+		GrantedBy: uuid.NullUUID{},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Granted %s to %s", role, email)
+	return nil
+}
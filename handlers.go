@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/chirplen"
 	"github.com/rQxwX3/chirpy/internal/database"
+	"github.com/rQxwX3/chirpy/internal/mailer"
+	"github.com/rQxwX3/chirpy/internal/moderation"
 	"log"
 	"net/http"
 	"slices"
-	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
@@ -29,7 +34,7 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
 
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 	if cfg.platform != "dev" {
-		w.WriteHeader(403)
+		respondWithError(w, r, 403, errCodeForbidden, "Reset is only allowed on the dev platform")
 		return
 	}
 
@@ -37,7 +42,7 @@ func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 
 	err := cfg.db.DeleteAll(r.Context())
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error reseting users table %s", err)
 		return
 	}
@@ -50,76 +55,196 @@ func handlerHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func filterProfane(chirpBody string) string {
-	profaneWords := [3]string{"kerfuffle", "sharbert", "fornax"}
-	words := strings.Split(chirpBody, " ")
-	newWords := []string{}
-
-	for _, word := range words {
-		for _, profaneWord := range profaneWords {
-			if strings.ToLower(word) == profaneWord {
-				word = "****"
-				break
-			}
-		}
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	type res struct {
+		Keys []auth.JWK `json:"keys"`
+	}
 
-		newWords = append(newWords, word)
+	data, err := json.Marshal(res{cfg.jwtKeys.JWKS()})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error marshalling JSON: %s", err)
+		return
 	}
 
-	return strings.Join(newWords, " ")
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(200)
+	w.Write(data)
 }
 
-func validateChirp(chirpBody *string) bool {
-	if len(*chirpBody) > 140 {
-		return false
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
+// makeAccessToken issues an access token for a login session, carrying the
+// roles the user holds right now.
+func (cfg *apiConfig) makeAccessToken(ctx context.Context, userID, sessionID uuid.UUID) (string, error) {
+	roles, err := cfg.userRoles(ctx, userID)
+	if err != nil {
+		return "", err
 	}
 
-	*chirpBody = filterProfane(*chirpBody)
+	return cfg.jwtKeys.MakeAccessToken(auth.AccessToken{
+		UserID:    userID,
+		SessionID: sessionID,
+		Roles:     roles,
+	}, time.Duration(3600)*time.Second)
+}
 
-	return true
+type chirpResponse struct {
+	ID           uuid.UUID  `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	Body         string     `json:"body"`
+	UserID       uuid.UUID  `json:"user_id"`
+	InReplyTo    *uuid.UUID `json:"in_reply_to"`
+	ReplyCount   int32      `json:"reply_count"`
+	LikeCount    int32      `json:"like_count"`
+	RechirpCount int32      `json:"rechirp_count"`
+	// LikedByMe is only set for authenticated callers.
+	LikedByMe *bool `json:"liked_by_me,omitempty"`
 }
 
-func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error obtaining JWT from headers: %s", err)
-		return
+func newChirpResponse(chirp database.Chirp) chirpResponse {
+	res := chirpResponse{
+		ID:           chirp.ID,
+		CreatedAt:    chirp.CreatedAt,
+		UpdatedAt:    chirp.UpdatedAt,
+		Body:         chirp.Body,
+		UserID:       chirp.UserID,
+		ReplyCount:   chirp.ReplyCount,
+		LikeCount:    chirp.LikeCount,
+		RechirpCount: chirp.RechirpCount,
+	}
+
+	if chirp.InReplyTo.Valid {
+		res.InReplyTo = &chirp.InReplyTo.UUID
+	}
+
+	return res
+}
+
+// markLikedByMe fills in LikedByMe on each chirp for the given user.
+func (cfg *apiConfig) markLikedByMe(ctx context.Context, userID uuid.UUID, chirps []chirpResponse) error {
+	chirpIDs := []uuid.UUID{}
+	for _, chirp := range chirps {
+		chirpIDs = append(chirpIDs, chirp.ID)
 	}
 
-	userUUID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	likedIDs, err := cfg.db.ListLikedChirpIDs(ctx, database.ListLikedChirpIDsParams{
+		UserID:   userID,
+		ChirpIds: chirpIDs,
+	})
 	if err != nil {
-		w.WriteHeader(401)
-		log.Printf("Error validating JWT: %s", err)
-		return
+		return err
+	}
+
+	for i := range chirps {
+		liked := slices.Contains(likedIDs, chirps[i].ID)
+		chirps[i].LikedByMe = &liked
+	}
+
+	return nil
+}
+
+var errChirpRejected = fieldError{Field: "body", Code: fieldCodeRejected, Message: "Chirp body rejected by moderation"}
+
+// chirpLimits is the maximum chirp length, as counted by chirplen, for each
+// account tier.
+type chirpLimits struct {
+	standard int
+	red      int
+}
+
+var defaultChirpLimits = chirpLimits{standard: 140, red: 280}
+
+// minChirpBytes is the least storage any chirp gets, whatever its limit,
+// so bodies made of long emoji sequences still fit. Limits are raised to
+// four bytes per character, UTF-8's widest, when that is more.
+const minChirpBytes = 8 << 10
+
+func chirpByteLimit(limit int) int {
+	return max(minChirpBytes, limit*utf8.UTFMax)
+}
+
+func (l chirpLimits) forUser(user database.User) int {
+	if user.IsChirpyRed {
+		return l.red
+	}
+
+	return l.standard
+}
+
+// validateChirp normalizes the body to NFC, checks it against the author's
+// length limit and moderates it. The byte cap comes first: a single grapheme
+// or URL can be arbitrarily long while still counting as one or
+// chirplen.URLLength characters.
+func (cfg *apiConfig) validateChirp(author database.User, chirpBody *string) (moderation.Result, error) {
+	*chirpBody = chirplen.Normalize(*chirpBody)
+
+	limit := cfg.chirpLimits.forUser(author)
+	if byteLimit := chirpByteLimit(limit); len(*chirpBody) > byteLimit {
+		return moderation.Result{}, fieldError{
+			Field:   "body",
+			Code:    fieldCodeTooLong,
+			Message: fmt.Sprintf("Chirp is %d bytes long, the limit is %d", len(*chirpBody), byteLimit),
+		}
+	}
+
+	length := chirplen.Length(*chirpBody)
+	if length > limit {
+		return moderation.Result{}, fieldError{
+			Field:   "body",
+			Code:    fieldCodeTooLong,
+			Message: fmt.Sprintf("Chirp is %d characters long, the limit is %d", length, limit),
+			Length:  length,
+			Limit:   limit,
+		}
+	}
+
+	result := cfg.moderator.Moderate(*chirpBody)
+	if result.Rejected {
+		return result, errChirpRejected
 	}
 
+	*chirpBody = result.Text
+
+	return result, nil
+}
+
+func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
 	type req struct {
-		Body string `json:"body"`
+		Body      string `json:"body" validate:"required"`
+		InReplyTo string `json:"in_reply_to" validate:"uuid"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	reqStruct := req{}
-
-	err = decoder.Decode(&reqStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error decoding JSON: %s", err)
+	if !decodeJSON(w, r, &reqStruct) {
 		return
 	}
 
-	if ok := validateChirp(&reqStruct.Body); !ok {
-		w.WriteHeader(400)
-		log.Printf("Error creating chirp: body exceeds max length")
+	moderationResult, err := cfg.validateChirp(caller.user, &reqStruct.Body)
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error creating chirp: %s", err)
 		return
 	}
 
-	type res struct {
-		ID        uuid.UUID `json:"id"`
-		CreatedAt time.Time `json:"created_at"`
-		UpdatedAt time.Time `json:"updated_at"`
-		Body      string    `json:"body"`
-		UserID    uuid.UUID `json:"user_id"`
+	inReplyTo := nullUUID(reqStruct.InReplyTo)
+	if inReplyTo.Valid {
+		_, err = cfg.db.GetChirpByID(r.Context(), inReplyTo.UUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithValidationError(w, r,
+				fieldError{Field: "in_reply_to", Code: fieldCodeNotFound, Message: "Chirp being replied to does not exist"})
+			return
+		}
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error querying database for chirp being replied to: %s", err)
+			return
+		}
 	}
 
 	chirp, err := cfg.db.CreateChirp(r.Context(), database.CreateChirpParams{
@@ -128,60 +253,51 @@ func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request)
 		UpdatedAt: time.Now(),
 		Body:      reqStruct.Body,
 		UserID:    userUUID,
+		InReplyTo: inReplyTo,
 	})
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error creating chirp: %s", err)
 		return
 	}
 
-	resBody := res{
-		ID:        chirp.ID,
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body:      chirp.Body,
-		UserID:    chirp.UserID,
-	}
+	cfg.flagChirp(r.Context(), chirp.ID, moderationResult)
 
-	data, err := json.Marshal(resBody)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
-		return
-	}
+	resBody := newChirpResponse(chirp)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(201)
-	w.Write(data)
+	respondWithJSON(w, 201, resBody)
 }
 
 func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request) {
 	type req struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+		Password string `json:"password" validate:"required"`
+		Email    string `json:"email" validate:"required"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
-
 	reqStruct := req{}
-	err := decoder.Decode(&reqStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error decoding JSON: %s", err)
+	if !decodeJSON(w, r, &reqStruct) {
 		return
 	}
 
 	type res struct {
-		Id          uuid.UUID `json:"id"`
-		CreatedAt   time.Time `json:"created_at"`
-		UpdatedAt   time.Time `json:"updated_at"`
-		Email       string    `json:"email"`
-		IsChirpyRed bool      `json:"is_chirpy_red"`
+		Id            uuid.UUID `json:"id"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		IsChirpyRed   bool      `json:"is_chirpy_red"`
+	}
+
+	email, err := mailer.NormalizeAddress(reqStruct.Email)
+	if err != nil {
+		respondWithValidationError(w, r, fieldError{Field: "email", Code: fieldCodeInvalid, Message: "Email address is invalid"})
+		log.Printf("Error creating user: %s %q", err, reqStruct.Email)
+		return
 	}
 
 	hash, err := auth.HashPassword(reqStruct.Password)
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error hashing the password: %s", err)
 		return
 	}
@@ -190,284 +306,344 @@ func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request)
 		ID:             uuid.New(),
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
-		Email:          reqStruct.Email,
+		Email:          email,
 		HashedPassword: hash,
 	})
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error creating user: %s", err)
 		return
 	}
 
-	resBody := res{user.ID, user.CreatedAt, user.UpdatedAt, user.Email, user.IsChirpyRed}
-	data, err := json.Marshal(resBody)
+	// The account is usable either way; a failed email can be resent later.
+	err = cfg.sendEmailVerification(r.Context(), user.ID, user.Email)
 	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
-		return
+		log.Printf("Error sending verification email: %s", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(201)
-	w.Write(data)
+	resBody := res{
+		user.ID, user.CreatedAt, user.UpdatedAt,
+		user.Email, user.EmailVerifiedAt.Valid, user.IsChirpyRed,
+	}
+	respondWithJSON(w, 201, resBody)
 }
 
 func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
-	authorUUIDString := r.URL.Query().Get("author_id")
-	chirps := []database.Chirp{}
-
-	if authorUUIDString == "" {
-		allChirps, err := cfg.db.GetAllChirps(r.Context())
-		if err != nil {
-			w.WriteHeader(500)
-			log.Printf("Error querying database for chirps: %s", err)
-			return
-		}
+	type params struct {
+		AuthorID string `query:"author_id" validate:"uuid"`
+		Sort     string `query:"sort" validate:"oneof=asc desc"`
+	}
 
-		chirps = allChirps
-	} else {
-		authorUUID, err := uuid.Parse(authorUUIDString)
-		if err != nil {
-			w.WriteHeader(500)
-			log.Printf("Error parsing for author UUID: %s", err)
-			return
-		}
+	paramsStruct := params{}
+	if !decodeQuery(w, r, &paramsStruct) {
+		return
+	}
 
-		authorChirps, err := cfg.db.GetChirpsByAuthorID(r.Context(), authorUUID)
+	authorUUID := nullUUID(paramsStruct.AuthorID)
 
-		chirps = authorChirps
+	p, err := parsePage(r.URL.Query())
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error parsing page parameters: %s", err)
+		return
 	}
 
-	sortingOrder := r.URL.Query().Get("sort")
-	if sortingOrder == "desc" {
-		slices.Reverse(chirps)
+	// One extra row tells us whether another page follows.
+	var chirps []database.Chirp
+	if paramsStruct.Sort == "desc" {
+		chirps, err = cfg.db.ListChirpsDesc(r.Context(), database.ListChirpsDescParams{
+			AuthorID:        authorUUID,
+			CursorCreatedAt: p.cursorCreatedAt,
+			CursorID:        p.cursorID,
+			Limit:           p.limit + 1,
+		})
+	} else {
+		chirps, err = cfg.db.ListChirpsAsc(r.Context(), database.ListChirpsAscParams{
+			AuthorID:        authorUUID,
+			CursorCreatedAt: p.cursorCreatedAt,
+			CursorID:        p.cursorID,
+			Limit:           p.limit + 1,
+		})
 	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirps: %s", err)
+		return
+	}
+
+	chirps, nextCursor := trimPage(chirps, p.limit)
 
 	type res struct {
-		ID        uuid.UUID `json:"id"`
-		CreatedAt time.Time `json:"created_at"`
-		UpdatedAt time.Time `json:"updated_at"`
-		Body      string    `json:"body"`
-		UserID    uuid.UUID `json:"user_id"`
+		Chirps     []chirpResponse `json:"chirps"`
+		NextCursor string          `json:"next_cursor,omitempty"`
 	}
 
-	resBody := []res{}
+	resBody := res{Chirps: []chirpResponse{}, NextCursor: nextCursor}
 	for _, chirp := range chirps {
-		resBody = append(resBody, res{
-			chirp.ID,
-			chirp.CreatedAt,
-			chirp.UpdatedAt,
-			chirp.Body,
-			chirp.UserID,
-		})
+		resBody.Chirps = append(resBody.Chirps, newChirpResponse(chirp))
 	}
 
-	data, err := json.Marshal(resBody)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
-		return
+	if caller, ok := authFromRequest(r); ok {
+		err = cfg.markLikedByMe(r.Context(), caller.user.ID, resBody.Chirps)
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error querying database for likes: %s", err)
+			return
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
+	respondWithJSON(w, 200, resBody)
 }
 
 func (cfg *apiConfig) handlerGetChirpByID(w http.ResponseWriter, r *http.Request) {
-	chirpIDString := r.PathValue("chirpID")
-
-	chirpID, err := uuid.Parse(chirpIDString)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error parsing UUID path value %s", err)
+	chirpID, ok := pathUUID(w, r, "chirpID", "Chirp")
+	if !ok {
 		return
 	}
 
 	chirp, err := cfg.db.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 404, errCodeNotFound, "Chirp not found")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(404)
-		log.Printf("Error querying database for chirp")
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp: %s", err)
 		return
 	}
 
-	type res struct {
-		ID        uuid.UUID `json:"id"`
-		CreatedAt time.Time `json:"created_at"`
-		UpdatedAt time.Time `json:"updated_at"`
-		Body      string    `json:"body"`
-		UserID    uuid.UUID `json:"user_id"`
+	resBody := []chirpResponse{newChirpResponse(chirp)}
+
+	if caller, ok := authFromRequest(r); ok {
+		err = cfg.markLikedByMe(r.Context(), caller.user.ID, resBody)
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error querying database for likes: %s", err)
+			return
+		}
 	}
 
-	resBody := res{
-		chirp.ID,
-		chirp.CreatedAt,
-		chirp.UpdatedAt,
-		chirp.Body,
-		chirp.UserID,
+	respondWithJSON(w, 200, resBody[0])
+}
+
+func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
+	type req struct {
+		Password string `json:"password" validate:"required"`
+		Email    string `json:"email" validate:"required"`
 	}
 
-	data, err := json.Marshal(resBody)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
-}
+	subjects := loginSubjects(r, reqStruct.Email)
+	if !cfg.throttleLogin(w, r, subjects) {
+		return
+	}
 
-func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
-	type req struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+	user, err := cfg.db.GetUserByEmail(r.Context(), lookupEmail(reqStruct.Email))
+	userFound := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for user: %s", err)
+		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
+	hash := user.HashedPassword
+	if !userFound {
+		hash = dummyPasswordHash()
+	}
 
-	reqStruct := req{}
-	err := decoder.Decode(&reqStruct)
+	ok, err := auth.CheckPasswordHash(reqStruct.Password, hash)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error checking password hash: %s", err)
+		return
+	}
+
+	if !ok || !userFound {
+		rejectLogin(w, r)
+		return
+	}
+
+	err = cfg.forgiveLoginAttempt(r.Context(), subjects)
 	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error decoding JSON: %s", err)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error forgiving login attempt: %s", err)
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(r.Context(), reqStruct.Email)
+	mfaEnabled, err := cfg.mfaEnabled(r.Context(), user.ID)
 	if err != nil {
-		w.WriteHeader(404)
-		log.Printf("Error querying database for user: %s", err)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for TOTP: %s", err)
+		return
+	}
+
+	if mfaEnabled {
+		cfg.writeMFAChallenge(w, r, user.ID)
+		return
+	}
+
+	err = cfg.clearLoginFailures(r.Context(), user.Email)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error clearing login failures: %s", err)
 		return
 	}
 
-	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Duration(3600)*time.Second)
+	cfg.startSession(w, r, user)
+}
+
+// startSession logs user in: it opens a session and responds with the user
+// and a fresh access and refresh token pair.
+func (cfg *apiConfig) startSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	sessionID := uuid.New()
+
+	token, err := cfg.makeAccessToken(r.Context(), user.ID, sessionID)
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error creating a JWT: %s", err)
 		return
 	}
 
 	refreshTokenValue, err := auth.MakeRefreshToken()
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error creating a refresh token: %s", err)
 		return
 	}
 
 	currentTime := time.Now().UTC()
 
+	_, err = cfg.db.CreateSession(r.Context(), database.CreateSessionParams{
+		ID:        sessionID,
+		UserID:    user.ID,
+		CreatedAt: currentTime,
+		UserAgent: r.UserAgent(),
+		Ip:        clientIP(r),
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error inserting session to the database: %s", err)
+		return
+	}
+
 	_, err = cfg.db.CreateRefreshToken(r.Context(),
 		database.CreateRefreshTokenParams{
 			Token:     refreshTokenValue,
 			CreatedAt: currentTime,
-			ExpiresAt: currentTime.Add(time.Hour * 24 * 60),
+			ExpiresAt: currentTime.Add(refreshTokenLifetime),
 			UserID:    user.ID,
+			FamilyID:  sessionID,
 		})
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error inserting refresh token to the database: %s", err)
 		return
 	}
 
-	ok, err := auth.CheckPasswordHash(reqStruct.Password, user.HashedPassword)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error checking password hash: %s", err)
-		return
-	}
-
-	if !ok {
-		w.WriteHeader(401)
-		w.Write([]byte("Incorrect email or password"))
-		return
-	}
-
 	type res struct {
-		Id           uuid.UUID `json:"id"`
-		CreatedAt    time.Time `json:"created_at"`
-		UpdatedAt    time.Time `json:"updated_at"`
-		Email        string    `json:"email"`
-		IsChirpyRed  bool      `json:"is_chirpy_red"`
-		Token        string    `json:"token"`
-		RefreshToken string    `json:"refresh_token"`
+		Id            uuid.UUID `json:"id"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		IsChirpyRed   bool      `json:"is_chirpy_red"`
+		Token         string    `json:"token"`
+		RefreshToken  string    `json:"refresh_token"`
 	}
 
 	resStruct := res{
-		user.ID, user.CreatedAt, user.UpdatedAt,
-		user.Email, user.IsChirpyRed, token, refreshTokenValue,
-	}
-
-	data, err := json.Marshal(resStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
-		return
+		user.ID, user.CreatedAt, user.UpdatedAt, user.Email,
+		user.EmailVerifiedAt.Valid, user.IsChirpyRed, token, refreshTokenValue,
 	}
 
-	w.WriteHeader(200)
-	w.Write(data)
+	respondWithJSON(w, 200, resStruct)
 }
 
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	refreshTokenValue, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		w.WriteHeader(500)
+		writeUnauthorized(w, r, err)
 		log.Printf("Error getting refresh token from headers: %s", err)
 		return
 	}
 
-	refreshToken, err := cfg.db.GetRefreshTokenByValue(r.Context(), refreshTokenValue)
+	newRefreshTokenValue, err := auth.MakeRefreshToken()
 	if err != nil {
-		w.WriteHeader(401)
-		log.Printf("Error retrieving refresh token from database: %s", err)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error creating a refresh token: %s", err)
 		return
 	}
 
-	if (time.Now().After(refreshToken.ExpiresAt) ||
-		refreshToken.RevokedAt != sql.NullTime{}) {
-		w.WriteHeader(401)
+	currentTime := time.Now().UTC()
+
+	refreshToken, err := cfg.db.RotateRefreshToken(r.Context(), database.RotateRefreshTokenParams{
+		Now:       currentTime,
+		NewToken:  newRefreshTokenValue,
+		OldToken:  refreshTokenValue,
+		ExpiresAt: currentTime.Add(refreshTokenLifetime),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		cfg.detectRefreshTokenReuse(r, refreshTokenValue)
+		respondWithError(w, r, 401, errCodeInvalidToken, "Refresh token is invalid, expired or revoked")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error rotating refresh token: %s", err)
 		return
 	}
 
-	token, err := auth.MakeJWT(refreshToken.UserID, cfg.jwtSecret,
-		time.Duration(3600)*time.Second,
-	)
+	token, err := cfg.makeAccessToken(r.Context(), refreshToken.UserID, refreshToken.FamilyID)
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error creating a JWT: %s", err)
 		return
 	}
 
 	type res struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
-	resStruct := res{token}
+	resStruct := res{token, refreshToken.Token}
 
-	data, err := json.Marshal(resStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
+	respondWithJSON(w, 200, resStruct)
+}
+
+// detectRefreshTokenReuse revokes the whole family of a refresh token that
+// was presented again after it had been rotated. Either the client or an
+// attacker holds a stolen copy, and there is no telling which one.
+func (cfg *apiConfig) detectRefreshTokenReuse(r *http.Request, refreshTokenValue string) {
+	refreshToken, err := cfg.db.GetRefreshTokenByValue(r.Context(), refreshTokenValue)
+	if err != nil || !refreshToken.ReplacedBy.Valid {
 		return
 	}
 
-	w.WriteHeader(200)
-	w.Write(data)
+	err = cfg.db.RevokeRefreshTokenFamily(r.Context(), refreshToken.FamilyID)
+	if err != nil {
+		log.Printf("Error revoking refresh token family %s: %s", refreshToken.FamilyID, err)
+	}
+
+	logSecurityEvent(r, "refresh_token_reuse",
+		"user %s presented an already rotated refresh token, revoked token family %s",
+		refreshToken.UserID, refreshToken.FamilyID)
 }
 
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	refreshTokenValue, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		w.WriteHeader(500)
+		writeUnauthorized(w, r, err)
 		log.Printf("Error getting refresh token from headers: %s", err)
 		return
 	}
 
 	err = cfg.db.RevokeRefreshToken(r.Context(), refreshTokenValue)
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error revoking refresh token: %s", err)
 		return
 	}
@@ -476,156 +652,287 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		w.WriteHeader(401)
-		log.Printf("Error obtaining JWT from headers: %s", err)
-		return
-	}
+	caller, _ := authFromRequest(r)
 
 	type req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email               string `json:"email" validate:"required"`
+		Password            string `json:"password" validate:"required"`
+		RevokeOtherSessions bool   `json:"revoke_other_sessions"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	reqStruct := req{}
-
-	err = decoder.Decode(&reqStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error decoding JSON: %s", err)
+	if !decodeJSON(w, r, &reqStruct) {
 		return
 	}
 
-	userUUID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	email, err := mailer.NormalizeAddress(reqStruct.Email)
 	if err != nil {
-		w.WriteHeader(401)
+		respondWithValidationError(w, r, fieldError{Field: "email", Code: fieldCodeInvalid, Message: "Email address is invalid"})
+		log.Printf("Error updating user: %s %q", err, reqStruct.Email)
 		return
 	}
 
+	// A new address only replaces the current one once its owner follows the
+	// link mailed to it.
+	pendingEmail := ""
+	if email != caller.user.Email {
+		err = cfg.sendEmailVerification(r.Context(), caller.user.ID, email)
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error sending verification email: %s", err)
+			return
+		}
+
+		pendingEmail = email
+	}
+
 	hash, err := auth.HashPassword(reqStruct.Password)
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error hashing password: %s", err)
 		return
 	}
 
 	user, err := cfg.db.UpdateUser(r.Context(), database.UpdateUserParams{
-		ID:             userUUID,
-		Email:          reqStruct.Email,
+		ID:             caller.user.ID,
+		Email:          caller.user.Email,
 		HashedPassword: hash,
 	})
 	if err != nil {
-		w.WriteHeader(500)
+		respondWithError(w, r, 500, errCodeInternal, "")
 		log.Printf("Error updating database: %s", err)
 		return
 	}
 
-	type res struct {
-		Id          uuid.UUID `json:"id"`
-		CreatedAt   time.Time `json:"created_at"`
-		UpdatedAt   time.Time `json:"updated_at"`
-		Email       string    `json:"email"`
-		IsChirpyRed bool      `json:"is_chirpy_red"`
+	if reqStruct.RevokeOtherSessions {
+		err = cfg.db.RevokeUserSessions(r.Context(), database.RevokeUserSessionsParams{
+			UserID:          user.ID,
+			ExceptSessionID: uuid.NullUUID{UUID: caller.sessionID, Valid: caller.sessionID != uuid.Nil},
+		})
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error revoking sessions: %s", err)
+			return
+		}
 	}
 
-	resStruct := res{user.ID, user.CreatedAt, user.UpdatedAt, user.Email, user.IsChirpyRed}
-	data, err := json.Marshal(resStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error marshalling JSON: %s", err)
-		return
+	type res struct {
+		Id            uuid.UUID `json:"id"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		PendingEmail  string    `json:"pending_email,omitempty"`
+		IsChirpyRed   bool      `json:"is_chirpy_red"`
 	}
 
-	w.WriteHeader(200)
-	w.Write(data)
+	resStruct := res{
+		user.ID, user.CreatedAt, user.UpdatedAt, user.Email,
+		user.EmailVerifiedAt.Valid, pendingEmail, user.IsChirpyRed,
+	}
+	respondWithJSON(w, 200, resStruct)
 }
 
 func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		w.WriteHeader(401)
-		log.Printf("Error obtaining JWT: %s", err)
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	chirpID, ok := pathUUID(w, r, "chirpID", "Chirp")
+	if !ok {
 		return
 	}
 
-	userUUID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	chirp, err := cfg.db.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 404, errCodeNotFound, "Chirp not found")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(401)
-		log.Printf("Error validating JWT: %s", err)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp: %s", err)
 		return
 	}
 
-	chirpIDString := r.PathValue("chirpID")
+	if chirp.UserID != userUUID {
+		respondWithError(w, r, 403, errCodeForbidden, "Only the author can delete this chirp")
+		return
+	}
 
-	chirpID, err := uuid.Parse(chirpIDString)
+	err = cfg.db.DeleteChirp(r.Context(), chirp.ID)
 	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error parsing UUID from URL: %s", err)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error deleing chirp from database: %s", err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handlerUpdateChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	chirpID, ok := pathUUID(w, r, "chirpID", "Chirp")
+	if !ok {
+		return
+	}
+
+	type req struct {
+		Body string `json:"body" validate:"required"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
 		return
 	}
 
 	chirp, err := cfg.db.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 404, errCodeNotFound, "Chirp not found")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(404)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp: %s", err)
 		return
 	}
 
 	if chirp.UserID != userUUID {
-		w.WriteHeader(403)
+		respondWithError(w, r, 403, errCodeForbidden, "Only the author can edit this chirp")
 		return
 	}
 
-	err = cfg.db.DeleteChirp(r.Context(), chirp.ID)
+	moderationResult, err := cfg.validateChirp(caller.user, &reqStruct.Body)
 	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error deleing chirp from database: %s", err)
+		respondWithValidationError(w, r, err)
+		log.Printf("Error updating chirp: %s", err)
 		return
 	}
 
-	w.WriteHeader(204)
+	chirp, err = cfg.db.UpdateChirpBody(r.Context(), database.UpdateChirpBodyParams{
+		RevisionID: uuid.New(),
+		UpdatedAt:  time.Now(),
+		ID:         chirp.ID,
+		Body:       reqStruct.Body,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error updating chirp: %s", err)
+		return
+	}
+
+	cfg.flagChirp(r.Context(), chirp.ID, moderationResult)
+
+	resBody := newChirpResponse(chirp)
+
+	respondWithJSON(w, 200, resBody)
 }
 
-func (cfg *apiConfig) handlerUpgradeUserToRed(w http.ResponseWriter, r *http.Request) {
-	apiKey, err := auth.GetAPIKey(r.Header)
+func (cfg *apiConfig) handlerGetChirpRevisions(w http.ResponseWriter, r *http.Request) {
+	chirpID, ok := pathUUID(w, r, "chirpID", "Chirp")
+	if !ok {
+		return
+	}
+
+	_, err := cfg.db.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 404, errCodeNotFound, "Chirp not found")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(401)
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp: %s", err)
 		return
 	}
 
-	if apiKey != cfg.polkaKey {
-		w.WriteHeader(401)
+	revisions, err := cfg.db.GetChirpRevisions(r.Context(), chirpID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp revisions: %s", err)
 		return
 	}
 
-	type req struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserID uuid.UUID `json:"user_id"`
-		} `json:"data"`
+	type res struct {
+		ID         uuid.UUID `json:"id"`
+		ChirpID    uuid.UUID `json:"chirp_id"`
+		Body       string    `json:"body"`
+		CreatedAt  time.Time `json:"created_at"`
+		ReplacedAt time.Time `json:"replaced_at"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	reqStruct := req{}
+	resBody := []res{}
+	for _, revision := range revisions {
+		resBody = append(resBody, res{
+			revision.ID,
+			revision.ChirpID,
+			revision.Body,
+			revision.CreatedAt,
+			revision.ReplacedAt,
+		})
+	}
 
-	err = decoder.Decode(&reqStruct)
-	if err != nil {
-		w.WriteHeader(500)
-		log.Printf("Error decoding JSON: %s", err)
+	respondWithJSON(w, 200, resBody)
+}
+
+// handlerGetChirpThread returns the chain of chirps the requested chirp
+// replies to, oldest first, and the requested chirp with its nested replies.
+func (cfg *apiConfig) handlerGetChirpThread(w http.ResponseWriter, r *http.Request) {
+	chirpID, ok := pathUUID(w, r, "chirpID", "Chirp")
+	if !ok {
 		return
 	}
 
-	if reqStruct.Event != "user.upgraded" {
-		w.WriteHeader(204)
+	chirps, err := cfg.db.GetChirpThread(r.Context(), chirpID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp thread: %s", err)
 		return
 	}
 
-	err = cfg.db.UpgradeUserToRed(r.Context(), reqStruct.Data.UserID)
-	if err != nil {
-		w.WriteHeader(404)
+	type node struct {
+		chirpResponse
+		Replies []*node `json:"replies"`
+	}
+
+	nodes := map[uuid.UUID]*node{}
+	for _, chirp := range chirps {
+		nodes[chirp.ID] = &node{newChirpResponse(chirp), []*node{}}
+	}
+
+	target, ok := nodes[chirpID]
+	if !ok {
+		respondWithError(w, r, 404, errCodeNotFound, "Chirp not found")
 		return
 	}
 
-	w.WriteHeader(204)
+	ancestors := []chirpResponse{}
+	inAncestors := map[uuid.UUID]bool{}
+	for parentID := target.InReplyTo; parentID != nil; {
+		parent, ok := nodes[*parentID]
+		if !ok || inAncestors[parent.ID] {
+			break
+		}
+
+		ancestors = append([]chirpResponse{parent.chirpResponse}, ancestors...)
+		inAncestors[parent.ID] = true
+		parentID = parent.InReplyTo
+	}
+
+	// Chirps arrive oldest first, so replies end up in chronological order.
+	for _, chirp := range chirps {
+		if chirp.ID == chirpID || inAncestors[chirp.ID] || !chirp.InReplyTo.Valid {
+			continue
+		}
+
+		if parent, ok := nodes[chirp.InReplyTo.UUID]; ok {
+			parent.Replies = append(parent.Replies, nodes[chirp.ID])
+		}
+	}
+
+	type res struct {
+		Ancestors []chirpResponse `json:"ancestors"`
+		Chirp     *node           `json:"chirp"`
+	}
+
+	respondWithJSON(w, 200, res{ancestors, target})
 }
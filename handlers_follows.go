@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"time"
+)
+
+func (cfg *apiConfig) handlerFollowUser(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	followeeUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	if followeeUUID == userUUID {
+		respondWithError(w, r, 400, errCodeInvalidRequest, "Users cannot follow themselves")
+		log.Printf("Error following user: users cannot follow themselves")
+		return
+	}
+
+	_, err := cfg.db.GetUserByID(r.Context(), followeeUUID)
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "User not found")
+		return
+	}
+
+	err = cfg.db.FollowUser(r.Context(), database.FollowUserParams{
+		FollowerID: userUUID,
+		FolloweeID: followeeUUID,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error following user: %s", err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handlerUnfollowUser(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	followeeUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	err := cfg.db.UnfollowUser(r.Context(), database.UnfollowUserParams{
+		FollowerID: userUUID,
+		FolloweeID: followeeUUID,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error unfollowing user: %s", err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handlerListFollowers(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, cfg.db.ListFollowers, func(follow database.Follow) uuid.UUID {
+		return follow.FollowerID
+	})
+}
+
+func (cfg *apiConfig) handlerListFollowing(w http.ResponseWriter, r *http.Request) {
+	cfg.listFollows(w, r, cfg.db.ListFollowing, func(follow database.Follow) uuid.UUID {
+		return follow.FolloweeID
+	})
+}
+
+// listFollows writes one side of the follow graph of the user in the path,
+// with other picking the user on the opposite end of each edge.
+func (cfg *apiConfig) listFollows(w http.ResponseWriter, r *http.Request,
+	query func(ctx context.Context, userID uuid.UUID) ([]database.Follow, error),
+	other func(database.Follow) uuid.UUID,
+) {
+	userUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	_, err := cfg.db.GetUserByID(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "User not found")
+		return
+	}
+
+	follows, err := query(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for follows: %s", err)
+		return
+	}
+
+	type res struct {
+		UserID     uuid.UUID `json:"user_id"`
+		FollowedAt time.Time `json:"followed_at"`
+	}
+
+	resBody := []res{}
+	for _, follow := range follows {
+		resBody = append(resBody, res{other(follow), follow.CreatedAt})
+	}
+
+	respondWithJSON(w, 200, resBody)
+}
+
+func (cfg *apiConfig) handlerGetTimeline(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	p, err := parsePage(r.URL.Query())
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error parsing page parameters: %s", err)
+		return
+	}
+
+	chirps, err := cfg.db.ListTimelineChirps(r.Context(), database.ListTimelineChirpsParams{
+		FollowerID:      userUUID,
+		CursorCreatedAt: p.cursorCreatedAt,
+		CursorID:        p.cursorID,
+		Limit:           p.limit + 1,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for timeline: %s", err)
+		return
+	}
+
+	chirps, nextCursor := trimPage(chirps, p.limit)
+
+	type res struct {
+		Chirps     []chirpResponse `json:"chirps"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}
+
+	resBody := res{Chirps: []chirpResponse{}, NextCursor: nextCursor}
+	for _, chirp := range chirps {
+		resBody.Chirps = append(resBody.Chirps, newChirpResponse(chirp))
+	}
+
+	respondWithJSON(w, 200, resBody)
+}
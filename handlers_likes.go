@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"time"
+)
+
+func (cfg *apiConfig) handlerLikeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.react(w, r, func(ctx context.Context, chirpID, userID uuid.UUID) (database.Chirp, error) {
+		return cfg.db.LikeChirp(ctx, database.LikeChirpParams{
+			ChirpID:   chirpID,
+			UserID:    userID,
+			CreatedAt: time.Now(),
+		})
+	})
+}
+
+func (cfg *apiConfig) handlerUnlikeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.react(w, r, func(ctx context.Context, chirpID, userID uuid.UUID) (database.Chirp, error) {
+		return cfg.db.UnlikeChirp(ctx, database.UnlikeChirpParams{
+			ChirpID: chirpID,
+			UserID:  userID,
+		})
+	})
+}
+
+func (cfg *apiConfig) handlerRechirpChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.react(w, r, func(ctx context.Context, chirpID, userID uuid.UUID) (database.Chirp, error) {
+		return cfg.db.RechirpChirp(ctx, database.RechirpChirpParams{
+			ChirpID:   chirpID,
+			UserID:    userID,
+			CreatedAt: time.Now(),
+		})
+	})
+}
+
+func (cfg *apiConfig) handlerUnrechirpChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.react(w, r, func(ctx context.Context, chirpID, userID uuid.UUID) (database.Chirp, error) {
+		return cfg.db.UnrechirpChirp(ctx, database.UnrechirpChirpParams{
+			ChirpID: chirpID,
+			UserID:  userID,
+		})
+	})
+}
+
+// react applies an idempotent like or rechirp change for the caller and
+// responds with the chirp's updated counters.
+func (cfg *apiConfig) react(w http.ResponseWriter, r *http.Request,
+	apply func(ctx context.Context, chirpID, userID uuid.UUID) (database.Chirp, error),
+) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	chirpID, ok := pathUUID(w, r, "chirpID", "Chirp")
+	if !ok {
+		return
+	}
+
+	_, err := cfg.db.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 404, errCodeNotFound, "Chirp not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp: %s", err)
+		return
+	}
+
+	chirp, err := apply(r.Context(), chirpID, userUUID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error updating chirp reactions: %s", err)
+		return
+	}
+
+	resBody := []chirpResponse{newChirpResponse(chirp)}
+
+	err = cfg.markLikedByMe(r.Context(), userUUID, resBody)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for likes: %s", err)
+		return
+	}
+
+	respondWithJSON(w, 200, resBody[0])
+}
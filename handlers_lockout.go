@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per account, keyed by the email that was tried so
+// unknown addresses are throttled the same way as real ones, and per client
+// IP. Failures older than loginFailureWindow are forgotten.
+const (
+	loginScopeAccount  = "account"
+	loginScopeIP       = "ip"
+	loginFailureWindow = time.Hour
+)
+
+// loginThrottle is the policy for one scope: the first freeAttempts failures
+// cost nothing, the following ones block further attempts for a delay that
+// doubles each time, and from lockoutAfter failures on the scope is locked
+// out for lockout.
+type loginThrottle struct {
+	freeAttempts int32
+	lockoutAfter int32
+	lockout      time.Duration
+}
+
+var loginThrottles = map[string]loginThrottle{
+	loginScopeAccount: {freeAttempts: 3, lockoutAfter: 10, lockout: 15 * time.Minute},
+	// Addresses are shared behind NAT, so they get more room than an account.
+	loginScopeIP: {freeAttempts: 20, lockoutAfter: 100, lockout: 15 * time.Minute},
+}
+
+func (t loginThrottle) blockFor(failures int32) time.Duration {
+	if failures >= t.lockoutAfter {
+		return t.lockout
+	}
+
+	if failures < t.freeAttempts {
+		return 0
+	}
+
+	backoff := time.Second * time.Duration(math.Pow(2, float64(failures-t.freeAttempts)))
+	return min(backoff, t.lockout)
+}
+
+// schedule lists blockFor in seconds for one failure up to lockoutAfter, as
+// RecordLoginAttempt takes it.
+func (t loginThrottle) schedule() []int32 {
+	schedule := []int32{}
+	for failures := int32(1); failures <= t.lockoutAfter; failures++ {
+		schedule = append(schedule, int32(t.blockFor(failures)/time.Second))
+	}
+
+	return schedule
+}
+
+// dummyPasswordHash is checked against when the email is unknown, so the
+// response takes as long as it does for a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := auth.HashPassword("chirpy-dummy-password")
+	if err != nil {
+		log.Printf("Error hashing dummy password: %s", err)
+	}
+
+	return hash
+})
+
+type loginSubject struct {
+	scope   string
+	subject string
+}
+
+func loginSubjects(r *http.Request, email string) []loginSubject {
+	return []loginSubject{
+		{loginScopeAccount, lookupEmail(email)},
+		{loginScopeIP, clientIP(r)},
+	}
+}
+
+// loginRetryAfter returns how long a blocked subject has to wait.
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, s loginSubject) (time.Duration, error) {
+	failure, err := cfg.db.GetLoginFailure(ctx, database.GetLoginFailureParams{
+		Scope:   s.scope,
+		Subject: s.subject,
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// The block may have run out since the attempt was refused.
+	return max(time.Until(failure.BlockedUntil.Time), time.Second), nil
+}
+
+// forgiveLoginAttempt takes back what throttleLogin counted for an attempt
+// that did not fail.
+func (cfg *apiConfig) forgiveLoginAttempt(ctx context.Context, subjects []loginSubject) error {
+	for _, s := range subjects {
+		err := cfg.db.ForgiveLoginAttempt(ctx, database.ForgiveLoginAttemptParams{
+			Scope:   s.scope,
+			Subject: s.subject,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cfg *apiConfig) clearLoginFailures(ctx context.Context, email string) error {
+	return cfg.db.ClearLoginFailures(ctx, database.ClearLoginFailuresParams{
+		Scope:   loginScopeAccount,
+		Subject: lookupEmail(email),
+	})
+}
+
+// throttleLogin counts the attempt as a failure of every subject before the
+// credentials are checked, so a burst of parallel attempts runs into the
+// block the first ones set. It answers 429 and returns false when a subject
+// is blocked. Attempts that succeed are taken back with forgiveLoginAttempt.
+func (cfg *apiConfig) throttleLogin(w http.ResponseWriter, r *http.Request, subjects []loginSubject) bool {
+	currentTime := time.Now().UTC()
+
+	for i, s := range subjects {
+		throttle := loginThrottles[s.scope]
+
+		failure, err := cfg.db.RecordLoginAttempt(r.Context(), database.RecordLoginAttemptParams{
+			Scope:       s.scope,
+			Subject:     s.subject,
+			Now:         currentTime,
+			Schedule:    throttle.schedule(),
+			WindowStart: currentTime.Add(-loginFailureWindow),
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			// A refused attempt does not count against the other subjects.
+			err = cfg.forgiveLoginAttempt(r.Context(), subjects[:i])
+			if err != nil {
+				respondWithError(w, r, 500, errCodeInternal, "")
+				log.Printf("Error forgiving login attempt: %s", err)
+				return false
+			}
+
+			wait, err := cfg.loginRetryAfter(r.Context(), s)
+			if err != nil {
+				respondWithError(w, r, 500, errCodeInternal, "")
+				log.Printf("Error querying database for login failures: %s", err)
+				return false
+			}
+
+			w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(wait)))
+			respondWithError(w, r, 429, errCodeLoginThrottled, "Too many failed logins, try again later")
+			log.Printf("Error logging in: too many failed attempts, retry in %s", wait)
+			return false
+		}
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error recording login attempt: %s", err)
+			return false
+		}
+
+		if failure.Failures == throttle.lockoutAfter {
+			logSecurityEvent(r, "login_locked_out", "%s %s locked out after %d failed logins",
+				s.scope, s.subject, failure.Failures)
+		}
+	}
+
+	return true
+}
+
+// rejectLogin answers 401 with the same body whether the email, the password
+// or the second factor was wrong. throttleLogin already counted the failure.
+func rejectLogin(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, r, 401, errCodeInvalidCredentials, "Incorrect email or password")
+}
+
+func (cfg *apiConfig) handlerUnlockUser(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	userUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "User not found")
+		return
+	}
+
+	err = cfg.clearLoginFailures(r.Context(), user.Email)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error clearing login failures: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "login_unlocked", "user %s unlocked user %s", caller.user.ID, user.ID)
+
+	w.WriteHeader(204)
+}
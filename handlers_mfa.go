@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	mfaTokenLifetime  = 5 * time.Minute
+	totpIssuer        = "Chirpy"
+	recoveryCodeCount = 10
+)
+
+// makeRecoveryCode returns 50 random bits as ten base32 characters, split in
+// two so they are easier to copy down.
+func makeRecoveryCode() (string, error) {
+	raw := make([]byte, 5)
+
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+	return code[:5] + "-" + code[5:], nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return auth.HashToken(code)
+}
+
+func (cfg *apiConfig) mfaEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	totp, err := cfg.db.GetUserTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return totp.ConfirmedAt.Valid, nil
+}
+
+// checkTOTP validates code against the user's TOTP secret. Each code is
+// accepted once, so one seen over someone's shoulder cannot be replayed.
+func (cfg *apiConfig) checkTOTP(ctx context.Context, totp database.UserTotp, code string) (bool, error) {
+	if cfg.totpBox == nil {
+		return false, errors.New("TOTP_ENCRYPTION_KEY is not set")
+	}
+
+	secret, err := cfg.totpBox.Open(totp.SecretCiphertext, totp.UserID[:])
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	used, err := cfg.db.UseTOTPStep(ctx, database.UseTOTPStepParams{
+		UserID:       totp.UserID,
+		LastUsedStep: step,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return used == 1, nil
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code
+// from a user with confirmed two-factor authentication.
+func (cfg *apiConfig) checkSecondFactor(r *http.Request, userID uuid.UUID, code, recoveryCode string) (bool, error) {
+	totp, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !totp.ConfirmedAt.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if recoveryCode == "" {
+		return cfg.checkTOTP(r.Context(), totp, code)
+	}
+
+	used, err := cfg.db.UseTOTPRecoveryCode(r.Context(), database.UseTOTPRecoveryCodeParams{
+		UserID:   userID,
+		CodeHash: hashRecoveryCode(recoveryCode),
+		UsedAt:   sql.NullTime{Time: time.Now().UTC(), Valid: true},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if used == 1 {
+		logSecurityEvent(r, "mfa_recovery_code_used", "user %s used a recovery code", userID)
+	}
+
+	return used == 1, nil
+}
+
+func (cfg *apiConfig) writeMFAChallenge(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	mfaToken, err := cfg.jwtKeys.MakeMFAToken(userID, mfaTokenLifetime)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error creating an MFA token: %s", err)
+		return
+	}
+
+	type res struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+
+	respondWithJSON(w, 200, res{true, mfaToken})
+}
+
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type req struct {
+		MFAToken     string `json:"mfa_token" validate:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	userUUID, err := cfg.jwtKeys.ValidateMFAToken(reqStruct.MFAToken)
+	if err != nil {
+		writeUnauthorized(w, r, err)
+		log.Printf("Error validating MFA token: %s", err)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 401, errCodeInvalidToken, "MFA token is invalid")
+		log.Printf("Error querying database for user: %s", err)
+		return
+	}
+
+	// Guessing codes counts towards the same lockout as guessing passwords.
+	subjects := loginSubjects(r, user.Email)
+	if !cfg.throttleLogin(w, r, subjects) {
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(r, user.ID, reqStruct.Code, reqStruct.RecoveryCode)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error checking second factor: %s", err)
+		return
+	}
+
+	if !ok {
+		rejectLogin(w, r)
+		return
+	}
+
+	err = cfg.forgiveLoginAttempt(r.Context(), subjects)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error forgiving login attempt: %s", err)
+		return
+	}
+
+	err = cfg.clearLoginFailures(r.Context(), user.Email)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error clearing login failures: %s", err)
+		return
+	}
+
+	cfg.startSession(w, r, user)
+}
+
+func (cfg *apiConfig) handlerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	if cfg.totpBox == nil {
+		respondWithError(w, r, 503, errCodeUnavailable, "Two-factor authentication is not configured")
+		log.Printf("Error enrolling TOTP: TOTP_ENCRYPTION_KEY is not set")
+		return
+	}
+
+	enabled, err := cfg.mfaEnabled(r.Context(), caller.user.ID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for TOTP: %s", err)
+		return
+	}
+
+	if enabled {
+		respondWithError(w, r, 409, errCodeMFAEnabled, "Two-factor authentication is already enabled")
+		log.Printf("Error enrolling TOTP: already enabled for user %s", caller.user.ID)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error generating TOTP secret: %s", err)
+		return
+	}
+
+	ciphertext, err := cfg.totpBox.Seal(secret, caller.user.ID[:])
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error encrypting TOTP secret: %s", err)
+		return
+	}
+
+	err = cfg.db.UpsertUserTOTP(r.Context(), database.UpsertUserTOTPParams{
+		UserID:           caller.user.ID,
+		SecretCiphertext: ciphertext,
+		CreatedAt:        time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error inserting TOTP secret to the database: %s", err)
+		return
+	}
+
+	type res struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+
+	respondWithJSON(w, 201, res{
+		auth.EncodeTOTPSecret(secret),
+		auth.TOTPURI(totpIssuer, caller.user.Email, secret),
+	})
+}
+
+func (cfg *apiConfig) handlerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	type req struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), caller.user.ID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && totp.ConfirmedAt.Valid) {
+		respondWithError(w, r, 409, errCodeMFANotEnrolled, "No two-factor enrollment in progress")
+		log.Printf("Error confirming TOTP: no enrollment in progress for user %s", caller.user.ID)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for TOTP: %s", err)
+		return
+	}
+
+	ok, err := cfg.checkTOTP(r.Context(), totp, reqStruct.Code)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error checking TOTP code: %s", err)
+		return
+	}
+
+	if !ok {
+		respondWithError(w, r, 400, errCodeInvalidMFACode, "Code is incorrect")
+		log.Printf("Error confirming TOTP: incorrect code")
+		return
+	}
+
+	currentTime := time.Now().UTC()
+
+	err = cfg.db.DeleteTOTPRecoveryCodes(r.Context(), caller.user.ID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error deleting recovery codes: %s", err)
+		return
+	}
+
+	recoveryCodes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code, err := makeRecoveryCode()
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error creating a recovery code: %s", err)
+			return
+		}
+
+		err = cfg.db.CreateTOTPRecoveryCode(r.Context(), database.CreateTOTPRecoveryCodeParams{
+			UserID:    caller.user.ID,
+			CodeHash:  hashRecoveryCode(code),
+			CreatedAt: currentTime,
+		})
+		if err != nil {
+			respondWithError(w, r, 500, errCodeInternal, "")
+			log.Printf("Error inserting recovery code to the database: %s", err)
+			return
+		}
+
+		recoveryCodes = append(recoveryCodes, code)
+	}
+
+	err = cfg.db.ConfirmUserTOTP(r.Context(), database.ConfirmUserTOTPParams{
+		UserID:      caller.user.ID,
+		ConfirmedAt: sql.NullTime{Time: currentTime, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error confirming TOTP: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "mfa_enabled", "user %s enabled TOTP", caller.user.ID)
+
+	type res struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	respondWithJSON(w, 200, res{recoveryCodes})
+}
+
+func (cfg *apiConfig) handlerDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	type req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	// A stolen access token alone is not enough to turn the second factor off.
+	ok, err := cfg.checkSecondFactor(r, caller.user.ID, reqStruct.Code, reqStruct.RecoveryCode)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error checking second factor: %s", err)
+		return
+	}
+
+	if !ok {
+		respondWithError(w, r, 400, errCodeInvalidMFACode,
+			"Code is incorrect or two-factor authentication is not enabled")
+		log.Printf("Error disabling TOTP: incorrect code or TOTP not enabled")
+		return
+	}
+
+	err = cfg.db.DeleteUserTOTP(r.Context(), caller.user.ID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error deleting TOTP: %s", err)
+		return
+	}
+
+	err = cfg.db.DeleteTOTPRecoveryCodes(r.Context(), caller.user.ID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error deleting recovery codes: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "mfa_disabled", "user %s disabled TOTP", caller.user.ID)
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"github.com/rQxwX3/chirpy/internal/moderation"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// moderationReloadInterval is how often the word list is reloaded, which is
+// how changes made through another instance reach this one.
+const moderationReloadInterval = time.Minute
+
+// reloadModeration rebuilds the moderation rule chain from the rules file and
+// the word list stored in the database. Reloads are serialized, so a slower
+// one cannot install a word list older than the one before it.
+func (cfg *apiConfig) reloadModeration(ctx context.Context) error {
+	cfg.moderationMu.Lock()
+	defer cfg.moderationMu.Unlock()
+
+	words, err := cfg.db.ListModerationWords(ctx)
+	if err != nil {
+		return err
+	}
+
+	wordActions := map[string]moderation.Action{}
+	for _, word := range words {
+		action, ok := moderation.ParseAction(word.Action)
+		if !ok {
+			log.Printf("Skipping moderation word %q with unknown action %q", word.Word, word.Action)
+			continue
+		}
+
+		wordActions[word.Word] = action
+	}
+
+	rules := slices.Clone(cfg.moderationFileRules)
+	rules = append(rules, moderation.WordRules("words", wordActions)...)
+	cfg.moderator.SetRules(rules...)
+
+	return nil
+}
+
+// runModerationReload calls reloadModeration every interval until ctx is done.
+func (cfg *apiConfig) runModerationReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := cfg.reloadModeration(ctx); err != nil {
+			log.Printf("Error reloading moderation rules: %s", err)
+		}
+	}
+}
+
+func (cfg *apiConfig) flagChirp(ctx context.Context, chirpID uuid.UUID, result moderation.Result) {
+	for _, rule := range result.Flags {
+		_, err := cfg.db.CreateChirpFlag(ctx, database.CreateChirpFlagParams{
+			ID:        uuid.New(),
+			ChirpID:   chirpID,
+			Rule:      rule,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			log.Printf("Error flagging chirp %s for review: %s", chirpID, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) handlerListModerationWords(w http.ResponseWriter, r *http.Request) {
+	words, err := cfg.db.ListModerationWords(r.Context())
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for moderation words: %s", err)
+		return
+	}
+
+	type res struct {
+		Word      string    `json:"word"`
+		Action    string    `json:"action"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	resBody := []res{}
+	for _, word := range words {
+		resBody = append(resBody, res{word.Word, word.Action, word.CreatedAt, word.UpdatedAt})
+	}
+
+	respondWithJSON(w, 200, resBody)
+}
+
+func (cfg *apiConfig) handlerPutModerationWord(w http.ResponseWriter, r *http.Request) {
+	type req struct {
+		Word   string `json:"word" validate:"required"`
+		Action string `json:"action"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	if reqStruct.Action == "" {
+		reqStruct.Action = string(moderation.ActionMask)
+	}
+
+	action, ok := moderation.ParseAction(reqStruct.Action)
+	if !ok {
+		respondWithValidationError(w, r,
+			fieldError{Field: "action", Code: fieldCodeInvalid, Message: fmt.Sprintf("Unknown action %q", reqStruct.Action)})
+		log.Printf("Error updating moderation words: unknown action %q", reqStruct.Action)
+		return
+	}
+
+	tokens := moderation.Tokenize(reqStruct.Word)
+	if len(tokens) != 1 || tokens[0].Normalized != moderation.Normalize(reqStruct.Word) {
+		respondWithValidationError(w, r, fieldError{Field: "word", Code: fieldCodeInvalid, Message: "Must be a single word"})
+		log.Printf("Error updating moderation words: %q is not a single word", reqStruct.Word)
+		return
+	}
+
+	word, err := cfg.db.UpsertModerationWord(r.Context(), database.UpsertModerationWordParams{
+		Word:      tokens[0].Normalized,
+		Action:    string(action),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error updating moderation words: %s", err)
+		return
+	}
+
+	err = cfg.reloadModeration(r.Context())
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error reloading moderation rules: %s", err)
+		return
+	}
+
+	type res struct {
+		Word      string    `json:"word"`
+		Action    string    `json:"action"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	respondWithJSON(w, 200, res{word.Word, word.Action, word.CreatedAt, word.UpdatedAt})
+}
+
+func (cfg *apiConfig) handlerDeleteModerationWord(w http.ResponseWriter, r *http.Request) {
+	deleted, err := cfg.db.DeleteModerationWord(r.Context(),
+		moderation.Normalize(r.PathValue("word")))
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error deleting moderation word: %s", err)
+		return
+	}
+
+	if deleted == 0 {
+		respondWithError(w, r, 404, errCodeNotFound, "Moderation word not found")
+		return
+	}
+
+	err = cfg.reloadModeration(r.Context())
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error reloading moderation rules: %s", err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handlerListChirpFlags(w http.ResponseWriter, r *http.Request) {
+	flags, err := cfg.db.ListChirpFlags(r.Context())
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for chirp flags: %s", err)
+		return
+	}
+
+	type res struct {
+		ID        uuid.UUID `json:"id"`
+		ChirpID   uuid.UUID `json:"chirp_id"`
+		Rule      string    `json:"rule"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	resBody := []res{}
+	for _, flag := range flags {
+		resBody = append(resBody, res{flag.ID, flag.ChirpID, flag.Rule, flag.CreatedAt})
+	}
+
+	respondWithJSON(w, 200, resBody)
+}
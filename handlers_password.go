@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"github.com/rQxwX3/chirpy/internal/mailer"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	passwordResetTokenLifetime = time.Hour
+	passwordResetMailTimeout   = 30 * time.Second
+)
+
+func (cfg *apiConfig) handlerForgotPassword(w http.ResponseWriter, r *http.Request) {
+	type req struct {
+		Email string `json:"email" validate:"required"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	// Unknown addresses get the same answer, so the endpoint cannot be used to
+	// find out who has an account.
+	user, err := cfg.db.GetUserByEmail(r.Context(), lookupEmail(reqStruct.Email))
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(202)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for user: %s", err)
+		return
+	}
+
+	// The token is stored and mailed after answering, so known addresses are
+	// not told apart by a slower answer or by a mail failure.
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), passwordResetMailTimeout)
+		defer cancel()
+
+		err := cfg.sendPasswordReset(ctx, user)
+		if err != nil {
+			log.Printf("Error sending password reset email: %s", err)
+		}
+	}()
+
+	w.WriteHeader(202)
+}
+
+func (cfg *apiConfig) sendPasswordReset(ctx context.Context, user database.User) error {
+	resetToken, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	currentTime := time.Now().UTC()
+
+	err = cfg.db.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashToken(resetToken),
+		UserID:    user.ID,
+		CreatedAt: currentTime,
+		ExpiresAt: currentTime.Add(passwordResetTokenLifetime),
+	})
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account.\n\n"+
+			"To choose a new one, send your reset token and new password to\n"+
+			"POST %s/api/password/reset\n\n"+
+			"    {\"token\": \"%s\", \"password\": \"<new password>\"}\n\n"+
+			"The token expires in an hour. If it wasn't you, ignore this email.\n",
+			cfg.publicURL, resetToken),
+	})
+}
+
+func (cfg *apiConfig) handlerResetPassword(w http.ResponseWriter, r *http.Request) {
+	type req struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	currentTime := time.Now().UTC()
+
+	userUUID, err := cfg.db.ConsumePasswordResetToken(r.Context(),
+		database.ConsumePasswordResetTokenParams{
+			Now:       currentTime,
+			TokenHash: auth.HashToken(reqStruct.Token),
+		})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 400, errCodeInvalidToken, "Reset token is invalid, used or expired")
+		log.Printf("Error resetting password: unknown, used or expired token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error consuming password reset token: %s", err)
+		return
+	}
+
+	hash, err := auth.HashPassword(reqStruct.Password)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error hashing password: %s", err)
+		return
+	}
+
+	err = cfg.db.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+		ID:             userUUID,
+		HashedPassword: hash,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error updating database: %s", err)
+		return
+	}
+
+	err = cfg.db.InvalidatePasswordResetTokens(r.Context(),
+		database.InvalidatePasswordResetTokensParams{
+			UserID: userUUID,
+			UsedAt: sql.NullTime{Time: currentTime, Valid: true},
+		})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error invalidating password reset tokens: %s", err)
+		return
+	}
+
+	// Whoever knew the old password may still hold a session or have created
+	// personal access tokens.
+	err = cfg.db.RevokeUserSessions(r.Context(), database.RevokeUserSessionsParams{
+		UserID: userUUID,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error revoking sessions: %s", err)
+		return
+	}
+
+	err = cfg.db.RevokeUserPersonalAccessTokens(r.Context(),
+		database.RevokeUserPersonalAccessTokensParams{
+			UserID:    userUUID,
+			RevokedAt: sql.NullTime{Time: currentTime, Valid: true},
+		})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error revoking personal access tokens: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "password_reset", "user %s reset their password", userUUID)
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Polka deliveries are authenticated by their HMAC signature when
+// POLKA_WEBHOOK_SECRET is set and by the static API key otherwise. Each one
+// is stored in polka_events under its event ID before it is processed, so a
+// retried delivery is answered from the log instead of being applied again
+// and failed ones can be re-run by an admin.
+const (
+	polkaSignatureHeader    = "Polka-Signature"
+	polkaSignatureTolerance = 5 * time.Minute
+	// polkaClaimTimeout is how long an event can be processing before it is
+	// taken to be abandoned and may be claimed again.
+	polkaClaimTimeout = 5 * time.Minute
+)
+
+// Processing states of a stored Polka event. An event is processing while one
+// request applies it. Rejected events can never succeed as they are, failed
+// ones may on a retry.
+const (
+	polkaStatusReceived   = "received"
+	polkaStatusProcessing = "processing"
+	polkaStatusProcessed  = "processed"
+	polkaStatusIgnored    = "ignored"
+	polkaStatusRejected   = "rejected"
+	polkaStatusFailed     = "failed"
+)
+
+var (
+	errPolkaUserNotFound   = errors.New("User not found")
+	errPolkaInvalidPayload = errors.New("Invalid payload")
+)
+
+type polkaPayload struct {
+	ID    string `json:"id"`
+	Event string `json:"event" validate:"required"`
+	Data  struct {
+		UserID    string     `json:"user_id" validate:"required,uuid"`
+		Plan      string     `json:"plan"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	} `json:"data"`
+}
+
+func (cfg *apiConfig) authenticatePolka(r *http.Request, body []byte) error {
+	if cfg.polkaWebhookSecret != "" {
+		return auth.VerifyWebhookSignature([]byte(cfg.polkaWebhookSecret), r.Header.Get(polkaSignatureHeader),
+			body, time.Now(), polkaSignatureTolerance)
+	}
+
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.polkaKey)) != 1 {
+		return errors.New("API key mismatch")
+	}
+
+	return nil
+}
+
+// claimPolkaEvent takes a received or failed event for processing, returning
+// false when it is settled or being processed by another request.
+func (cfg *apiConfig) claimPolkaEvent(ctx context.Context, id string) (database.PolkaEvent, bool, error) {
+	currentTime := time.Now().UTC()
+
+	event, err := cfg.db.ClaimPolkaEvent(ctx, database.ClaimPolkaEventParams{
+		Now:         currentTime,
+		ID:          id,
+		StaleBefore: currentTime.Add(-polkaClaimTimeout),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.PolkaEvent{}, false, nil
+	}
+	if err != nil {
+		return database.PolkaEvent{}, false, err
+	}
+
+	return event, true, nil
+}
+
+// processPolkaEvent applies a claimed event and records the outcome on it.
+// The error is only about recording the outcome; processing errors end up in
+// the returned event.
+func (cfg *apiConfig) processPolkaEvent(ctx context.Context, event database.PolkaEvent) (database.PolkaEvent, error) {
+	finish := database.FinishPolkaEventParams{
+		ID:          event.ID,
+		Status:      polkaStatusProcessed,
+		ProcessedAt: sql.NullTime{Time: time.Now().UTC(), Valid: true},
+	}
+
+	payload := polkaPayload{}
+	err := json.Unmarshal(event.Payload, &payload)
+	if err == nil {
+		err = validateStruct(&payload, "json")
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", errPolkaInvalidPayload, err)
+	}
+
+	changed := false
+	if err == nil {
+		changed, err = cfg.applyPolkaEvent(ctx, payload)
+	}
+
+	switch {
+	case errors.Is(err, errPolkaUserNotFound), errors.Is(err, errPolkaInvalidPayload):
+		finish.Status = polkaStatusRejected
+	case err != nil:
+		finish.Status = polkaStatusFailed
+		finish.ProcessedAt = sql.NullTime{}
+	case !changed:
+		finish.Status = polkaStatusIgnored
+	}
+
+	if err != nil {
+		finish.LastError = sql.NullString{String: err.Error(), Valid: true}
+		log.Printf("Error processing Polka event %s: %s", event.ID, err)
+	}
+
+	return cfg.db.FinishPolkaEvent(ctx, finish)
+}
+
+// respondWithPolkaResult answers a delivery with the outcome of its event, so
+// Polka retries exactly the deliveries that may still succeed.
+func respondWithPolkaResult(w http.ResponseWriter, r *http.Request, event database.PolkaEvent) {
+	switch event.Status {
+	case polkaStatusProcessed, polkaStatusIgnored:
+		w.WriteHeader(204)
+	case polkaStatusRejected:
+		if strings.HasPrefix(event.LastError.String, errPolkaInvalidPayload.Error()) {
+			respondWithError(w, r, 400, errCodeInvalidRequest, event.LastError.String)
+			return
+		}
+
+		respondWithError(w, r, 404, errCodeNotFound, event.LastError.String)
+	default:
+		w.Header().Set("Retry-After", "60")
+		respondWithError(w, r, 503, errCodeUnavailable, "Event could not be processed, retry later")
+	}
+}
+
+func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		respondWithDecodeError(w, r, err)
+		log.Printf("Error reading Polka webhook: %s", err)
+		return
+	}
+
+	err = cfg.authenticatePolka(r, body)
+	if err != nil {
+		respondWithError(w, r, 401, errCodeUnauthorized, "Invalid webhook credentials")
+		logSecurityEvent(r, "webhook_rejected", "Polka webhook failed authentication: %s", err)
+		return
+	}
+
+	// Only JSON can be stored. The rest is checked once the delivery is
+	// logged, and leniently, so a field Polka adds does not get deliveries
+	// refused unseen.
+	if !json.Valid(body) {
+		respondWithError(w, r, 400, errCodeInvalidJSON, "Request body is not valid JSON")
+		log.Printf("Error decoding Polka webhook: body is not valid JSON")
+		return
+	}
+
+	payload := polkaPayload{}
+	json.Unmarshal(body, &payload)
+
+	eventID := payload.ID
+	if eventID == "" {
+		// Identical deliveries without an ID may well be separate events, so
+		// they are logged but cannot be recognized as retries.
+		eventID = "generated:" + uuid.NewString()
+	}
+
+	_, err = cfg.db.CreatePolkaEvent(r.Context(), database.CreatePolkaEventParams{
+		ID:         eventID,
+		Event:      payload.Event,
+		Payload:    body,
+		Status:     polkaStatusReceived,
+		ReceivedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, r, 503, errCodeUnavailable, "Event could not be stored, retry later")
+		log.Printf("Error storing Polka event: %s", err)
+		return
+	}
+
+	event, claimed, err := cfg.claimPolkaEvent(r.Context(), eventID)
+	if err != nil {
+		respondWithError(w, r, 503, errCodeUnavailable, "Event could not be processed, retry later")
+		log.Printf("Error claiming Polka event: %s", err)
+		return
+	}
+
+	if !claimed {
+		event, err = cfg.db.GetPolkaEvent(r.Context(), eventID)
+		if err != nil {
+			respondWithError(w, r, 503, errCodeUnavailable, "Event could not be stored, retry later")
+			log.Printf("Error querying database for Polka event: %s", err)
+			return
+		}
+
+		log.Printf("Polka event %s is already %s", eventID, event.Status)
+		respondWithPolkaResult(w, r, event)
+		return
+	}
+
+	event, err = cfg.processPolkaEvent(r.Context(), event)
+	if err != nil {
+		respondWithError(w, r, 503, errCodeUnavailable, "Event could not be processed, retry later")
+		log.Printf("Error recording Polka event result: %s", err)
+		return
+	}
+
+	respondWithPolkaResult(w, r, event)
+}
+
+type polkaEventResponse struct {
+	ID          string          `json:"id"`
+	Event       string          `json:"event"`
+	Status      string          `json:"status"`
+	Attempts    int32           `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt *time.Time      `json:"processed_at"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+func newPolkaEventResponse(event database.PolkaEvent) polkaEventResponse {
+	return polkaEventResponse{
+		ID:          event.ID,
+		Event:       event.Event,
+		Status:      event.Status,
+		Attempts:    event.Attempts,
+		LastError:   event.LastError.String,
+		ReceivedAt:  event.ReceivedAt,
+		ProcessedAt: nullTimePtr(event.ProcessedAt),
+	}
+}
+
+func (cfg *apiConfig) handlerListPolkaEvents(w http.ResponseWriter, r *http.Request) {
+	type params struct {
+		Status string `query:"status" validate:"oneof=received processing processed ignored rejected failed"`
+	}
+
+	paramsStruct := params{}
+	if !decodeQuery(w, r, &paramsStruct) {
+		return
+	}
+
+	limit, err := parsePageLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error parsing page parameters: %s", err)
+		return
+	}
+
+	events, err := cfg.db.ListPolkaEvents(r.Context(), database.ListPolkaEventsParams{
+		Status: sql.NullString{String: paramsStruct.Status, Valid: paramsStruct.Status != ""},
+		Limit:  limit,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for Polka events: %s", err)
+		return
+	}
+
+	resBody := []polkaEventResponse{}
+	for _, event := range events {
+		resBody = append(resBody, newPolkaEventResponse(event))
+	}
+
+	respondWithJSON(w, 200, resBody)
+}
+
+func (cfg *apiConfig) handlerGetPolkaEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.db.GetPolkaEvent(r.Context(), r.PathValue("eventID"))
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "Event not found")
+		return
+	}
+
+	resBody := newPolkaEventResponse(event)
+	resBody.Payload = event.Payload
+
+	respondWithJSON(w, 200, resBody)
+}
+
+func (cfg *apiConfig) handlerRerunPolkaEvent(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	event, err := cfg.db.GetPolkaEvent(r.Context(), r.PathValue("eventID"))
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "Event not found")
+		return
+	}
+
+	// Applying an event twice is not harmless: a renewal without expires_at
+	// would add another period.
+	claimedEvent, claimed, err := cfg.claimPolkaEvent(r.Context(), event.ID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error claiming Polka event: %s", err)
+		return
+	}
+
+	if !claimed {
+		respondWithError(w, r, 409, errCodeEventNotRetryable,
+			fmt.Sprintf("Only received or failed events can be re-run, this one was %s", event.Status))
+		return
+	}
+
+	event, err = cfg.processPolkaEvent(r.Context(), claimedEvent)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error recording Polka event result: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "webhook_rerun", "user %s re-ran Polka event %s: %s",
+		caller.user.ID, event.ID, event.Status)
+
+	respondWithJSON(w, 200, newPolkaEventResponse(event))
+}
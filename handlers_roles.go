@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Every account has roleUser; the other roles are granted and stored in
+// user_roles. An admin can do everything a moderator can.
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+func isGrantableRole(role string) bool {
+	return role == roleModerator || role == roleAdmin
+}
+
+func hasRole(roles []string, role string) bool {
+	if slices.Contains(roles, roleAdmin) {
+		return true
+	}
+
+	return slices.Contains(roles, role)
+}
+
+func (cfg *apiConfig) userRoles(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	roles, err := cfg.db.ListUserRoles(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{roleUser}, roles...), nil
+}
+
+func (cfg *apiConfig) handlerListUserRoles(w http.ResponseWriter, r *http.Request) {
+	userUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	_, err := cfg.db.GetUserByID(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "User not found")
+		return
+	}
+
+	roles, err := cfg.userRoles(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for roles: %s", err)
+		return
+	}
+
+	type res struct {
+		UserID uuid.UUID `json:"user_id"`
+		Roles  []string  `json:"roles"`
+	}
+
+	respondWithJSON(w, 200, res{userUUID, roles})
+}
+
+func (cfg *apiConfig) handlerGrantUserRole(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	userUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	role := r.PathValue("role")
+	if !isGrantableRole(role) {
+		respondWithError(w, r, 400, errCodeInvalidRequest, fmt.Sprintf("Unknown role %q", role))
+		log.Printf("Error granting role: unknown role %q", role)
+		return
+	}
+
+	_, err := cfg.db.GetUserByID(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, "User not found")
+		return
+	}
+
+	err = cfg.db.GrantUserRole(r.Context(), database.GrantUserRoleParams{
+		UserID:    userUUID,
+		Role:      role,
+		GrantedAt: time.Now(),
+		GrantedBy: uuid.NullUUID{UUID: caller.user.ID, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error granting role: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "role_granted", "user %s granted %s to user %s",
+		caller.user.ID, role, userUUID)
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handlerRevokeUserRole(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	userUUID, ok := pathUUID(w, r, "userID", "User")
+	if !ok {
+		return
+	}
+
+	role := r.PathValue("role")
+	if !isGrantableRole(role) {
+		respondWithError(w, r, 400, errCodeInvalidRequest, fmt.Sprintf("Unknown role %q", role))
+		log.Printf("Error revoking role: unknown role %q", role)
+		return
+	}
+
+	roles, err := cfg.db.ListUserRoles(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for roles: %s", err)
+		return
+	}
+
+	if !slices.Contains(roles, role) {
+		respondWithError(w, r, 404, errCodeNotFound, "User does not hold this role")
+		return
+	}
+
+	// The last admin check is part of the delete, so two admins revoking
+	// each other at once cannot leave nobody in charge.
+	revoked, err := cfg.db.RevokeUserRoleUnlessLastAdmin(r.Context(),
+		database.RevokeUserRoleUnlessLastAdminParams{
+			UserID: userUUID,
+			Role:   role,
+		})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error revoking role: %s", err)
+		return
+	}
+
+	if revoked == 0 && role == roleAdmin {
+		respondWithError(w, r, 409, errCodeLastAdmin, "Cannot remove the last admin")
+		log.Printf("Error revoking role: refusing to remove the last admin")
+		return
+	}
+
+	if revoked == 0 {
+		respondWithError(w, r, 404, errCodeNotFound, "User does not hold this role")
+		return
+	}
+
+	logSecurityEvent(r, "role_revoked", "user %s revoked %s from user %s",
+		caller.user.ID, role, userUUID)
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A session is a refresh token family: it starts at login and survives
+// rotation, so revoking it logs out every device holding one of its tokens.
+
+func (cfg *apiConfig) handlerListSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+	sessionID := caller.sessionID
+
+	sessions, err := cfg.db.ListActiveSessions(r.Context(), database.ListActiveSessionsParams{
+		UserID:    userUUID,
+		ExpiresAt: time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for sessions: %s", err)
+		return
+	}
+
+	type res struct {
+		Id          uuid.UUID `json:"id"`
+		CreatedAt   time.Time `json:"created_at"`
+		RefreshedAt time.Time `json:"refreshed_at"`
+		ExpiresAt   time.Time `json:"expires_at"`
+		UserAgent   string    `json:"user_agent"`
+		IP          string    `json:"ip"`
+		Current     bool      `json:"current"`
+	}
+
+	resBody := []res{}
+	for _, session := range sessions {
+		resBody = append(resBody, res{
+			session.ID, session.CreatedAt, session.RefreshedAt, session.ExpiresAt,
+			session.UserAgent, session.Ip, session.ID == sessionID,
+		})
+	}
+
+	respondWithJSON(w, 200, resBody)
+}
+
+func (cfg *apiConfig) handlerRevokeSession(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	sessionUUID, ok := pathUUID(w, r, "sessionID", "Session")
+	if !ok {
+		return
+	}
+
+	revoked, err := cfg.db.RevokeSession(r.Context(), database.RevokeSessionParams{
+		FamilyID: sessionUUID,
+		UserID:   userUUID,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error revoking session: %s", err)
+		return
+	}
+
+	if revoked == 0 {
+		respondWithError(w, r, 404, errCodeNotFound, "Session not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handlerRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	err := cfg.db.RevokeUserSessions(r.Context(), database.RevokeUserSessionsParams{
+		UserID: userUUID,
+	})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error revoking sessions: %s", err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
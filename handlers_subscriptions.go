@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// A subscription is what makes a user Chirpy Red. Polka tells us about
+// payments through webhooks; users.is_chirpy_red mirrors whether the
+// subscription currently grants Chirpy Red.
+const (
+	subscriptionActive   = "active"
+	subscriptionPastDue  = "past_due"
+	subscriptionCanceled = "canceled"
+	subscriptionExpired  = "expired"
+)
+
+const (
+	polkaEventUpgraded      = "user.upgraded"
+	polkaEventRenewed       = "user.renewed"
+	polkaEventPaymentFailed = "user.payment_failed"
+	polkaEventCanceled      = "user.canceled"
+	polkaEventDowngraded    = "user.downgraded"
+
+	// subscriptionEventExpired is recorded in the history when the expiry job
+	// ends a lapsed subscription.
+	subscriptionEventExpired = "subscription.expired"
+)
+
+var polkaEvents = []string{
+	polkaEventUpgraded, polkaEventRenewed, polkaEventPaymentFailed, polkaEventCanceled, polkaEventDowngraded,
+}
+
+const (
+	defaultSubscriptionPlan = "red"
+	// subscriptionPeriod is how long a payment lasts when Polka does not say.
+	subscriptionPeriod = 30 * 24 * time.Hour
+	// subscriptionGracePeriod keeps Chirpy Red after the paid period ends or a
+	// payment fails, so a late renewal or a retried payment does not take it
+	// away. Canceled subscriptions end with the paid period.
+	subscriptionGracePeriod    = 7 * 24 * time.Hour
+	subscriptionExpiryInterval = 10 * time.Minute
+	// subscriptionSaveAttempts is how many times an event is applied again
+	// when another change to the subscription got in first.
+	subscriptionSaveAttempts = 5
+)
+
+var errSubscriptionConflict = errors.New("Subscription kept changing, giving up")
+
+// nextSubscription applies a Polka event to the user's subscription, current
+// being the zero value when there is none. It returns false when the event
+// does not change anything, such as a cancellation without a subscription.
+func nextSubscription(current database.Subscription, userID uuid.UUID, event, plan string,
+	expiresAt sql.NullTime, now time.Time,
+) (database.Subscription, bool) {
+	lapsed := current.Status == "" || current.Status == subscriptionExpired
+	if lapsed && event != polkaEventUpgraded && event != polkaEventRenewed {
+		return database.Subscription{}, false
+	}
+
+	next := current
+	next.UserID = userID
+	next.UpdatedAt = now
+
+	if plan != "" {
+		next.Plan = plan
+	} else if next.Plan == "" {
+		next.Plan = defaultSubscriptionPlan
+	}
+
+	switch event {
+	case polkaEventUpgraded, polkaEventRenewed:
+		periodStart := now
+		if lapsed {
+			next.StartedAt = now
+			next.RenewedAt = sql.NullTime{}
+		} else {
+			next.RenewedAt = sql.NullTime{Time: now, Valid: true}
+			periodStart = latest(now, current.ExpiresAt)
+		}
+
+		next.Status = subscriptionActive
+		next.ExpiresAt = periodStart.Add(subscriptionPeriod)
+		if expiresAt.Valid {
+			next.ExpiresAt = expiresAt.Time
+		}
+		next.GraceUntil = sql.NullTime{Time: next.ExpiresAt.Add(subscriptionGracePeriod), Valid: true}
+		next.CanceledAt = sql.NullTime{}
+	case polkaEventPaymentFailed:
+		if current.Status == subscriptionCanceled {
+			return database.Subscription{}, false
+		}
+
+		next.Status = subscriptionPastDue
+		next.GraceUntil = sql.NullTime{
+			Time:  latest(now, current.ExpiresAt).Add(subscriptionGracePeriod),
+			Valid: true,
+		}
+	case polkaEventCanceled:
+		next.Status = subscriptionCanceled
+		next.GraceUntil = sql.NullTime{}
+		next.CanceledAt = sql.NullTime{Time: now, Valid: true}
+	case polkaEventDowngraded:
+		next.Status = subscriptionExpired
+		next.ExpiresAt = now
+		next.GraceUntil = sql.NullTime{}
+	default:
+		return database.Subscription{}, false
+	}
+
+	return next, true
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+
+	return a
+}
+
+// saveSubscription stores the subscription, records event in its history and
+// brings the user's Chirpy Red flag in line with it. previousUpdatedAt is when
+// the subscription the change was computed from was last updated, invalid if
+// there was none; sql.ErrNoRows means it has changed since.
+func (cfg *apiConfig) saveSubscription(ctx context.Context, subscription database.Subscription,
+	previousUpdatedAt sql.NullTime, event string,
+) error {
+	_, err := cfg.db.SaveSubscription(ctx, database.SaveSubscriptionParams{
+		UserID:            subscription.UserID,
+		Plan:              subscription.Plan,
+		Status:            subscription.Status,
+		StartedAt:         subscription.StartedAt,
+		RenewedAt:         subscription.RenewedAt,
+		ExpiresAt:         subscription.ExpiresAt,
+		GraceUntil:        subscription.GraceUntil,
+		CanceledAt:        subscription.CanceledAt,
+		UpdatedAt:         subscription.UpdatedAt,
+		PreviousUpdatedAt: previousUpdatedAt,
+		EventID:           uuid.New(),
+		Event:             event,
+	})
+
+	return err
+}
+
+// expireSubscriptions ends the subscriptions whose paid and grace periods have
+// run out and returns how many it ended.
+func (cfg *apiConfig) expireSubscriptions(ctx context.Context) (int, error) {
+	expired, err := cfg.db.ExpireLapsedSubscriptions(ctx, database.ExpireLapsedSubscriptionsParams{
+		Now:   time.Now().UTC(),
+		Event: subscriptionEventExpired,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+// runSubscriptionExpiry calls expireSubscriptions every interval until ctx is
+// done.
+func (cfg *apiConfig) runSubscriptionExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := cfg.expireSubscriptions(ctx)
+		if err != nil {
+			log.Printf("Error expiring subscriptions: %s", err)
+		} else if expired > 0 {
+			log.Printf("Expired %d lapsed subscriptions", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyPolkaEvent updates the subscription of the user the event is about and
+// returns false when the event does not concern subscriptions or changes
+// nothing.
+func (cfg *apiConfig) applyPolkaEvent(ctx context.Context, payload polkaPayload) (bool, error) {
+	if !slices.Contains(polkaEvents, payload.Event) {
+		return false, nil
+	}
+
+	userID, err := uuid.Parse(payload.Data.UserID)
+	if err != nil {
+		return false, errPolkaUserNotFound
+	}
+
+	user, err := cfg.db.GetUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errPolkaUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	expiresAt := sql.NullTime{}
+	if payload.Data.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: payload.Data.ExpiresAt.UTC(), Valid: true}
+	}
+
+	// The change is computed from the subscription as read and only saved if
+	// it has not changed since, so concurrent events cannot undo each other.
+	for range subscriptionSaveAttempts {
+		current, err := cfg.db.GetSubscription(ctx, user.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+		previousUpdatedAt := sql.NullTime{Time: current.UpdatedAt, Valid: err == nil}
+
+		next, changed := nextSubscription(current, user.ID, payload.Event, payload.Data.Plan,
+			expiresAt, time.Now().UTC())
+		if !changed {
+			return false, nil
+		}
+
+		err = cfg.saveSubscription(ctx, next, previousUpdatedAt, payload.Event)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+
+		return err == nil, err
+	}
+
+	return false, errSubscriptionConflict
+}
+
+func (cfg *apiConfig) handlerGetSubscription(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+	userUUID := caller.user.ID
+
+	subscription, err := cfg.db.GetSubscription(r.Context(), userUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, r, 404, errCodeNotFound, "No subscription")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for subscription: %s", err)
+		return
+	}
+
+	events, err := cfg.db.ListSubscriptionEvents(r.Context(), userUUID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for subscription events: %s", err)
+		return
+	}
+
+	type event struct {
+		Event     string    `json:"event"`
+		Status    string    `json:"status"`
+		ExpiresAt time.Time `json:"expires_at"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	type res struct {
+		Plan        string     `json:"plan"`
+		Status      string     `json:"status"`
+		IsChirpyRed bool       `json:"is_chirpy_red"`
+		StartedAt   time.Time  `json:"started_at"`
+		RenewedAt   *time.Time `json:"renewed_at"`
+		ExpiresAt   time.Time  `json:"expires_at"`
+		GraceUntil  *time.Time `json:"grace_until"`
+		CanceledAt  *time.Time `json:"canceled_at"`
+		History     []event    `json:"history"`
+	}
+
+	history := []event{}
+	for _, e := range events {
+		history = append(history, event{e.Event, e.Status, e.ExpiresAt, e.CreatedAt})
+	}
+
+	respondWithJSON(w, 200, res{
+		subscription.Plan, subscription.Status, subscription.Status != subscriptionExpired,
+		subscription.StartedAt, nullTimePtr(subscription.RenewedAt), subscription.ExpiresAt,
+		nullTimePtr(subscription.GraceUntil), nullTimePtr(subscription.CanceledAt), history,
+	})
+}
@@ -0,0 +1,2243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/chirplen"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"github.com/rQxwX3/chirpy/internal/mailer"
+	"github.com/rQxwX3/chirpy/internal/moderation"
+	"github.com/rQxwX3/chirpy/internal/ratelimit"
+	"github.com/rQxwX3/chirpy/internal/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testJWTSecret = "test-secret"
+	testPolkaKey  = "test-polka-key"
+)
+
+type testServer struct {
+	*httptest.Server
+	cfg    *apiConfig
+	outbox *mailer.Outbox
+	t      *testing.T
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	outbox := mailer.NewOutbox()
+	cfg := &apiConfig{
+		db:          store.NewMemory(),
+		platform:    "dev",
+		polkaKey:    testPolkaKey,
+		mailer:      outbox,
+		publicURL:   "http://chirpy.test",
+		chirpLimits: defaultChirpLimits,
+	}
+
+	cfg.jwtKeys = auth.NewKeyring()
+	if err := cfg.jwtKeys.Add(auth.NewHMACKey("", []byte(testJWTSecret))); err != nil {
+		t.Fatalf("Error adding JWT key: %s", err)
+	}
+
+	totpBox, err := auth.NewSecretBox(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("Error creating TOTP secret box: %s", err)
+	}
+
+	cfg.totpBox = totpBox
+
+	cfg.moderator = moderation.NewPipeline()
+	if err := cfg.reloadModeration(context.Background()); err != nil {
+		t.Fatalf("Error loading moderation words: %s", err)
+	}
+
+	server := httptest.NewServer(cfg.routes())
+	t.Cleanup(server.Close)
+
+	return &testServer{Server: server, cfg: cfg, outbox: outbox, t: t}
+}
+
+func (ts *testServer) do(method, path, authorization string, body any) *http.Response {
+	ts.t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatalf("Error marshalling JSON: %s", err)
+		}
+
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		ts.t.Fatalf("Error creating request: %s", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatalf("Error sending %s %s: %s", method, path, err)
+	}
+	ts.t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+func (ts *testServer) expect(res *http.Response, status int, v any) {
+	ts.t.Helper()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		ts.t.Fatalf("Error reading response body: %s", err)
+	}
+
+	if res.StatusCode != status {
+		ts.t.Fatalf("%s %s: status %d != %d, body: %s",
+			res.Request.Method, res.Request.URL.Path, res.StatusCode, status, data)
+	}
+
+	if v == nil {
+		return
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		ts.t.Fatalf("Error decoding JSON %q: %s", data, err)
+	}
+}
+
+type testUser struct {
+	ID            uuid.UUID `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	PendingEmail  string    `json:"pending_email"`
+	IsChirpyRed   bool      `json:"is_chirpy_red"`
+	Token         string    `json:"token"`
+	RefreshToken  string    `json:"refresh_token"`
+}
+
+type testChirp struct {
+	ID     uuid.UUID `json:"id"`
+	Body   string    `json:"body"`
+	UserID uuid.UUID `json:"user_id"`
+}
+
+type testProblem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+	Errors    []struct {
+		Field  string `json:"field"`
+		Code   string `json:"code"`
+		Length int    `json:"length"`
+		Limit  int    `json:"limit"`
+	} `json:"errors"`
+}
+
+func bearer(token string) string {
+	return fmt.Sprintf("Bearer %s", token)
+}
+
+func (ts *testServer) signup(email, password string) testUser {
+	ts.t.Helper()
+
+	user := testUser{}
+	ts.expect(ts.do("POST", "/api/users", "", map[string]string{
+		"email": email, "password": password,
+	}), 201, &user)
+
+	return user
+}
+
+func (ts *testServer) login(email, password string) testUser {
+	ts.t.Helper()
+
+	user := testUser{}
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": email, "password": password,
+	}), 200, &user)
+
+	return user
+}
+
+// staff signs up a user and grants them role the way an operator would.
+func (ts *testServer) staff(email, role string) testUser {
+	ts.t.Helper()
+
+	ts.signup(email, "staff-password")
+	if err := ts.cfg.runCommand(context.Background(), []string{"grant-role", email, role}); err != nil {
+		ts.t.Fatalf("Error granting role: %s", err)
+	}
+
+	return ts.login(email, "staff-password")
+}
+
+func (ts *testServer) chirp(token, body string) testChirp {
+	ts.t.Helper()
+
+	chirp := testChirp{}
+	ts.expect(ts.do("POST", "/api/chirps", bearer(token), map[string]string{
+		"body": body,
+	}), 201, &chirp)
+
+	return chirp
+}
+
+func TestHealthAndMetrics(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.expect(ts.do("GET", "/api/healthz", "", nil), 200, nil)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	admin := ts.staff("admin@example.com", "admin")
+
+	ts.expect(ts.do("GET", "/admin/metrics", "", nil), 401, nil)
+	ts.expect(ts.do("GET", "/admin/metrics", bearer(walt.Token), nil), 403, nil)
+
+	ts.cfg.fileserverHits.Store(3)
+	res := ts.do("GET", "/admin/metrics", bearer(admin.Token), nil)
+	data, _ := io.ReadAll(res.Body)
+	if !bytes.Contains(data, []byte("visited 3 times")) {
+		t.Errorf("Expected hit count in metrics page, got %s", data)
+	}
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+
+	created := ts.signup("walt@example.com", "123456")
+	if created.Email != "walt@example.com" || created.ID == uuid.Nil {
+		t.Errorf("Unexpected user %+v", created)
+	}
+
+	if created.IsChirpyRed {
+		t.Errorf("Expected new user not to be Chirpy Red")
+	}
+
+	loggedIn := ts.login("walt@example.com", "123456")
+	if loggedIn.ID != created.ID {
+		t.Errorf("User ID mismatch %s != %s", loggedIn.ID, created.ID)
+	}
+
+	if loggedIn.Token == "" || loggedIn.RefreshToken == "" {
+		t.Errorf("Expected access and refresh tokens, got %+v", loggedIn)
+	}
+
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "walt@example.com", "password": "wrong",
+	}), 401, nil)
+
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "nobody@example.com", "password": "123456",
+	}), 401, nil)
+}
+
+func TestErrorResponses(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	res := ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": string(bytes.Repeat([]byte("a"), 141)),
+	})
+	if got := res.Header.Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Expected problem+json content type, got %q", got)
+	}
+
+	tooLong := testProblem{}
+	ts.expect(res, 400, &tooLong)
+	if tooLong.Status != 400 || tooLong.Title != "Bad Request" || tooLong.Type != "about:blank" ||
+		tooLong.Code != "validation_failed" || tooLong.Instance != "/api/chirps" {
+		t.Errorf("Unexpected problem %+v", tooLong)
+	}
+
+	if len(tooLong.Errors) != 1 || tooLong.Errors[0].Field != "body" || tooLong.Errors[0].Code != "too_long" {
+		t.Errorf("Expected a too_long error on body, got %+v", tooLong.Errors)
+	}
+
+	if requestID := res.Header.Get("X-Request-ID"); requestID == "" || tooLong.RequestID != requestID {
+		t.Errorf("Request ID mismatch %q != %q", tooLong.RequestID, requestID)
+	}
+
+	wrongPassword := testProblem{}
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "walt@example.com", "password": "wrong",
+	}), 401, &wrongPassword)
+	if wrongPassword.Code != "invalid_credentials" || wrongPassword.Detail != "Incorrect email or password" {
+		t.Errorf("Unexpected problem %+v", wrongPassword)
+	}
+
+	notFound := testProblem{}
+	ts.expect(ts.do("GET", "/api/chirps/"+uuid.NewString(), "", nil), 404, &notFound)
+	if notFound.Code != "not_found" {
+		t.Errorf("Expected not_found, got %+v", notFound)
+	}
+
+	for requestID, kept := range map[string]bool{
+		"req-42.a:b_c":              true,
+		"has spaces":                false,
+		strings.Repeat("x", 129):    false,
+		"<script>alert(1)</script>": false,
+	} {
+		req, err := http.NewRequest("GET", ts.URL+"/api/healthz", nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		req.Header.Set("X-Request-ID", requestID)
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %s", err)
+		}
+		res.Body.Close()
+
+		got := res.Header.Get("X-Request-ID")
+		if (got == requestID) != kept || got == "" {
+			t.Errorf("Request ID %q came back as %q", requestID, got)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	send := func(method, path, contentType, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", bearer(walt.Token))
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Error sending %s %s: %s", method, path, err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+
+		return res
+	}
+
+	expectCode := func(res *http.Response, status int, code string, fields ...string) {
+		t.Helper()
+
+		p := testProblem{}
+		ts.expect(res, status, &p)
+		if p.Code != code {
+			t.Errorf("%s %s: code %q != %q", res.Request.Method, res.Request.URL, p.Code, code)
+		}
+
+		got := []string{}
+		for _, fieldErr := range p.Errors {
+			got = append(got, fieldErr.Field+":"+fieldErr.Code)
+		}
+		if !slices.Equal(got, fields) {
+			t.Errorf("%s %s: field errors %v != %v", res.Request.Method, res.Request.URL, got, fields)
+		}
+	}
+
+	expectCode(send("POST", "/api/chirps", "text/plain", `{"body": "hi"}`), 415, "unsupported_media_type")
+	expectCode(send("POST", "/api/chirps", "application/json", `{"body": "hi"`), 400, "invalid_json")
+	expectCode(send("POST", "/api/chirps", "application/json", ``), 400, "invalid_json")
+	expectCode(send("POST", "/api/chirps", "application/json", `{"body": "hi"} {}`), 400, "invalid_json")
+	expectCode(send("POST", "/api/chirps", "application/json; charset=utf-8", `{"body": 5}`),
+		400, "validation_failed", "body:invalid")
+	expectCode(send("POST", "/api/chirps", "application/json", `{"body": "hi", "bodyy": "hi"}`),
+		400, "validation_failed", "bodyy:unknown")
+	expectCode(send("POST", "/api/chirps", "application/json", `{}`),
+		400, "validation_failed", "body:required")
+	expectCode(send("POST", "/api/chirps", "application/json", `{"body": "hi", "in_reply_to": "nope"}`),
+		400, "validation_failed", "in_reply_to:invalid")
+	expectCode(send("POST", "/api/chirps", "application/json",
+		`{"body": "`+strings.Repeat("a", 2<<20)+`"}`), 413, "request_too_large")
+	expectCode(send("POST", "/api/users", "application/json", `{}`),
+		400, "validation_failed", "password:required", "email:required")
+	expectCode(send("POST", "/api/polka/webhooks", "application/json", `{"event": "user.upgraded", "data": {}}`),
+		401, "unauthorized")
+
+	expectCode(ts.do("GET", "/api/chirps?author_id=nope&sort=sideways", "", nil),
+		400, "validation_failed", "author_id:invalid", "sort:invalid")
+	expectCode(ts.do("GET", "/api/chirps?limit=0", "", nil), 400, "validation_failed", "limit:invalid")
+	expectCode(ts.do("GET", "/api/chirps/not-a-uuid", "", nil), 404, "not_found")
+	expectCode(ts.do("DELETE", "/api/chirps/not-a-uuid", bearer(walt.Token), nil), 404, "not_found")
+	expectCode(ts.do("POST", "/api/refresh", "Bearer", nil), 401, "unauthorized")
+
+	ts.chirp(walt.Token, "Still fine")
+}
+
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	admin := ts.staff("admin@example.com", "admin")
+
+	for _, email := range []string{"walt@example.com", "nobody@example.com"} {
+		for range 3 {
+			ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+				"email": email, "password": "wrong",
+			}), 401, nil)
+		}
+
+		// Unknown addresses back off exactly like real ones.
+		res := ts.do("POST", "/api/login", "", map[string]string{
+			"email": email, "password": "123456",
+		})
+		ts.expect(res, 429, nil)
+		if res.Header.Get("Retry-After") != "1" {
+			t.Errorf("Expected Retry-After: 1, got %q", res.Header.Get("Retry-After"))
+		}
+	}
+
+	ts.expect(ts.do("POST", "/admin/users/"+uuid.NewString()+"/unlock", bearer(admin.Token), nil),
+		404, nil)
+
+	user, _ := ts.cfg.db.GetUserByEmail(context.Background(), "walt@example.com")
+	ts.expect(ts.do("POST", "/admin/users/"+user.ID.String()+"/unlock", "", nil), 401, nil)
+	ts.expect(ts.do("POST", "/admin/users/"+user.ID.String()+"/unlock", bearer(admin.Token), nil),
+		204, nil)
+
+	ts.login("walt@example.com", "123456")
+
+	// A burst of parallel guesses gets no more tries than sequential ones.
+	statuses := make(chan int, 20)
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res := ts.do("POST", "/api/login", "", map[string]string{
+				"email": "walt@example.com", "password": "wrong",
+			})
+			res.Body.Close()
+			statuses <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	rejected := 0
+	for status := range statuses {
+		if status == 401 {
+			rejected++
+		} else if status != 429 {
+			t.Errorf("Expected 401 or 429 for a guess, got %d", status)
+		}
+	}
+	if rejected != 3 {
+		t.Errorf("Expected 3 guesses to be checked, got %d", rejected)
+	}
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle := loginThrottles[loginScopeAccount]
+
+	want := map[int32]time.Duration{
+		1:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		9:  64 * time.Second,
+		10: 15 * time.Minute,
+		25: 15 * time.Minute,
+	}
+
+	for failures, blockFor := range want {
+		if got := throttle.blockFor(failures); got != blockFor {
+			t.Errorf("blockFor(%d) = %s, want %s", failures, got, blockFor)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.limiter = ratelimit.NewMemory()
+
+	ts.signup("walt@example.com", "123456")
+	ts.signup("jesse@example.com", "654321")
+	walt := ts.login("walt@example.com", "123456")
+	jesse := ts.login("jesse@example.com", "654321")
+
+	// Chirps are counted per user, not per address.
+	ts.chirp(walt.Token, "First")
+	res := ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{"body": "Second"})
+	ts.expect(res, 201, nil)
+	if res.Header.Get("RateLimit-Policy") != "30;w=60" || res.Header.Get("RateLimit-Remaining") != "28" {
+		t.Errorf("Unexpected rate limit headers %v", res.Header)
+	}
+
+	res = ts.do("POST", "/api/chirps", bearer(jesse.Token), map[string]string{"body": "Mine"})
+	ts.expect(res, 201, nil)
+	if res.Header.Get("RateLimit-Remaining") != "29" {
+		t.Errorf("Expected a separate bucket per user, got %v", res.Header)
+	}
+
+	for i := range 3 {
+		ts.signup(fmt.Sprintf("user%d@example.com", i), "123456")
+	}
+
+	res = ts.do("POST", "/api/users", "", map[string]string{
+		"email": "one-too-many@example.com", "password": "123456",
+	})
+	ts.expect(res, 429, nil)
+	// Five signups an hour refill one every 12 minutes.
+	retryAfter, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+	if retryAfter < 700 || retryAfter > 720 || res.Header.Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected rate limit headers %v", res.Header)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	user := ts.login("walt@example.com", "123456")
+
+	ts.expect(ts.do("PUT", "/api/users", "", map[string]string{
+		"email": "heisenberg@example.com", "password": "654321",
+	}), 401, nil)
+
+	ts.expect(ts.do("PUT", "/api/users", bearer(user.Token), map[string]string{
+		"email": "not an email", "password": "654321",
+	}), 400, nil)
+
+	updated := testUser{}
+	ts.expect(ts.do("PUT", "/api/users", bearer(user.Token), map[string]string{
+		"email": "walt@example.com", "password": "654321",
+	}), 200, &updated)
+
+	if updated.Email != "walt@example.com" || updated.PendingEmail != "" {
+		t.Errorf("Unexpected user %+v", updated)
+	}
+
+	ts.login("walt@example.com", "654321")
+}
+
+func TestEmailVerification(t *testing.T) {
+	ts := newTestServer(t)
+
+	verifyToken := func(email string) string {
+		t.Helper()
+
+		msg, ok := ts.outbox.Last(email)
+		if !ok {
+			t.Fatalf("Expected a verification email to %s", email)
+		}
+
+		match := regexp.MustCompile(`verify\?token=(\w+)`).FindStringSubmatch(msg.Body)
+		if match == nil {
+			t.Fatalf("Expected a verification link in %q", msg.Body)
+		}
+
+		return match[1]
+	}
+
+	ts.expect(ts.do("POST", "/api/users", "", map[string]string{
+		"email": "Walt <walt@example.com>", "password": "123456",
+	}), 400, nil)
+
+	created := ts.signup(" walt@Example.COM", "123456")
+	if created.Email != "walt@example.com" || created.EmailVerified {
+		t.Errorf("Unexpected user %+v", created)
+	}
+
+	signupToken := verifyToken("walt@example.com")
+	ts.expect(ts.do("GET", "/api/users/verify?token=invalid", "", nil), 400, nil)
+	ts.expect(ts.do("GET", "/api/users/verify?token="+signupToken, "", nil), 204, nil)
+	ts.expect(ts.do("GET", "/api/users/verify?token="+signupToken, "", nil), 400, nil)
+
+	walt := ts.login("walt@EXAMPLE.com", "123456")
+	if !walt.EmailVerified {
+		t.Errorf("Expected a verified email after following the link")
+	}
+
+	ts.expect(ts.do("POST", "/api/users/verify", bearer(walt.Token), nil), 409, nil)
+
+	// The new address is only used once it is verified.
+	updated := testUser{}
+	ts.expect(ts.do("PUT", "/api/users", bearer(walt.Token), map[string]string{
+		"email": "heisenberg@example.com", "password": "123456",
+	}), 200, &updated)
+	if updated.Email != "walt@example.com" || updated.PendingEmail != "heisenberg@example.com" {
+		t.Errorf("Unexpected user %+v", updated)
+	}
+
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "heisenberg@example.com", "password": "123456",
+	}), 401, nil)
+
+	ts.expect(ts.do("GET", "/api/users/verify?token="+verifyToken("heisenberg@example.com"), "", nil),
+		204, nil)
+
+	ts.login("heisenberg@example.com", "123456")
+
+	// A pending address taken by someone else in the meantime is not applied.
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+	ts.expect(ts.do("PUT", "/api/users", bearer(jesse.Token), map[string]string{
+		"email": "pinkman@example.com", "password": "654321",
+	}), 200, nil)
+	pinkmanToken := verifyToken("pinkman@example.com")
+
+	ts.signup("pinkman@example.com", "123456")
+	ts.expect(ts.do("GET", "/api/users/verify?token="+pinkmanToken, "", nil), 409, nil)
+
+	// Accounts stored before addresses were normalized can still log in.
+	hashedPassword, err := auth.HashPassword("123456")
+	if err != nil {
+		t.Fatalf("Error hashing password: %s", err)
+	}
+	_, err = ts.cfg.db.CreateUser(context.Background(), database.CreateUserParams{
+		ID:             uuid.New(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		Email:          "Bob@Example.COM",
+		HashedPassword: hashedPassword,
+	})
+	if err != nil {
+		t.Fatalf("Error creating user: %s", err)
+	}
+	ts.login("Bob@example.com", "123456")
+
+	res := ts.do("POST", "/api/users", "", map[string]string{
+		"email": "Bob@example.com", "password": "123456",
+	})
+	res.Body.Close()
+	if res.StatusCode == 201 {
+		t.Errorf("Expected an address differing in domain case to be taken")
+	}
+}
+
+type testRefreshed struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func TestRefreshAndRevoke(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	user := ts.login("walt@example.com", "123456")
+
+	refreshed := testRefreshed{}
+	ts.expect(ts.do("POST", "/api/refresh", bearer(user.RefreshToken), nil),
+		200, &refreshed)
+
+	ts.chirp(refreshed.Token, "Using a refreshed access token")
+
+	ts.expect(ts.do("POST", "/api/refresh", bearer("unknown"), nil), 401, nil)
+
+	ts.expect(ts.do("POST", "/api/revoke", bearer(refreshed.RefreshToken), nil), 204, nil)
+	ts.expect(ts.do("POST", "/api/refresh", bearer(refreshed.RefreshToken), nil), 401, nil)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	user := ts.login("walt@example.com", "123456")
+	other := ts.login("walt@example.com", "123456")
+
+	first := testRefreshed{}
+	ts.expect(ts.do("POST", "/api/refresh", bearer(user.RefreshToken), nil), 200, &first)
+	if first.RefreshToken == "" || first.RefreshToken == user.RefreshToken {
+		t.Fatalf("Expected a new refresh token, got %q", first.RefreshToken)
+	}
+
+	second := testRefreshed{}
+	ts.expect(ts.do("POST", "/api/refresh", bearer(first.RefreshToken), nil), 200, &second)
+
+	// Replaying a rotated token revokes every token descended from the login.
+	ts.expect(ts.do("POST", "/api/refresh", bearer(user.RefreshToken), nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/refresh", bearer(second.RefreshToken), nil), 401, nil)
+
+	// Sessions from other logins are left alone.
+	ts.expect(ts.do("POST", "/api/refresh", bearer(other.RefreshToken), nil), 200, nil)
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	type testToken struct {
+		ID         uuid.UUID  `json:"id"`
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		Token      string     `json:"token"`
+	}
+
+	for _, invalid := range []map[string]any{
+		{"name": "", "scopes": []string{"chirps:read"}},
+		{"name": "bot", "scopes": []string{}},
+		{"name": "bot", "scopes": []string{"admin"}},
+		{"name": "bot", "scopes": []string{"chirps:read"}, "expires_at": time.Now().Add(-time.Hour)},
+	} {
+		ts.expect(ts.do("POST", "/api/tokens", bearer(walt.Token), invalid), 400, nil)
+	}
+
+	bot := testToken{}
+	ts.expect(ts.do("POST", "/api/tokens", bearer(walt.Token), map[string]any{
+		"name": "bot", "scopes": []string{"chirps:write", "chirps:read"},
+	}), 201, &bot)
+	if !strings.HasPrefix(bot.Token, "chirpy_pat_") || !slices.Equal(bot.Scopes, []string{"chirps:read", "chirps:write"}) {
+		t.Fatalf("Unexpected token %+v", bot)
+	}
+
+	ts.chirp(bot.Token, "Posted by a bot")
+	ts.expect(ts.do("GET", "/api/timeline", bearer(bot.Token), nil), 200, nil)
+
+	res := ts.do("POST", "/api/users/"+uuid.NewString()+"/follow", bearer(bot.Token), nil)
+	ts.expect(res, 403, nil)
+	if got := res.Header.Get("WWW-Authenticate"); !strings.Contains(got, `scope="follows:write"`) {
+		t.Errorf("Expected an insufficient_scope challenge, got %q", got)
+	}
+
+	// Not even follows:write lets a token take over the account.
+	profile := testToken{}
+	ts.expect(ts.do("POST", "/api/tokens", bearer(walt.Token), map[string]any{
+		"name": "follows", "scopes": []string{"follows:write"},
+	}), 201, &profile)
+	ts.expect(ts.do("PUT", "/api/users", bearer(profile.Token), map[string]any{
+		"email": "walt@example.com", "password": "hijacked", "revoke_other_sessions": true,
+	}), 403, nil)
+	ts.login("walt@example.com", "123456")
+	ts.expect(ts.do("DELETE", "/api/tokens/"+profile.ID.String(), bearer(walt.Token), nil), 204, nil)
+
+	// Tokens cannot manage tokens, so a leaked one cannot widen its own access.
+	ts.expect(ts.do("GET", "/api/tokens", bearer(bot.Token), nil), 403, nil)
+	ts.expect(ts.do("POST", "/api/tokens", bearer(bot.Token), map[string]any{
+		"name": "wider", "scopes": []string{"follows:write"},
+	}), 403, nil)
+
+	reader := testToken{}
+	ts.expect(ts.do("POST", "/api/tokens", bearer(walt.Token), map[string]any{
+		"name": "reader", "scopes": []string{"chirps:read"},
+		"expires_at": time.Now().Add(time.Hour),
+	}), 201, &reader)
+	ts.expect(ts.do("POST", "/api/chirps", bearer(reader.Token), map[string]string{
+		"body": "Not allowed",
+	}), 403, nil)
+
+	listed := []testToken{}
+	ts.expect(ts.do("GET", "/api/tokens", bearer(walt.Token), nil), 200, &listed)
+	if len(listed) != 2 || listed[1].ID != bot.ID || listed[1].Token != "" || listed[1].LastUsedAt == nil {
+		t.Errorf("Unexpected tokens %+v", listed)
+	}
+
+	user, _ := ts.cfg.db.GetUserByEmail(context.Background(), "walt@example.com")
+	ts.cfg.db.CreatePersonalAccessToken(context.Background(), database.CreatePersonalAccessTokenParams{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		Name:      "expired",
+		TokenHash: auth.HashToken("chirpy_pat_expired"),
+		Scopes:    []string{"chirps:read"},
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+		ExpiresAt: sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true},
+	})
+
+	res = ts.do("GET", "/api/timeline", bearer("chirpy_pat_expired"), nil)
+	ts.expect(res, 401, nil)
+	if got := res.Header.Get("WWW-Authenticate"); !strings.Contains(got, "Token has expired") {
+		t.Errorf("Expected an expired token challenge, got %q", got)
+	}
+
+	ts.expect(ts.do("GET", "/api/timeline", bearer("chirpy_pat_unknown"), nil), 401, nil)
+
+	ts.expect(ts.do("DELETE", "/api/tokens/"+bot.ID.String(), bearer(walt.Token), nil), 204, nil)
+	ts.expect(ts.do("DELETE", "/api/tokens/"+bot.ID.String(), bearer(walt.Token), nil), 404, nil)
+	ts.expect(ts.do("GET", "/api/timeline", bearer(bot.Token), nil), 401, nil)
+}
+
+func TestSessions(t *testing.T) {
+	ts := newTestServer(t)
+
+	type testSession struct {
+		ID        uuid.UUID `json:"id"`
+		UserAgent string    `json:"user_agent"`
+		IP        string    `json:"ip"`
+		Current   bool      `json:"current"`
+	}
+
+	ts.signup("walt@example.com", "123456")
+	laptop := ts.login("walt@example.com", "123456")
+	phone := ts.login("walt@example.com", "123456")
+	tablet := ts.login("walt@example.com", "123456")
+
+	ts.expect(ts.do("GET", "/api/sessions", "", nil), 401, nil)
+
+	sessions := []testSession{}
+	ts.expect(ts.do("GET", "/api/sessions", bearer(laptop.Token), nil), 200, &sessions)
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(sessions))
+	}
+
+	var current testSession
+	for _, session := range sessions {
+		if session.Current {
+			current = session
+		}
+	}
+
+	if current.IP != "127.0.0.1" || current.UserAgent == "" {
+		t.Errorf("Expected login metadata on the current session, got %+v", current)
+	}
+
+	// Refreshing keeps the session, and its access tokens still know it.
+	refreshed := testRefreshed{}
+	ts.expect(ts.do("POST", "/api/refresh", bearer(laptop.RefreshToken), nil), 200, &refreshed)
+
+	sessions = []testSession{}
+	ts.expect(ts.do("GET", "/api/sessions", bearer(refreshed.Token), nil), 200, &sessions)
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions after refresh, got %d", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.Current != (session.ID == current.ID) {
+			t.Errorf("Expected only session %s to be current, got %+v", current.ID, session)
+		}
+	}
+
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+	ts.expect(ts.do("DELETE", "/api/sessions/"+current.ID.String(), bearer(jesse.Token), nil),
+		404, nil)
+	ts.expect(ts.do("DELETE", "/api/sessions/invalid", bearer(laptop.Token), nil), 404, nil)
+
+	ts.expect(ts.do("DELETE", "/api/sessions/"+current.ID.String(), bearer(phone.Token), nil),
+		204, nil)
+	ts.expect(ts.do("POST", "/api/refresh", bearer(refreshed.RefreshToken), nil), 401, nil)
+	ts.expect(ts.do("DELETE", "/api/sessions/"+current.ID.String(), bearer(phone.Token), nil),
+		404, nil)
+
+	// Access tokens of a revoked session stop working before they expire.
+	ts.expect(ts.do("GET", "/api/sessions", bearer(laptop.Token), nil), 401, nil)
+	ts.expect(ts.do("GET", "/api/sessions", bearer(refreshed.Token), nil), 401, nil)
+
+	// Changing the password can sign out every other device.
+	ts.expect(ts.do("PUT", "/api/users", bearer(phone.Token), map[string]any{
+		"email": "walt@example.com", "password": "abcdef", "revoke_other_sessions": true,
+	}), 200, nil)
+	ts.expect(ts.do("POST", "/api/refresh", bearer(tablet.RefreshToken), nil), 401, nil)
+	ts.expect(ts.do("GET", "/api/sessions", bearer(tablet.Token), nil), 401, nil)
+
+	phoneRefreshed := testRefreshed{}
+	ts.expect(ts.do("POST", "/api/refresh", bearer(phone.RefreshToken), nil), 200, &phoneRefreshed)
+
+	ts.expect(ts.do("POST", "/api/sessions/revoke-all", bearer(phone.Token), nil), 204, nil)
+	ts.expect(ts.do("POST", "/api/refresh", bearer(phoneRefreshed.RefreshToken), nil), 401, nil)
+	ts.expect(ts.do("GET", "/api/sessions", bearer(phoneRefreshed.Token), nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/refresh", bearer(jesse.RefreshToken), nil), 200, nil)
+}
+
+func TestAccessTokenChallenge(t *testing.T) {
+	ts := newTestServer(t)
+
+	walt := ts.signup("walt@example.com", "123456")
+
+	res := ts.do("GET", "/api/timeline", "", nil)
+	ts.expect(res, 401, nil)
+	if challenge := res.Header.Get("WWW-Authenticate"); challenge != `Bearer realm="chirpy"` {
+		t.Errorf("Expected bare challenge without credentials, got %q", challenge)
+	}
+
+	expired, err := ts.cfg.jwtKeys.MakeJWT(walt.ID, -time.Minute)
+	if err != nil {
+		t.Fatalf("Error creating JWT: %s", err)
+	}
+
+	res = ts.do("GET", "/api/timeline", bearer(expired), nil)
+	ts.expect(res, 401, nil)
+	challenge := res.Header.Get("WWW-Authenticate")
+	if !strings.Contains(challenge, `error="invalid_token"`) ||
+		!strings.Contains(challenge, auth.ErrTokenExpired.Error()) {
+		t.Errorf("Expected expired token challenge, got %q", challenge)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	// Every authenticated route answers a missing token the same way.
+	ts.expect(ts.do("POST", "/api/chirps", "", map[string]string{"body": "hello"}), 401, nil)
+	ts.expect(ts.do("PUT", "/api/users", "", map[string]string{
+		"email": "walt@example.com", "password": "123456",
+	}), 401, nil)
+	ts.expect(ts.do("DELETE", "/api/chirps/"+uuid.NewString(), "", nil), 401, nil)
+
+	// Optional routes serve anonymous callers and callers with bad tokens.
+	ts.expect(ts.do("GET", "/api/chirps", "", nil), 200, nil)
+	ts.expect(ts.do("GET", "/api/chirps", bearer("invalid"), nil), 200, nil)
+
+	// Tokens outlive their user, the middleware must not.
+	admin := ts.staff("admin@example.com", "admin")
+	ts.expect(ts.do("POST", "/admin/reset", bearer(admin.Token), nil), 200, nil)
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": "hello",
+	}), 401, nil)
+
+	// A store failure says nothing about the token, so it is not a 401.
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+
+	db := &failingStore{Store: ts.cfg.db, failingUsers: true}
+	ts.cfg.db = db
+	ts.expect(ts.do("GET", "/api/timeline", bearer(jesse.Token), nil), 500, nil)
+	ts.expect(ts.do("GET", "/api/chirps", bearer(jesse.Token), nil), 500, nil)
+
+	db.failingUsers = false
+	ts.expect(ts.do("GET", "/api/timeline", bearer(jesse.Token), nil), 200, nil)
+}
+
+func TestJWKSAndKeyRotation(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	before := ts.login("walt@example.com", "123456")
+
+	jwks := struct {
+		Keys []auth.JWK `json:"keys"`
+	}{}
+	ts.expect(ts.do("GET", "/.well-known/jwks.json", "", nil), 200, &jwks)
+	if len(jwks.Keys) != 0 {
+		t.Errorf("Expected the HMAC secret not to be published, got %+v", jwks.Keys)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	if err := ts.cfg.jwtKeys.Add(auth.NewEd25519Key("ed-1", edKey)); err != nil {
+		t.Fatalf("Error adding key: %s", err)
+	}
+	if err := ts.cfg.jwtKeys.SetActive("ed-1"); err != nil {
+		t.Fatalf("Error activating key: %s", err)
+	}
+
+	after := ts.login("walt@example.com", "123456")
+
+	ts.expect(ts.do("GET", "/.well-known/jwks.json", "", nil), 200, &jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "ed-1" || jwks.Keys[0].Alg != "EdDSA" {
+		t.Errorf("Expected the Ed25519 key to be published, got %+v", jwks.Keys)
+	}
+
+	// Tokens from before the rotation keep working until they expire.
+	for _, user := range []testUser{before, after} {
+		ts.expect(ts.do("GET", "/api/sessions", bearer(user.Token), nil), 200, nil)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	// resetToken follows the emailed instructions: the endpoint to POST to
+	// and the token to send it.
+	resetEmail := regexp.MustCompile(`POST http://chirpy\.test(/\S+)\s+\{"token": "(\w+)"`)
+	resetToken := func() (string, string) {
+		t.Helper()
+
+		ts.cfg.background.Wait()
+		msg, ok := ts.outbox.Last("walt@example.com")
+		if !ok {
+			t.Fatalf("Expected a password reset email")
+		}
+
+		match := resetEmail.FindStringSubmatch(msg.Body)
+		if match == nil {
+			t.Fatalf("Expected reset instructions in %q", msg.Body)
+		}
+
+		return match[1], match[2]
+	}
+
+	sent := len(ts.outbox.Messages())
+	ts.expect(ts.do("POST", "/api/password/forgot", "", map[string]string{
+		"email": "nobody@example.com",
+	}), 202, nil)
+	ts.cfg.background.Wait()
+	if len(ts.outbox.Messages()) != sent {
+		t.Errorf("Expected no email for an unknown address")
+	}
+
+	ts.expect(ts.do("POST", "/api/password/forgot", "", map[string]string{
+		"email": "walt@example.com",
+	}), 202, nil)
+	_, stale := resetToken()
+
+	ts.expect(ts.do("POST", "/api/password/forgot", "", map[string]string{
+		"email": "walt@example.com",
+	}), 202, nil)
+	resetPath, token := resetToken()
+
+	ts.expect(ts.do("POST", resetPath, "", map[string]string{
+		"token": "invalid", "password": "abcdef",
+	}), 400, nil)
+	ts.expect(ts.do("POST", resetPath, "", map[string]string{
+		"token": token, "password": "",
+	}), 400, nil)
+	ts.expect(ts.do("POST", resetPath, "", map[string]string{
+		"token": token, "password": "abcdef",
+	}), 204, nil)
+
+	// Tokens are single use, and completing a reset burns the others too.
+	for _, used := range []string{token, stale} {
+		ts.expect(ts.do("POST", "/api/password/reset", "", map[string]string{
+			"token": used, "password": "hijacked",
+		}), 400, nil)
+	}
+
+	ts.expect(ts.do("POST", "/api/refresh", bearer(walt.RefreshToken), nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "walt@example.com", "password": "123456",
+	}), 401, nil)
+	ts.login("walt@example.com", "abcdef")
+
+	// A mail failure is only logged, or it would tell known addresses apart.
+	ts.cfg.mailer = failingMailer{}
+	ts.expect(ts.do("POST", "/api/password/forgot", "", map[string]string{
+		"email": "walt@example.com",
+	}), 202, nil)
+	ts.cfg.background.Wait()
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("mail server is down")
+}
+
+func TestTOTP(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	type enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+
+	enrolled := enrollment{}
+	ts.expect(ts.do("POST", "/api/users/mfa/totp", bearer(walt.Token), nil), 201, &enrolled)
+	if !strings.HasPrefix(enrolled.OTPAuthURI, "otpauth://totp/Chirpy:walt@example.com?") {
+		t.Errorf("Unexpected otpauth URI %s", enrolled.OTPAuthURI)
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrolled.Secret)
+	if err != nil {
+		t.Fatalf("Error decoding TOTP secret: %s", err)
+	}
+
+	// Until the enrollment is confirmed, logging in needs only the password.
+	ts.login("walt@example.com", "123456")
+
+	ts.expect(ts.do("POST", "/api/users/mfa/totp/confirm", bearer(walt.Token), map[string]string{
+		"code": "000000",
+	}), 400, nil)
+
+	now := time.Now()
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	ts.expect(ts.do("POST", "/api/users/mfa/totp/confirm", bearer(walt.Token), map[string]string{
+		"code": auth.TOTPCode(secret, now),
+	}), 200, &confirmed)
+	if len(confirmed.RecoveryCodes) != 10 {
+		t.Fatalf("Expected 10 recovery codes, got %v", confirmed.RecoveryCodes)
+	}
+
+	ts.expect(ts.do("POST", "/api/users/mfa/totp", bearer(walt.Token), nil), 409, nil)
+
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "walt@example.com", "password": "123456",
+	}), 200, &challenge)
+	if !challenge.MFARequired || challenge.MFAToken == "" || challenge.Token != "" {
+		t.Fatalf("Expected an MFA challenge, got %+v", challenge)
+	}
+
+	ts.expect(ts.do("GET", "/api/timeline", bearer(challenge.MFAToken), nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/login/mfa", "", map[string]string{
+		"mfa_token": walt.Token, "code": auth.TOTPCode(secret, now),
+	}), 401, nil)
+
+	// The code used to confirm the enrollment cannot be used again.
+	ts.expect(ts.do("POST", "/api/login/mfa", "", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": auth.TOTPCode(secret, now),
+	}), 401, nil)
+
+	next := auth.TOTPCode(secret, now.Add(auth.TOTPPeriod))
+	loggedIn := testUser{}
+	ts.expect(ts.do("POST", "/api/login/mfa", "", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": next,
+	}), 200, &loggedIn)
+	if loggedIn.Token == "" || loggedIn.RefreshToken == "" {
+		t.Errorf("Expected access and refresh tokens, got %+v", loggedIn)
+	}
+
+	recoveryCode := strings.ToUpper(confirmed.RecoveryCodes[0])
+	ts.expect(ts.do("POST", "/api/login/mfa", "", map[string]string{
+		"mfa_token": challenge.MFAToken, "recovery_code": recoveryCode,
+	}), 200, nil)
+	ts.expect(ts.do("POST", "/api/login/mfa", "", map[string]string{
+		"mfa_token": challenge.MFAToken, "recovery_code": recoveryCode,
+	}), 401, nil)
+
+	ts.expect(ts.do("DELETE", "/api/users/mfa/totp", bearer(loggedIn.Token), map[string]string{
+		"recovery_code": recoveryCode,
+	}), 400, nil)
+	ts.expect(ts.do("DELETE", "/api/users/mfa/totp", bearer(loggedIn.Token), map[string]string{
+		"recovery_code": confirmed.RecoveryCodes[1],
+	}), 204, nil)
+
+	ts.login("walt@example.com", "123456")
+}
+
+func TestChirpCRUD(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+
+	chirp := ts.chirp(walt.Token, "I am the one who knocks, what a kerfuffle")
+	if chirp.Body != "I am the one who knocks, what a ****" {
+		t.Errorf("Expected profanity to be masked, got %q", chirp.Body)
+	}
+
+	if chirp.UserID != walt.ID {
+		t.Errorf("Author mismatch %s != %s", chirp.UserID, walt.ID)
+	}
+
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": string(bytes.Repeat([]byte("a"), 141)),
+	}), 400, nil)
+
+	ts.expect(ts.do("POST", "/api/chirps", bearer("invalid"), map[string]string{
+		"body": "hello",
+	}), 401, nil)
+
+	fetched := testChirp{}
+	ts.expect(ts.do("GET", "/api/chirps/"+chirp.ID.String(), "", nil), 200, &fetched)
+	if fetched != chirp {
+		t.Errorf("Chirp mismatch %+v != %+v", fetched, chirp)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps/"+uuid.NewString(), "", nil), 404, nil)
+
+	ts.expect(ts.do("DELETE", "/api/chirps/"+chirp.ID.String(), bearer(jesse.Token), nil),
+		403, nil)
+	ts.expect(ts.do("DELETE", "/api/chirps/"+chirp.ID.String(), "", nil), 401, nil)
+	ts.expect(ts.do("DELETE", "/api/chirps/"+chirp.ID.String(), bearer(walt.Token), nil),
+		204, nil)
+
+	ts.expect(ts.do("GET", "/api/chirps/"+chirp.ID.String(), "", nil), 404, nil)
+}
+
+func TestEditChirp(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+
+	chirp := ts.chirp(walt.Token, "Say my nmae")
+	path := "/api/chirps/" + chirp.ID.String()
+
+	ts.expect(ts.do("PUT", path, bearer(jesse.Token), map[string]string{
+		"body": "Yo",
+	}), 403, nil)
+	ts.expect(ts.do("PUT", path, "", map[string]string{"body": "Yo"}), 401, nil)
+	ts.expect(ts.do("PUT", "/api/chirps/"+uuid.NewString(), bearer(walt.Token),
+		map[string]string{"body": "Yo"}), 404, nil)
+	ts.expect(ts.do("PUT", path, bearer(walt.Token), map[string]string{
+		"body": string(bytes.Repeat([]byte("a"), 141)),
+	}), 400, nil)
+
+	edited := testChirp{}
+	ts.expect(ts.do("PUT", path, bearer(walt.Token), map[string]string{
+		"body": "Say my name",
+	}), 200, &edited)
+	ts.expect(ts.do("PUT", path, bearer(walt.Token), map[string]string{
+		"body": "Say my name, sharbert",
+	}), 200, &edited)
+
+	if edited.ID != chirp.ID || edited.Body != "Say my name, ****" {
+		t.Errorf("Unexpected edited chirp %+v", edited)
+	}
+
+	revisions := []struct {
+		ChirpID uuid.UUID `json:"chirp_id"`
+		Body    string    `json:"body"`
+	}{}
+	ts.expect(ts.do("GET", path+"/revisions", "", nil), 200, &revisions)
+
+	if len(revisions) != 2 || revisions[0].Body != "Say my name" ||
+		revisions[1].Body != "Say my nmae" || revisions[0].ChirpID != chirp.ID {
+		t.Errorf("Expected earlier versions newest first, got %+v", revisions)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps/"+uuid.NewString()+"/revisions", "", nil), 404, nil)
+}
+
+func TestChirpLookupFailure(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	chirp := ts.chirp(walt.Token, "Say my name")
+	path := "/api/chirps/" + chirp.ID.String()
+
+	// A store failure is not a missing chirp.
+	db := &failingStore{Store: ts.cfg.db, failingChirps: true}
+	ts.cfg.db = db
+
+	ts.expect(ts.do("GET", path, "", nil), 500, nil)
+	ts.expect(ts.do("PUT", path, bearer(walt.Token), map[string]string{"body": "Heisenberg"}), 500, nil)
+	ts.expect(ts.do("DELETE", path, bearer(walt.Token), nil), 500, nil)
+	ts.expect(ts.do("GET", path+"/revisions", "", nil), 500, nil)
+	ts.expect(ts.do("POST", path+"/likes", bearer(walt.Token), nil), 500, nil)
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": "You're goddamn right", "in_reply_to": chirp.ID.String(),
+	}), 500, nil)
+
+	db.failingChirps = false
+	ts.expect(ts.do("GET", path, "", nil), 200, nil)
+	ts.expect(ts.do("GET", "/api/chirps/"+uuid.NewString(), "", nil), 404, nil)
+}
+
+func TestChirpLength(t *testing.T) {
+	ts := newTestServer(t)
+
+	user := ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	if chirp := ts.chirp(walt.Token, strings.Repeat("👩‍👩‍👧‍👦", 140)); chirp.Body == "" {
+		t.Errorf("Expected 140 emoji to fit in a chirp")
+	}
+
+	if chirp := ts.chirp(walt.Token, "cafe\u0301"); chirp.Body != "caf\u00e9" {
+		t.Errorf("Expected chirp to be stored in NFC, got %q", chirp.Body)
+	}
+
+	ts.chirp(walt.Token, strings.Repeat("a", 100)+" https://example.com/"+strings.Repeat("x", 200))
+
+	tooLong := testProblem{}
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": strings.Repeat("é", 141),
+	}), 400, &tooLong)
+
+	if tooLong.Code != "validation_failed" || len(tooLong.Errors) != 1 ||
+		tooLong.Errors[0].Code != "too_long" || tooLong.Errors[0].Length != 141 ||
+		tooLong.Errors[0].Limit != 140 {
+		t.Errorf("Unexpected problem %+v", tooLong)
+	}
+
+	ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, map[string]any{
+		"event": "user.upgraded",
+		"data":  map[string]string{"user_id": user.ID.String()},
+	}), 204, nil)
+
+	ts.chirp(walt.Token, strings.Repeat("a", 280))
+
+	tooLong = testProblem{}
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": strings.Repeat("a", 281),
+	}), 400, &tooLong)
+
+	if len(tooLong.Errors) != 1 || tooLong.Errors[0].Length != 281 || tooLong.Errors[0].Limit != 280 {
+		t.Errorf("Expected the Chirpy Red limit, got %+v", tooLong)
+	}
+
+	for _, body := range []string{
+		"a" + strings.Repeat("\u0301", 200_000),
+		"https://" + strings.Repeat("x", 512<<10),
+		"https://" + strings.Repeat("x", chirplen.MaxURLBytes),
+	} {
+		tooLong = testProblem{}
+		ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{"body": body}), 400, &tooLong)
+
+		if len(tooLong.Errors) != 1 || tooLong.Errors[0].Field != "body" || tooLong.Errors[0].Code != "too_long" {
+			t.Errorf("Expected a too_long error for a %d byte body, got %+v", len(body), tooLong)
+		}
+	}
+}
+
+func TestModerationWords(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	moderator := bearer(ts.staff("mod@example.com", "moderator").Token)
+
+	if chirp := ts.chirp(walt.Token, "What a kerfuffle!"); chirp.Body != "What a ****!" {
+		t.Errorf("Expected punctuated profanity to be masked, got %q", chirp.Body)
+	}
+
+	ts.expect(ts.do("POST", "/admin/moderation/words", moderator, map[string]string{
+		"word": "Heisenberg", "action": "reject",
+	}), 200, nil)
+	ts.expect(ts.do("POST", "/admin/moderation/words", moderator, map[string]string{
+		"word": "meth", "action": "flag",
+	}), 200, nil)
+	ts.expect(ts.do("POST", "/admin/moderation/words", moderator, map[string]string{
+		"word": "two words",
+	}), 400, nil)
+	ts.expect(ts.do("POST", "/admin/moderation/words", moderator, map[string]string{
+		"word": "blue", "action": "explode",
+	}), 400, nil)
+
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]string{
+		"body": "Say my name: heisenberg",
+	}), 400, nil)
+
+	flagged := ts.chirp(walt.Token, "Cooking meth")
+	if flagged.Body != "Cooking meth" {
+		t.Errorf("Expected flagged chirp to be stored as is, got %q", flagged.Body)
+	}
+
+	flags := []struct {
+		ChirpID uuid.UUID `json:"chirp_id"`
+		Rule    string    `json:"rule"`
+	}{}
+	ts.expect(ts.do("GET", "/admin/moderation/flags", moderator, nil), 200, &flags)
+	if len(flags) != 1 || flags[0].ChirpID != flagged.ID || flags[0].Rule != "words:flag" {
+		t.Errorf("Expected flagged chirp to be queued for review, got %+v", flags)
+	}
+
+	ts.expect(ts.do("DELETE", "/admin/moderation/words/kerfuffle", moderator, nil), 204, nil)
+	ts.expect(ts.do("DELETE", "/admin/moderation/words/kerfuffle", moderator, nil), 404, nil)
+
+	if chirp := ts.chirp(walt.Token, "What a kerfuffle!"); chirp.Body != "What a kerfuffle!" {
+		t.Errorf("Expected removed word to be allowed, got %q", chirp.Body)
+	}
+
+	words := []struct {
+		Word   string `json:"word"`
+		Action string `json:"action"`
+	}{}
+	ts.expect(ts.do("GET", "/admin/moderation/words", moderator, nil), 200, &words)
+	if len(words) != 4 || words[0].Word != "fornax" || words[1].Word != "heisenberg" ||
+		words[1].Action != "reject" {
+		t.Errorf("Unexpected word list %+v", words)
+	}
+
+	ts.expect(ts.do("GET", "/admin/moderation/words", bearer(walt.Token), nil), 403, nil)
+}
+
+func TestModerationWordsConcurrentWrites(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	moderator := bearer(ts.staff("mod@example.com", "moderator").Token)
+
+	words := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+
+	wg := sync.WaitGroup{}
+	for _, word := range words {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res := ts.do("POST", "/admin/moderation/words", moderator, map[string]string{
+				"word": word, "action": "mask",
+			})
+			if res.StatusCode != 200 {
+				t.Errorf("POST %s: status %d != 200", word, res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	chirp := ts.chirp(walt.Token, strings.Join(words, " "))
+	if strings.Trim(chirp.Body, "* ") != "" {
+		t.Errorf("Expected every word written concurrently to be masked, got %q", chirp.Body)
+	}
+}
+
+func TestRepliesAndThreads(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	reply := func(parentID uuid.UUID, body string) testChirp {
+		t.Helper()
+
+		chirp := testChirp{}
+		ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]any{
+			"body": body, "in_reply_to": parentID,
+		}), 201, &chirp)
+
+		return chirp
+	}
+
+	root := ts.chirp(walt.Token, "root")
+	child := reply(root.ID, "child")
+	sibling := reply(root.ID, "sibling")
+	grandchild := reply(child.ID, "grandchild")
+
+	ts.expect(ts.do("POST", "/api/chirps", bearer(walt.Token), map[string]any{
+		"body": "orphan", "in_reply_to": uuid.New(),
+	}), 400, nil)
+
+	type threadChirp struct {
+		ID         uuid.UUID      `json:"id"`
+		InReplyTo  *uuid.UUID     `json:"in_reply_to"`
+		ReplyCount int            `json:"reply_count"`
+		Replies    []*threadChirp `json:"replies"`
+	}
+
+	thread := struct {
+		Ancestors []threadChirp `json:"ancestors"`
+		Chirp     threadChirp   `json:"chirp"`
+	}{}
+	ts.expect(ts.do("GET", "/api/chirps/"+child.ID.String()+"/thread", "", nil), 200, &thread)
+
+	if len(thread.Ancestors) != 1 || thread.Ancestors[0].ID != root.ID ||
+		thread.Ancestors[0].ReplyCount != 2 {
+		t.Errorf("Expected root as the only ancestor, got %+v", thread.Ancestors)
+	}
+
+	if thread.Chirp.ID != child.ID || thread.Chirp.InReplyTo == nil ||
+		*thread.Chirp.InReplyTo != root.ID || thread.Chirp.ReplyCount != 1 {
+		t.Errorf("Unexpected thread chirp %+v", thread.Chirp)
+	}
+
+	if len(thread.Chirp.Replies) != 1 || thread.Chirp.Replies[0].ID != grandchild.ID {
+		t.Errorf("Expected grandchild as the only reply, got %+v", thread.Chirp.Replies)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps/"+root.ID.String()+"/thread", "", nil), 200, &thread)
+	if len(thread.Ancestors) != 0 || len(thread.Chirp.Replies) != 2 ||
+		thread.Chirp.Replies[0].ID != child.ID || thread.Chirp.Replies[1].ID != sibling.ID ||
+		len(thread.Chirp.Replies[0].Replies) != 1 {
+		t.Errorf("Unexpected conversation tree %+v", thread)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps/"+uuid.NewString()+"/thread", "", nil), 404, nil)
+
+	ts.expect(ts.do("DELETE", "/api/chirps/"+child.ID.String(), bearer(walt.Token), nil),
+		204, nil)
+
+	detached := threadChirp{}
+	ts.expect(ts.do("GET", "/api/chirps/"+grandchild.ID.String(), "", nil), 200, &detached)
+	if detached.InReplyTo != nil {
+		t.Errorf("Expected replies to a deleted chirp to be detached, got %+v", detached)
+	}
+
+	parent := threadChirp{}
+	ts.expect(ts.do("GET", "/api/chirps/"+root.ID.String(), "", nil), 200, &parent)
+	if parent.ReplyCount != 1 {
+		t.Errorf("Expected reply count to drop to 1, got %d", parent.ReplyCount)
+	}
+}
+
+func TestLikesAndRechirps(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	chirp := ts.chirp(walt.Token, "Say my name")
+	path := "/api/chirps/" + chirp.ID.String()
+
+	type counters struct {
+		LikeCount    int   `json:"like_count"`
+		RechirpCount int   `json:"rechirp_count"`
+		LikedByMe    *bool `json:"liked_by_me"`
+	}
+
+	users := []testUser{}
+	for i := 0; i < 4; i++ {
+		email := fmt.Sprintf("fan%d@example.com", i)
+		ts.signup(email, "123456")
+		users = append(users, ts.login(email, "123456"))
+	}
+
+	var wg sync.WaitGroup
+	for _, user := range users {
+		for i := 0; i < 3; i++ {
+			wg.Add(2)
+			for _, reaction := range []string{"/likes", "/rechirps"} {
+				go func() {
+					defer wg.Done()
+
+					res := ts.do("POST", path+reaction, bearer(user.Token), nil)
+					if res.StatusCode != 200 {
+						t.Errorf("POST %s: status %d != 200", reaction, res.StatusCode)
+					}
+				}()
+			}
+		}
+	}
+	wg.Wait()
+
+	got := counters{}
+	ts.expect(ts.do("GET", path, "", nil), 200, &got)
+	if got.LikeCount != 4 || got.RechirpCount != 4 || got.LikedByMe != nil {
+		t.Errorf("Expected one like and rechirp per user, got %+v", got)
+	}
+
+	ts.expect(ts.do("GET", path, bearer(users[0].Token), nil), 200, &got)
+	if got.LikedByMe == nil || !*got.LikedByMe {
+		t.Errorf("Expected liked_by_me for a liking user, got %+v", got)
+	}
+
+	got = counters{}
+	ts.expect(ts.do("DELETE", path+"/likes", bearer(users[0].Token), nil), 200, &got)
+	ts.expect(ts.do("DELETE", path+"/likes", bearer(users[0].Token), nil), 200, &got)
+	if got.LikeCount != 3 || got.LikedByMe == nil || *got.LikedByMe {
+		t.Errorf("Expected unlike to be idempotent, got %+v", got)
+	}
+
+	ts.expect(ts.do("DELETE", path+"/rechirps", bearer(users[1].Token), nil), 200, &got)
+	if got.RechirpCount != 3 {
+		t.Errorf("Expected rechirp count to drop to 3, got %+v", got)
+	}
+
+	page := struct {
+		Chirps []counters `json:"chirps"`
+	}{}
+	ts.expect(ts.do("GET", "/api/chirps", bearer(walt.Token), nil), 200, &page)
+	if len(page.Chirps) != 1 || page.Chirps[0].LikedByMe == nil || *page.Chirps[0].LikedByMe ||
+		page.Chirps[0].LikeCount != 3 {
+		t.Errorf("Unexpected chirp listing %+v", page.Chirps)
+	}
+
+	ts.expect(ts.do("POST", path+"/likes", "", nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/chirps/"+uuid.NewString()+"/likes", bearer(walt.Token), nil),
+		404, nil)
+}
+
+type testChirpPage struct {
+	Chirps     []testChirp `json:"chirps"`
+	NextCursor string      `json:"next_cursor"`
+}
+
+func TestGetChirpsQueryOptions(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+
+	first := ts.chirp(walt.Token, "first")
+	second := ts.chirp(jesse.Token, "second")
+	third := ts.chirp(walt.Token, "third")
+
+	page := testChirpPage{}
+	ts.expect(ts.do("GET", "/api/chirps", "", nil), 200, &page)
+	chirps := page.Chirps
+	if len(chirps) != 3 || chirps[0] != first || chirps[1] != second || chirps[2] != third {
+		t.Errorf("Expected chirps in ascending order, got %+v", chirps)
+	}
+
+	if page.NextCursor != "" {
+		t.Errorf("Expected no next cursor on the last page, got %q", page.NextCursor)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps?sort=desc", "", nil), 200, &page)
+	chirps = page.Chirps
+	if len(chirps) != 3 || chirps[0] != third || chirps[2] != first {
+		t.Errorf("Expected chirps in descending order, got %+v", chirps)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps?author_id="+walt.ID.String(), "", nil),
+		200, &page)
+	chirps = page.Chirps
+	if len(chirps) != 2 || chirps[0] != first || chirps[1] != third {
+		t.Errorf("Expected only chirps by author, got %+v", chirps)
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps?sort=desc&author_id="+walt.ID.String(), "", nil),
+		200, &page)
+	chirps = page.Chirps
+	if len(chirps) != 2 || chirps[0] != third || chirps[1] != first {
+		t.Errorf("Expected author chirps in descending order, got %+v", chirps)
+	}
+}
+
+func TestGetChirpsPagination(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	created := []testChirp{}
+	for i := 0; i < 5; i++ {
+		created = append(created, ts.chirp(walt.Token, fmt.Sprintf("chirp %d", i)))
+	}
+
+	seen := []testChirp{}
+	path := "/api/chirps?sort=desc&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("Pagination did not terminate")
+		}
+
+		page := testChirpPage{}
+		ts.expect(ts.do("GET", path, "", nil), 200, &page)
+		seen = append(seen, page.Chirps...)
+
+		if page.NextCursor == "" {
+			break
+		}
+
+		path = "/api/chirps?sort=desc&limit=2&cursor=" + page.NextCursor
+	}
+
+	if len(seen) != len(created) {
+		t.Fatalf("Chirp count mismatch %d != %d", len(seen), len(created))
+	}
+
+	for i := range seen {
+		if seen[i] != created[len(created)-1-i] {
+			t.Errorf("Chirp %d mismatch %+v != %+v", i, seen[i], created[len(created)-1-i])
+		}
+	}
+
+	ts.expect(ts.do("GET", "/api/chirps?limit=0", "", nil), 400, nil)
+	ts.expect(ts.do("GET", "/api/chirps?limit=abc", "", nil), 400, nil)
+	ts.expect(ts.do("GET", "/api/chirps?cursor=not-a-cursor", "", nil), 400, nil)
+}
+
+func TestFollowsAndTimeline(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+	ts.signup("jesse@example.com", "654321")
+	jesse := ts.login("jesse@example.com", "654321")
+	ts.signup("saul@example.com", "111111")
+	saul := ts.login("saul@example.com", "111111")
+
+	jessePath := "/api/users/" + jesse.ID.String()
+	saulPath := "/api/users/" + saul.ID.String()
+
+	ts.expect(ts.do("POST", jessePath+"/follow", "", nil), 401, nil)
+	ts.expect(ts.do("POST", "/api/users/"+walt.ID.String()+"/follow", bearer(walt.Token), nil),
+		400, nil)
+	ts.expect(ts.do("POST", "/api/users/"+uuid.NewString()+"/follow", bearer(walt.Token), nil),
+		404, nil)
+
+	ts.expect(ts.do("POST", jessePath+"/follow", bearer(walt.Token), nil), 204, nil)
+	ts.expect(ts.do("POST", jessePath+"/follow", bearer(walt.Token), nil), 204, nil)
+	ts.expect(ts.do("POST", saulPath+"/follow", bearer(walt.Token), nil), 204, nil)
+	ts.expect(ts.do("POST", saulPath+"/follow", bearer(jesse.Token), nil), 204, nil)
+
+	follows := []struct {
+		UserID uuid.UUID `json:"user_id"`
+	}{}
+	ts.expect(ts.do("GET", saulPath+"/followers", "", nil), 200, &follows)
+	if len(follows) != 2 || follows[0].UserID != jesse.ID || follows[1].UserID != walt.ID {
+		t.Errorf("Unexpected followers %+v", follows)
+	}
+
+	ts.expect(ts.do("GET", "/api/users/"+walt.ID.String()+"/following", "", nil),
+		200, &follows)
+	if len(follows) != 2 || follows[0].UserID != saul.ID || follows[1].UserID != jesse.ID {
+		t.Errorf("Unexpected following %+v", follows)
+	}
+
+	ts.expect(ts.do("GET", "/api/users/"+uuid.NewString()+"/followers", "", nil), 404, nil)
+
+	ts.chirp(walt.Token, "Not on my own timeline")
+	first := ts.chirp(jesse.Token, "Yeah science")
+	second := ts.chirp(saul.Token, "Better call Saul")
+	third := ts.chirp(jesse.Token, "Yo")
+
+	ts.expect(ts.do("GET", "/api/timeline", "", nil), 401, nil)
+
+	page := testChirpPage{}
+	ts.expect(ts.do("GET", "/api/timeline?limit=2", bearer(walt.Token), nil), 200, &page)
+	if len(page.Chirps) != 2 || page.Chirps[0] != third || page.Chirps[1] != second {
+		t.Errorf("Expected newest followed chirps first, got %+v", page.Chirps)
+	}
+
+	path := "/api/timeline?limit=2&cursor=" + page.NextCursor
+	page = testChirpPage{}
+	ts.expect(ts.do("GET", path, bearer(walt.Token), nil), 200, &page)
+	if len(page.Chirps) != 1 || page.Chirps[0] != first || page.NextCursor != "" {
+		t.Errorf("Expected last timeline page, got %+v", page)
+	}
+
+	ts.expect(ts.do("DELETE", jessePath+"/follow", bearer(walt.Token), nil), 204, nil)
+	ts.expect(ts.do("DELETE", jessePath+"/follow", bearer(walt.Token), nil), 204, nil)
+
+	ts.expect(ts.do("GET", "/api/timeline", bearer(walt.Token), nil), 200, &page)
+	if len(page.Chirps) != 1 || page.Chirps[0] != second {
+		t.Errorf("Expected unfollowed chirps to leave the timeline, got %+v", page.Chirps)
+	}
+}
+
+func TestPolkaWebhook(t *testing.T) {
+	ts := newTestServer(t)
+
+	user := ts.signup("walt@example.com", "123456")
+
+	upgrade := map[string]any{
+		"event": "user.upgraded",
+		"data":  map[string]string{"user_id": user.ID.String()},
+	}
+
+	ts.expect(ts.do("POST", "/api/polka/webhooks", "", upgrade), 401, nil)
+	ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey wrong", upgrade), 401, nil)
+
+	ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey,
+		map[string]any{
+			"event": "user.payment_failed",
+			"data":  map[string]string{"user_id": user.ID.String()},
+		}), 204, nil)
+
+	if loggedIn := ts.login("walt@example.com", "123456"); loggedIn.IsChirpyRed {
+		t.Errorf("Expected unrelated events to be ignored")
+	}
+
+	ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, upgrade), 204, nil)
+
+	if loggedIn := ts.login("walt@example.com", "123456"); !loggedIn.IsChirpyRed {
+		t.Errorf("Expected user to be upgraded to Chirpy Red")
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	ts := newTestServer(t)
+
+	user := ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	type subscription struct {
+		Plan        string     `json:"plan"`
+		Status      string     `json:"status"`
+		IsChirpyRed bool       `json:"is_chirpy_red"`
+		StartedAt   time.Time  `json:"started_at"`
+		RenewedAt   *time.Time `json:"renewed_at"`
+		ExpiresAt   time.Time  `json:"expires_at"`
+		CanceledAt  *time.Time `json:"canceled_at"`
+		History     []struct {
+			Event  string `json:"event"`
+			Status string `json:"status"`
+		} `json:"history"`
+	}
+
+	polka := func(event string, data map[string]any) {
+		t.Helper()
+
+		data["user_id"] = user.ID.String()
+		ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey,
+			map[string]any{"event": event, "data": data}), 204, nil)
+	}
+	get := func() subscription {
+		t.Helper()
+
+		sub := subscription{}
+		ts.expect(ts.do("GET", "/api/users/me/subscription", bearer(walt.Token), nil), 200, &sub)
+		return sub
+	}
+
+	ts.expect(ts.do("GET", "/api/users/me/subscription", "", nil), 401, nil)
+	ts.expect(ts.do("GET", "/api/users/me/subscription", bearer(walt.Token), nil), 404, nil)
+
+	polka("user.canceled", map[string]any{})
+	ts.expect(ts.do("GET", "/api/users/me/subscription", bearer(walt.Token), nil), 404, nil)
+
+	polka("user.upgraded", map[string]any{})
+	sub := get()
+	if sub.Plan != "red" || sub.Status != "active" || !sub.IsChirpyRed || sub.RenewedAt != nil ||
+		sub.ExpiresAt.Before(time.Now().Add(29*24*time.Hour)) {
+		t.Errorf("Unexpected new subscription %+v", sub)
+	}
+
+	polka("user.payment_failed", map[string]any{})
+	if sub := get(); sub.Status != "past_due" || !sub.IsChirpyRed {
+		t.Errorf("Expected a failed payment to keep Chirpy Red during the grace period, got %+v", sub)
+	}
+
+	renewedUntil := time.Now().Add(60 * 24 * time.Hour).UTC().Truncate(time.Second)
+	polka("user.renewed", map[string]any{"expires_at": renewedUntil})
+	if sub := get(); sub.Status != "active" || sub.RenewedAt == nil || !sub.ExpiresAt.Equal(renewedUntil) {
+		t.Errorf("Unexpected renewed subscription %+v", sub)
+	}
+
+	polka("user.canceled", map[string]any{})
+	if sub := get(); sub.Status != "canceled" || sub.CanceledAt == nil || !sub.IsChirpyRed {
+		t.Errorf("Expected a canceled subscription to last until it expires, got %+v", sub)
+	}
+
+	if expired, err := ts.cfg.expireSubscriptions(context.Background()); err != nil || expired != 0 {
+		t.Errorf("Expected nothing to expire yet, got %d, %v", expired, err)
+	}
+
+	// Renewed long ago and never again, so the grace period is over too.
+	polka("user.renewed", map[string]any{"expires_at": time.Now().Add(-8 * 24 * time.Hour)})
+
+	if expired, err := ts.cfg.expireSubscriptions(context.Background()); err != nil || expired != 1 {
+		t.Fatalf("Expected the lapsed subscription to expire, got %d, %v", expired, err)
+	}
+
+	sub = get()
+	if sub.Status != "expired" || sub.IsChirpyRed || len(sub.History) != 6 ||
+		sub.History[0].Event != "subscription.expired" || sub.History[5].Event != "user.upgraded" {
+		t.Errorf("Unexpected expired subscription %+v", sub)
+	}
+
+	if loggedIn := ts.login("walt@example.com", "123456"); loggedIn.IsChirpyRed {
+		t.Errorf("Expected Chirpy Red to end with the subscription")
+	}
+
+	polka("user.payment_failed", map[string]any{})
+	if sub := get(); sub.Status != "expired" {
+		t.Errorf("Expected events for an expired subscription to be ignored, got %+v", sub)
+	}
+
+	polka("user.upgraded", map[string]any{"plan": "red-annual"})
+	if sub := get(); sub.Plan != "red-annual" || sub.Status != "active" || sub.RenewedAt != nil ||
+		sub.StartedAt.Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("Expected a new subscription after expiry, got %+v", sub)
+	}
+
+	polka("user.downgraded", map[string]any{})
+	if sub := get(); sub.Status != "expired" || sub.IsChirpyRed {
+		t.Errorf("Expected a downgrade to end the subscription at once, got %+v", sub)
+	}
+
+	if loggedIn := ts.login("walt@example.com", "123456"); loggedIn.IsChirpyRed {
+		t.Errorf("Expected downgraded user to lose Chirpy Red")
+	}
+
+	ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, map[string]any{
+		"event": "user.upgraded",
+		"data":  map[string]string{"user_id": uuid.NewString()},
+	}), 404, nil)
+}
+
+func TestSubscriptionConcurrentEvents(t *testing.T) {
+	ts := newTestServer(t)
+
+	db := &racingStore{Store: ts.cfg.db}
+	ts.cfg.db = db
+
+	user := ts.signup("walt@example.com", "123456")
+	walt := ts.login("walt@example.com", "123456")
+
+	polka := func(event string, data map[string]any) {
+		t.Helper()
+
+		data["user_id"] = user.ID.String()
+		ts.expect(ts.do("POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey,
+			map[string]any{"event": event, "data": data}), 204, nil)
+	}
+
+	polka("user.upgraded", map[string]any{})
+
+	// The renewal lands after the cancellation has read the subscription but
+	// before it is saved, so the cancellation has to start over from it.
+	renewedUntil := time.Now().Add(60 * 24 * time.Hour).UTC().Truncate(time.Second)
+	db.beforeSave = func() {
+		polka("user.renewed", map[string]any{"expires_at": renewedUntil})
+	}
+	polka("user.canceled", map[string]any{})
+
+	sub := struct {
+		Status    string    `json:"status"`
+		ExpiresAt time.Time `json:"expires_at"`
+		History   []struct {
+			Event string `json:"event"`
+		} `json:"history"`
+	}{}
+	ts.expect(ts.do("GET", "/api/users/me/subscription", bearer(walt.Token), nil), 200, &sub)
+
+	if sub.Status != "canceled" || !sub.ExpiresAt.Equal(renewedUntil) || len(sub.History) != 3 ||
+		sub.History[0].Event != "user.canceled" || sub.History[1].Event != "user.renewed" {
+		t.Errorf("Expected the cancellation to keep the renewal, got %+v", sub)
+	}
+}
+
+// racingStore runs beforeSave, once, ahead of the next subscription write.
+type racingStore struct {
+	store.Store
+	beforeSave func()
+}
+
+func (s *racingStore) SaveSubscription(ctx context.Context, arg database.SaveSubscriptionParams) (database.Subscription, error) {
+	if beforeSave := s.beforeSave; beforeSave != nil {
+		s.beforeSave = nil
+		beforeSave()
+	}
+
+	return s.Store.SaveSubscription(ctx, arg)
+}
+
+// failingStore fails subscription writes while failing is set, user lookups
+// while failingUsers is, and chirp lookups while failingChirps is.
+type failingStore struct {
+	store.Store
+	failing       bool
+	failingUsers  bool
+	failingChirps bool
+}
+
+func (s *failingStore) GetChirpByID(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	if s.failingChirps {
+		return database.Chirp{}, errors.New("database is down")
+	}
+
+	return s.Store.GetChirpByID(ctx, id)
+}
+
+func (s *failingStore) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	if s.failingUsers {
+		return database.User{}, errors.New("database is down")
+	}
+
+	return s.Store.GetUserByID(ctx, id)
+}
+
+func (s *failingStore) SaveSubscription(ctx context.Context, arg database.SaveSubscriptionParams) (database.Subscription, error) {
+	if s.failing {
+		return database.Subscription{}, errors.New("database is down")
+	}
+
+	return s.Store.SaveSubscription(ctx, arg)
+}
+
+func TestPolkaWebhookEventLog(t *testing.T) {
+	ts := newTestServer(t)
+
+	const secret = "test-webhook-secret"
+	ts.cfg.polkaWebhookSecret = secret
+	db := &failingStore{Store: ts.cfg.db}
+	ts.cfg.db = db
+
+	admin := ts.staff("admin@example.com", roleAdmin)
+	user := ts.signup("walt@example.com", "123456")
+
+	deliver := func(body, signature string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("POST", ts.URL+"/api/polka/webhooks", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Polka-Signature", signature)
+		req.Header.Set("Authorization", "ApiKey "+testPolkaKey)
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Error sending webhook: %s", err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+
+		return res
+	}
+	sign := func(body string) string {
+		return auth.SignWebhook([]byte(secret), time.Now(), []byte(body))
+	}
+	event := func(id, event, userID string) string {
+		return fmt.Sprintf(`{"id":%q,"event":%q,"data":{"user_id":%q}}`, id, event, userID)
+	}
+	logged := func(id string) polkaEventResponse {
+		t.Helper()
+
+		e := polkaEventResponse{}
+		ts.expect(ts.do("GET", "/admin/polka/events/"+id, bearer(admin.Token), nil), 200, &e)
+		return e
+	}
+
+	upgrade := event("evt_1", "user.upgraded", user.ID.String())
+
+	ts.expect(deliver(upgrade, ""), 401, nil)
+	ts.expect(deliver(upgrade, auth.SignWebhook([]byte("wrong"), time.Now(), []byte(upgrade))), 401, nil)
+	ts.expect(deliver(upgrade, auth.SignWebhook([]byte(secret), time.Now().Add(-time.Hour), []byte(upgrade))), 401, nil)
+	ts.expect(deliver(event("evt_1", "user.downgraded", user.ID.String()), sign(upgrade)), 401, nil)
+
+	ts.expect(deliver(upgrade, sign(upgrade)), 204, nil)
+	ts.expect(deliver(upgrade, sign(upgrade)), 204, nil)
+
+	if e := logged("evt_1"); e.Status != "processed" || e.Attempts != 1 || e.ProcessedAt == nil ||
+		!strings.Contains(string(e.Payload), user.ID.String()) {
+		t.Errorf("Expected a retried delivery to be applied once, got %+v", e)
+	}
+
+	if loggedIn := ts.login("walt@example.com", "123456"); !loggedIn.IsChirpyRed {
+		t.Errorf("Expected user to be upgraded to Chirpy Red")
+	}
+
+	// Fields Polka adds later do not get a delivery refused, and payloads
+	// that cannot be applied are still logged.
+	extended := fmt.Sprintf(`{"id":"evt_6","event":"user.renewed","data":{"user_id":%q,"seats":3},"api_version":2}`,
+		user.ID.String())
+	ts.expect(deliver(extended, sign(extended)), 204, nil)
+	if e := logged("evt_6"); e.Status != "processed" {
+		t.Errorf("Expected a payload with new fields to be processed, got %+v", e)
+	}
+
+	invalid := `{"id":"evt_7","event":"user.renewed","data":{}}`
+	ts.expect(deliver(invalid, sign(invalid)), 400, nil)
+	ts.expect(deliver(invalid, sign(invalid)), 400, nil)
+	if e := logged("evt_7"); e.Status != "rejected" || e.Attempts != 1 ||
+		!strings.HasPrefix(e.LastError, "Invalid payload") {
+		t.Errorf("Expected an invalid payload to be logged as rejected, got %+v", e)
+	}
+
+	ts.expect(deliver(`{"id":`, sign(`{"id":`)), 400, nil)
+
+	unknownUser := event("evt_2", "user.upgraded", uuid.NewString())
+	ts.expect(deliver(unknownUser, sign(unknownUser)), 404, nil)
+	ts.expect(deliver(unknownUser, sign(unknownUser)), 404, nil)
+
+	if e := logged("evt_2"); e.Status != "rejected" || e.Attempts != 1 || e.LastError != "User not found" {
+		t.Errorf("Unexpected rejected event %+v", e)
+	}
+
+	db.failing = true
+	downgrade := event("evt_3", "user.downgraded", user.ID.String())
+
+	res := deliver(downgrade, sign(downgrade))
+	if res.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After on a failed delivery")
+	}
+	ts.expect(res, 503, nil)
+
+	if e := logged("evt_3"); e.Status != "failed" || e.LastError == "" || e.ProcessedAt != nil {
+		t.Errorf("Unexpected failed event %+v", e)
+	}
+
+	db.failing = false
+	ts.expect(deliver(downgrade, sign(downgrade)), 204, nil)
+
+	if e := logged("evt_3"); e.Status != "processed" || e.Attempts != 2 || e.LastError != "" {
+		t.Errorf("Expected the retried delivery to be processed, got %+v", e)
+	}
+
+	db.failing = true
+	renew := event("evt_4", "user.renewed", user.ID.String())
+	ts.expect(deliver(renew, sign(renew)), 503, nil)
+	db.failing = false
+
+	failed := []polkaEventResponse{}
+	ts.expect(ts.do("GET", "/admin/polka/events?status=failed", bearer(admin.Token), nil), 200, &failed)
+	if len(failed) != 1 || failed[0].ID != "evt_4" || failed[0].Payload != nil {
+		t.Errorf("Expected only the failed event without its payload, got %+v", failed)
+	}
+
+	rerun := polkaEventResponse{}
+	ts.expect(ts.do("POST", "/admin/polka/events/evt_4/rerun", bearer(admin.Token), nil), 200, &rerun)
+	if rerun.Status != "processed" || rerun.Attempts != 2 {
+		t.Errorf("Expected the re-run event to be processed, got %+v", rerun)
+	}
+
+	if loggedIn := ts.login("walt@example.com", "123456"); !loggedIn.IsChirpyRed {
+		t.Errorf("Expected the re-run renewal to restore Chirpy Red")
+	}
+
+	// Settled events are not applied again, or a renewal would add a period.
+	for _, id := range []string{"evt_1", "evt_2", "evt_4"} {
+		ts.expect(ts.do("POST", "/admin/polka/events/"+id+"/rerun", bearer(admin.Token), nil), 409, nil)
+	}
+	if e := logged("evt_4"); e.Attempts != 2 {
+		t.Errorf("Expected a refused re-run not to be attempted, got %+v", e)
+	}
+
+	// Parallel deliveries of one event apply it once; the losers are told
+	// to retry while it is being processed.
+	renewAgain := event("evt_5", "user.renewed", user.ID.String())
+	statuses := make(chan int, 10)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("POST", ts.URL+"/api/polka/webhooks", strings.NewReader(renewAgain))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Polka-Signature", sign(renewAgain))
+
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Errorf("Error sending webhook: %s", err)
+				return
+			}
+			res.Body.Close()
+			statuses <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != 204 && status != 503 {
+			t.Errorf("Expected 204 or 503 for a parallel delivery, got %d", status)
+		}
+	}
+	if e := logged("evt_5"); e.Status != "processed" || e.Attempts != 1 {
+		t.Errorf("Expected parallel deliveries to be applied once, got %+v", e)
+	}
+
+	all := []polkaEventResponse{}
+	ts.expect(ts.do("GET", "/admin/polka/events?limit=2", bearer(admin.Token), nil), 200, &all)
+	if len(all) != 2 {
+		t.Errorf("Expected the limit to be applied, got %d events", len(all))
+	}
+
+	ts.expect(ts.do("GET", "/admin/polka/events?status=lost", bearer(admin.Token), nil), 400, nil)
+	ts.expect(ts.do("GET", "/admin/polka/events/evt_404", bearer(admin.Token), nil), 404, nil)
+	ts.expect(ts.do("POST", "/admin/polka/events/evt_404/rerun", bearer(admin.Token), nil), 404, nil)
+
+	walt := ts.login("walt@example.com", "123456")
+	ts.expect(ts.do("GET", "/admin/polka/events", bearer(walt.Token), nil), 403, nil)
+}
+
+func TestAdminReset(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.signup("walt@example.com", "123456")
+	admin := ts.staff("admin@example.com", "admin")
+
+	ts.cfg.platform = "prod"
+	ts.expect(ts.do("POST", "/admin/reset", bearer(admin.Token), nil), 403, nil)
+
+	ts.cfg.platform = "dev"
+	ts.expect(ts.do("POST", "/admin/reset", bearer(admin.Token), nil), 200, nil)
+
+	ts.expect(ts.do("POST", "/api/login", "", map[string]string{
+		"email": "walt@example.com", "password": "123456",
+	}), 401, nil)
+}
+
+func TestRoles(t *testing.T) {
+	ts := newTestServer(t)
+
+	admin := ts.staff("admin@example.com", "admin")
+	walt := ts.signup("walt@example.com", "123456")
+	waltLogin := ts.login("walt@example.com", "123456")
+
+	rolesPath := "/admin/users/" + walt.ID.String() + "/roles"
+
+	ts.expect(ts.do("PUT", rolesPath+"/moderator", bearer(waltLogin.Token), nil), 403, nil)
+	ts.expect(ts.do("PUT", rolesPath+"/overlord", bearer(admin.Token), nil), 400, nil)
+	ts.expect(ts.do("PUT", "/admin/users/"+uuid.NewString()+"/roles/moderator",
+		bearer(admin.Token), nil), 404, nil)
+	ts.expect(ts.do("PUT", rolesPath+"/moderator", bearer(admin.Token), nil), 204, nil)
+	ts.expect(ts.do("PUT", rolesPath+"/moderator", bearer(admin.Token), nil), 204, nil)
+
+	roles := struct {
+		Roles []string `json:"roles"`
+	}{}
+	ts.expect(ts.do("GET", rolesPath, bearer(admin.Token), nil), 200, &roles)
+	if len(roles.Roles) != 2 || roles.Roles[0] != "user" || roles.Roles[1] != "moderator" {
+		t.Errorf("Expected user and moderator roles, got %v", roles.Roles)
+	}
+
+	// New access tokens carry the roles, the old one keeps working for
+	// moderator routes because they are checked against the database.
+	ts.expect(ts.do("GET", "/admin/moderation/words", bearer(waltLogin.Token), nil), 200, nil)
+
+	accessToken, err := ts.cfg.jwtKeys.ValidateAccessToken(ts.login("walt@example.com", "123456").Token)
+	if err != nil {
+		t.Fatalf("Error validating JWT: %s", err)
+	}
+	if !slices.Equal(accessToken.Roles, []string{"user", "moderator"}) {
+		t.Errorf("Expected roles in access token, got %v", accessToken.Roles)
+	}
+
+	ts.expect(ts.do("DELETE", rolesPath+"/moderator", bearer(admin.Token), nil), 204, nil)
+	ts.expect(ts.do("DELETE", rolesPath+"/moderator", bearer(admin.Token), nil), 404, nil)
+	ts.expect(ts.do("GET", "/admin/moderation/words", bearer(waltLogin.Token), nil), 403, nil)
+
+	// The last admin cannot be removed, or nobody could grant roles again.
+	ts.expect(ts.do("DELETE", "/admin/users/"+admin.ID.String()+"/roles/admin",
+		bearer(admin.Token), nil), 409, nil)
+	ts.expect(ts.do("DELETE", rolesPath+"/admin", bearer(admin.Token), nil), 404, nil)
+
+	// Two admins revoking each other at once leave one of them admin.
+	other := ts.staff("other@example.com", "admin")
+
+	results := make(chan int, 2)
+	var wg sync.WaitGroup
+	for _, pair := range [][2]testUser{{admin, other}, {other, admin}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res := ts.do("DELETE", "/admin/users/"+pair[1].ID.String()+"/roles/admin",
+				bearer(pair[0].Token), nil)
+			res.Body.Close()
+			results <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	revoked := 0
+	for status := range results {
+		if status == 204 {
+			revoked++
+		} else if status != 409 && status != 403 {
+			t.Errorf("Expected 204, 403 or 409 revoking an admin, got %d", status)
+		}
+	}
+	if revoked != 1 {
+		t.Errorf("Expected exactly one admin to be revoked, got %d", revoked)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Scopes limit what a personal access token can do. Routes needing
+// scopeSessionOnly, such as managing tokens, sessions or roles, or changing
+// the email or password, only accept the access tokens issued at login.
+// scopeFollowsWrite covers following and unfollowing users, nothing else.
+const (
+	scopeSessionOnly  = ""
+	scopeChirpsRead   = "chirps:read"
+	scopeChirpsWrite  = "chirps:write"
+	scopeFollowsWrite = "follows:write"
+)
+
+var tokenScopes = []string{scopeChirpsRead, scopeChirpsWrite, scopeFollowsWrite}
+
+func (cfg *apiConfig) authenticatePersonalToken(ctx context.Context, token string) (requestAuth, error) {
+	personalToken, err := cfg.db.GetPersonalAccessTokenByHash(ctx, auth.HashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return requestAuth{}, auth.ErrTokenUnknown
+	}
+	if err != nil {
+		return requestAuth{}, authUnavailable(err)
+	}
+
+	currentTime := time.Now().UTC()
+
+	if personalToken.RevokedAt.Valid {
+		return requestAuth{}, auth.ErrTokenRevoked
+	}
+
+	if personalToken.ExpiresAt.Valid && !personalToken.ExpiresAt.Time.After(currentTime) {
+		return requestAuth{}, auth.ErrTokenExpired
+	}
+
+	user, err := cfg.db.GetUserByID(ctx, personalToken.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return requestAuth{}, auth.ErrTokenUnknown
+	}
+	if err != nil {
+		return requestAuth{}, authUnavailable(err)
+	}
+
+	err = cfg.db.TouchPersonalAccessToken(ctx, database.TouchPersonalAccessTokenParams{
+		ID:         personalToken.ID,
+		LastUsedAt: sql.NullTime{Time: currentTime, Valid: true},
+	})
+	if err != nil {
+		return requestAuth{}, authUnavailable(err)
+	}
+
+	return requestAuth{user: user, personalToken: true, scopes: personalToken.Scopes}, nil
+}
+
+type personalTokenResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func newPersonalTokenResponse(token database.PersonalAccessToken) personalTokenResponse {
+	res := personalTokenResponse{
+		ID:        token.ID,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+	}
+
+	if token.ExpiresAt.Valid {
+		res.ExpiresAt = &token.ExpiresAt.Time
+	}
+
+	if token.LastUsedAt.Valid {
+		res.LastUsedAt = &token.LastUsedAt.Time
+	}
+
+	return res
+}
+
+func validateTokenRequest(scopes []string, expiresAt *time.Time) error {
+	for _, scope := range scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			return fieldError{Field: "scopes", Code: fieldCodeInvalid, Message: fmt.Sprintf("Unknown scope %q", scope)}
+		}
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return fieldError{Field: "expires_at", Code: fieldCodeInvalid, Message: "Token expiry must be in the future"}
+	}
+
+	return nil
+}
+
+func (cfg *apiConfig) handlerCreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	type req struct {
+		Name      string     `json:"name" validate:"required,max=100"`
+		Scopes    []string   `json:"scopes" validate:"required"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	reqStruct := req{}
+	if !decodeJSON(w, r, &reqStruct) {
+		return
+	}
+
+	err := validateTokenRequest(reqStruct.Scopes, reqStruct.ExpiresAt)
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error creating personal access token: %s", err)
+		return
+	}
+
+	tokenValue, err := auth.MakePersonalAccessToken()
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error creating a personal access token: %s", err)
+		return
+	}
+
+	expiresAt := sql.NullTime{}
+	if reqStruct.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: reqStruct.ExpiresAt.UTC(), Valid: true}
+	}
+
+	slices.Sort(reqStruct.Scopes)
+
+	personalToken, err := cfg.db.CreatePersonalAccessToken(r.Context(),
+		database.CreatePersonalAccessTokenParams{
+			ID:        uuid.New(),
+			UserID:    caller.user.ID,
+			Name:      reqStruct.Name,
+			TokenHash: auth.HashToken(tokenValue),
+			Scopes:    slices.Compact(reqStruct.Scopes),
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expiresAt,
+		})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error inserting personal access token to the database: %s", err)
+		return
+	}
+
+	logSecurityEvent(r, "personal_token_created", "user %s created token %s with scopes %v",
+		caller.user.ID, personalToken.ID, personalToken.Scopes)
+
+	// The only time the token itself is shown; only its hash is kept.
+	resStruct := newPersonalTokenResponse(personalToken)
+	resStruct.Token = tokenValue
+
+	respondWithJSON(w, 201, resStruct)
+}
+
+func (cfg *apiConfig) handlerListPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	personalTokens, err := cfg.db.ListPersonalAccessTokens(r.Context(), caller.user.ID)
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error querying database for personal access tokens: %s", err)
+		return
+	}
+
+	resStruct := make([]personalTokenResponse, 0, len(personalTokens))
+	for _, personalToken := range personalTokens {
+		resStruct = append(resStruct, newPersonalTokenResponse(personalToken))
+	}
+
+	respondWithJSON(w, 200, resStruct)
+}
+
+func (cfg *apiConfig) handlerRevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	caller, _ := authFromRequest(r)
+
+	tokenUUID, ok := pathUUID(w, r, "tokenID", "Token")
+	if !ok {
+		return
+	}
+
+	revoked, err := cfg.db.RevokePersonalAccessToken(r.Context(),
+		database.RevokePersonalAccessTokenParams{
+			ID:        tokenUUID,
+			UserID:    caller.user.ID,
+			RevokedAt: sql.NullTime{Time: time.Now().UTC(), Valid: true},
+		})
+	if err != nil {
+		respondWithError(w, r, 500, errCodeInternal, "")
+		log.Printf("Error revoking personal access token: %s", err)
+		return
+	}
+
+	if revoked == 0 {
+		respondWithError(w, r, 404, errCodeNotFound, "Token not found")
+		return
+	}
+
+	logSecurityEvent(r, "personal_token_revoked", "user %s revoked token %s",
+		caller.user.ID, tokenUUID)
+
+	w.WriteHeader(204)
+}
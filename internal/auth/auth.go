@@ -2,8 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/alexedwards/argon2id"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
@@ -30,49 +32,163 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 	return ok, nil
 }
 
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+// The typ claim tells tokens signed with the same keys apart, so an MFA
+// challenge is never accepted as an access token or the other way around.
+const (
+	TokenTypeAccess = "access"
+	TokenTypeMFA    = "mfa"
+)
+
+// TokenError is the reason a token was rejected. Validation errors wrap one,
+// so callers can tell them apart with errors.Is or errors.As.
+type TokenError string
+
+func (e TokenError) Error() string {
+	return string(e)
+}
+
+const (
+	ErrTokenMalformed   TokenError = "Token is malformed"
+	ErrTokenSignature   TokenError = "Token signature is invalid"
+	ErrTokenExpired     TokenError = "Token has expired"
+	ErrTokenNotYetValid TokenError = "Token is not valid yet"
+	ErrTokenIssuer      TokenError = "Token was issued by someone else"
+	ErrTokenAudience    TokenError = "Token is meant for another audience"
+	ErrTokenType        TokenError = "Token has the wrong type"
+	ErrTokenUnknown     TokenError = "Token is not recognized"
+	ErrTokenRevoked     TokenError = "Token has been revoked"
+)
+
+// Claims are the claims carried by access tokens. SessionID names the
+// refresh token family the token was issued from, if any.
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenType string   `json:"typ"`
+	SessionID string   `json:"sid,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// AccessToken is what an access token asserts about its bearer. SessionID is
+// uuid.Nil for tokens issued outside of a login session.
+type AccessToken struct {
+	UserID    uuid.UUID
+	SessionID uuid.UUID
+	Roles     []string
+}
+
+func (k *Keyring) MakeJWT(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	return k.MakeAccessToken(AccessToken{UserID: userID}, expiresIn)
+}
+
+func (k *Keyring) MakeAccessToken(accessToken AccessToken, expiresIn time.Duration) (string, error) {
+	claims := k.newClaims(TokenTypeAccess, accessToken.UserID, expiresIn)
+	claims.Roles = accessToken.Roles
+	if accessToken.SessionID != uuid.Nil {
+		claims.SessionID = accessToken.SessionID.String()
+	}
+
+	return k.sign(claims)
+}
+
+// MakeMFAToken issues the challenge a user with two-factor authentication
+// gets after a correct password. It only proves the first factor.
+func (k *Keyring) MakeMFAToken(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	return k.sign(k.newClaims(TokenTypeMFA, userID, expiresIn))
+}
+
+func (k *Keyring) newClaims(tokenType string, userID uuid.UUID, expiresIn time.Duration) Claims {
 	currentTime := time.Now().UTC()
-	jwt := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy-access",
-		IssuedAt:  &jwt.NumericDate{Time: currentTime},
-		ExpiresAt: &jwt.NumericDate{Time: currentTime.Add(expiresIn)},
-		Subject:   userID.String(),
-	})
-
-	signedJWT, err := jwt.SignedString([]byte(tokenSecret))
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    k.Issuer,
+			Audience:  jwt.ClaimStrings{k.Audience},
+			IssuedAt:  &jwt.NumericDate{Time: currentTime},
+			NotBefore: &jwt.NumericDate{Time: currentTime},
+			ExpiresAt: &jwt.NumericDate{Time: currentTime.Add(expiresIn)},
+			Subject:   userID.String(),
+		},
+		TokenType: tokenType,
+	}
+}
+
+func (k *Keyring) ValidateJWT(tokenString string) (uuid.UUID, error) {
+	accessToken, err := k.ValidateAccessToken(tokenString)
+	return accessToken.UserID, err
+}
+
+func (k *Keyring) ValidateAccessToken(tokenString string) (AccessToken, error) {
+	claims, userUUID, err := k.parse(tokenString, TokenTypeAccess)
 	if err != nil {
-		return "", err
+		return AccessToken{}, err
+	}
+
+	sessionUUID := uuid.Nil
+	if claims.SessionID != "" {
+		sessionUUID, err = uuid.Parse(claims.SessionID)
+		if err != nil {
+			return AccessToken{}, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+		}
 	}
 
-	return signedJWT, nil
+	return AccessToken{UserID: userUUID, SessionID: sessionUUID, Roles: claims.Roles}, nil
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claims := &jwt.RegisteredClaims{}
+func (k *Keyring) ValidateMFAToken(tokenString string) (uuid.UUID, error) {
+	_, userUUID, err := k.parse(tokenString, TokenTypeMFA)
+	return userUUID, err
+}
+
+func (k *Keyring) parse(tokenString, tokenType string) (*Claims, uuid.UUID, error) {
+	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims,
-		func(token *jwt.Token) (any, error) {
-			return []byte(tokenSecret), nil
-		})
+	token, err := jwt.ParseWithClaims(tokenString, claims, k.keyFunc,
+		jwt.WithIssuer(k.Issuer),
+		jwt.WithAudience(k.Audience),
+		jwt.WithLeeway(k.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, uuid.Nil, classifyJWTError(err)
 	}
 
 	if !token.Valid {
-		return uuid.Nil, errors.New("Provided token is invalid")
+		return nil, uuid.Nil, ErrTokenMalformed
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, uuid.Nil, fmt.Errorf("%w: got %q, expected %q", ErrTokenType, claims.TokenType, tokenType)
 	}
 
 	userID, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return nil, uuid.Nil, err
 	}
 
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, uuid.Nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	}
+
+	return claims, userUUID, nil
+}
+
+func classifyJWTError(err error) error {
+	reason := ErrTokenMalformed
+	switch {
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		reason = ErrTokenSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		reason = ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		reason = ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		reason = ErrTokenIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		reason = ErrTokenAudience
 	}
 
-	return userUUID, nil
+	return fmt.Errorf("%w: %w", reason, err)
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -81,11 +197,22 @@ func GetBearerToken(headers http.Header) (string, error) {
 		return "", errors.New("Authorization header not found")
 	}
 
-	words := strings.Split(values[0], " ")
-	return words[1], nil
+	scheme, token, found := strings.Cut(values[0], " ")
+	token = strings.TrimSpace(token)
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errors.New("Authorization header is not a bearer token")
+	}
+
+	return token, nil
 }
 
 func MakeRefreshToken() (string, error) {
+	return MakeOpaqueToken()
+}
+
+// MakeOpaqueToken returns 256 random bits, hex encoded, for tokens that are
+// looked up rather than verified.
+func MakeOpaqueToken() (string, error) {
 	token := make([]byte, 32)
 
 	_, err := rand.Read(token)
@@ -96,27 +223,44 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// PersonalAccessTokenPrefix starts every personal access token, which tells
+// them apart from JWTs and makes leaked ones easy to scan for.
+const PersonalAccessTokenPrefix = "chirpy_pat_"
+
+func MakePersonalAccessToken() (string, error) {
+	token, err := MakeOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	return PersonalAccessTokenPrefix + token, nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// HashToken is how single-use tokens are stored, so a leaked table does not
+// hand out working tokens. They are random enough not to need a slow hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAPIKey returns the key of the first "ApiKey <key>" Authorization header.
 func GetAPIKey(headers http.Header) (string, error) {
 	values := headers.Values("Authorization")
 	if len(values) == 0 {
 		return "", errors.New("Authorization header not found")
 	}
 
-	foundAPIKey := false
-
 	for _, value := range values {
-		if !strings.Contains(value, "Api") {
-			continue
+		scheme, key, found := strings.Cut(value, " ")
+		key = strings.TrimSpace(key)
+		if found && strings.EqualFold(scheme, "ApiKey") && key != "" {
+			return key, nil
 		}
-
-		foundAPIKey = true
-		break
-	}
-
-	if !foundAPIKey {
-		return "", errors.New("API key not found")
 	}
 
-	words := strings.Split(values[0], " ")
-	return words[1], nil
+	return "", errors.New("API key not found")
 }
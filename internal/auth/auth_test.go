@@ -1,9 +1,18 @@
 package auth
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"net/http"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,26 +29,360 @@ func TestHashing(t *testing.T) {
 	}
 }
 
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+
+	keys := NewKeyring()
+	if err := keys.Add(NewHMACKey("", []byte("secret"))); err != nil {
+		t.Fatalf("Error adding key: %s", err)
+	}
+
+	return keys
+}
+
 func TestJWT(t *testing.T) {
+	keys := testKeyring(t)
 	randUUID, _ := uuid.NewRandom()
 
-	token, _ := MakeJWT(randUUID, "secret", time.Second*1)
-	returnedUUID, _ := ValidateJWT(token, "secret")
+	token, _ := keys.MakeJWT(randUUID, time.Second*1)
+	returnedUUID, _ := keys.ValidateJWT(token)
 
 	if returnedUUID != randUUID {
 		t.Errorf("UUID mismatch")
 	}
 
-	token, _ = MakeJWT(randUUID, "secret", time.Second*1)
+	token, _ = keys.MakeJWT(randUUID, time.Second*1)
 
 	time.Sleep(2 * time.Second)
 
-	returnedUUID, err := ValidateJWT(token, "secret")
+	returnedUUID, err := keys.ValidateJWT(token)
 	if err == nil {
 		t.Errorf("Expected JWT rejection due to timeout")
 	}
 }
 
+func TestAccessToken(t *testing.T) {
+	keys := testKeyring(t)
+	expected := AccessToken{UserID: uuid.New(), SessionID: uuid.New(), Roles: []string{"user", "admin"}}
+
+	token, _ := keys.MakeAccessToken(expected, time.Minute)
+	returned, err := keys.ValidateAccessToken(token)
+	if err != nil {
+		t.Fatalf("Error validating JWT: %s", err)
+	}
+
+	if returned.UserID != expected.UserID || returned.SessionID != expected.SessionID ||
+		!slices.Equal(returned.Roles, expected.Roles) {
+		t.Errorf("Claims mismatch %+v != %+v", returned, expected)
+	}
+
+	token, _ = keys.MakeJWT(expected.UserID, time.Minute)
+	if returned, _ := keys.ValidateAccessToken(token); returned.SessionID != uuid.Nil {
+		t.Errorf("Expected no session for plain access token")
+	}
+}
+
+func TestJWTClaimValidation(t *testing.T) {
+	keys := testKeyring(t)
+	userID := uuid.New()
+
+	expired, _ := keys.MakeJWT(userID, -time.Minute)
+
+	other := testKeyring(t)
+	other.Audience = "someone-else"
+	wrongAudience, _ := other.MakeJWT(userID, time.Minute)
+
+	other = testKeyring(t)
+	other.Issuer = "someone-else"
+	wrongIssuer, _ := other.MakeJWT(userID, time.Minute)
+
+	currentTime := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    keys.Issuer,
+			Audience:  jwt.ClaimStrings{keys.Audience},
+			ExpiresAt: jwt.NewNumericDate(currentTime.Add(time.Hour)),
+			Subject:   userID.String(),
+		},
+		TokenType: "refresh",
+	}
+	wrongType, _ := keys.sign(claims)
+
+	claims.TokenType = TokenTypeAccess
+	claims.NotBefore = jwt.NewNumericDate(currentTime.Add(30 * time.Second))
+	early, _ := keys.sign(claims)
+
+	forged, _ := testKeyring(t).MakeJWT(userID, time.Minute)
+	forged = forged[:len(forged)-2] + "xx"
+
+	cases := []struct {
+		name  string
+		token string
+		err   TokenError
+	}{
+		{"expired", expired, ErrTokenExpired},
+		{"wrong audience", wrongAudience, ErrTokenAudience},
+		{"wrong issuer", wrongIssuer, ErrTokenIssuer},
+		{"wrong type", wrongType, ErrTokenType},
+		{"not yet valid", early, ErrTokenNotYetValid},
+		{"bad signature", forged, ErrTokenSignature},
+		{"malformed", "not-a-token", ErrTokenMalformed},
+	}
+
+	for _, c := range cases {
+		if _, err := keys.ValidateJWT(c.token); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+	}
+
+	// Leeway absorbs clock skew between instances.
+	keys.Leeway = time.Minute
+	if _, err := keys.ValidateJWT(early); err != nil {
+		t.Errorf("Expected token within leeway to validate: %s", err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	keys := testKeyring(t)
+	userID := uuid.New()
+
+	legacy, _ := keys.MakeJWT(userID, time.Minute)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %s", err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating Ed25519 key: %s", err)
+	}
+
+	keys.Add(NewRSAKey("rsa-1", rsaKey))
+	keys.Add(NewEd25519Key("ed-1", edKey))
+
+	if err := keys.SetActive("rsa-1"); err != nil {
+		t.Fatalf("Error activating key: %s", err)
+	}
+	signedRSA, _ := keys.MakeJWT(userID, time.Minute)
+
+	if err := keys.SetActive("ed-1"); err != nil {
+		t.Fatalf("Error activating key: %s", err)
+	}
+	signedEd, _ := keys.MakeJWT(userID, time.Minute)
+
+	for _, token := range []string{legacy, signedRSA, signedEd} {
+		if returned, err := keys.ValidateJWT(token); err != nil || returned != userID {
+			t.Errorf("Expected token signed with a known key to validate: %v", err)
+		}
+	}
+
+	// Retiring a key invalidates what it signed and nothing else.
+	keys.Remove("rsa-1")
+	if _, err := keys.ValidateJWT(signedRSA); err == nil {
+		t.Errorf("Expected token signed with a removed key to be rejected")
+	}
+	if _, err := keys.ValidateJWT(signedEd); err != nil {
+		t.Errorf("Expected token signed with the active key to validate: %s", err)
+	}
+
+	jwks := keys.JWKS()
+	if len(jwks) != 1 || jwks[0].Kid != "ed-1" || jwks[0].Kty != "OKP" {
+		t.Errorf("Expected only the Ed25519 key to be published, got %+v", jwks)
+	}
+}
+
+func TestKeyringRejectsAlgorithmMismatch(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	keys := NewKeyring()
+	keys.Add(NewEd25519Key("ed-1", edKey))
+
+	// An HS256 token naming the Ed25519 key must not be checked with it.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject: uuid.NewString(),
+	})
+	forged.Header["kid"] = "ed-1"
+	token, _ := forged.SignedString([]byte(edKey.Public().(ed25519.PublicKey)))
+
+	if _, err := keys.ValidateJWT(token); err == nil {
+		t.Errorf("Expected token with mismatched algorithm to be rejected")
+	}
+}
+
+func TestKeyringActivatesFirstSigningKey(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	verifying, err := ParsePEMKey("ed-old", pem.EncodeToMemory(&pem.Block{
+		Type: "PUBLIC KEY", Bytes: publicDER,
+	}))
+	if err != nil {
+		t.Fatalf("Error parsing public key: %s", err)
+	}
+
+	// A key kept only to verify old tokens must not stop the signing key
+	// added after it from becoming active.
+	keys := NewKeyring()
+	keys.Add(verifying)
+	if keys.CanSign() {
+		t.Errorf("Expected a ring of verifying keys not to sign")
+	}
+
+	keys.Add(NewEd25519Key("ed-1", private))
+	if !keys.CanSign() {
+		t.Errorf("Expected the signing key to make the ring sign")
+	}
+
+	userID := uuid.New()
+	token, err := keys.MakeJWT(userID, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected the signing key to be active: %s", err)
+	}
+	if returned, err := keys.ValidateJWT(token); err != nil || returned != userID {
+		t.Errorf("Expected token signed with the active key to validate: %v", err)
+	}
+}
+
+func TestParsePEMKey(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(private)
+	signing, err := ParsePEMKey("ed-1", pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: privateDER,
+	}))
+	if err != nil {
+		t.Fatalf("Error parsing private key: %s", err)
+	}
+
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	verifying, err := ParsePEMKey("ed-1", pem.EncodeToMemory(&pem.Block{
+		Type: "PUBLIC KEY", Bytes: publicDER,
+	}))
+	if err != nil {
+		t.Fatalf("Error parsing public key: %s", err)
+	}
+
+	signer := NewKeyring()
+	signer.Add(signing)
+	token, _ := signer.MakeJWT(uuid.New(), time.Minute)
+
+	verifier := NewKeyring()
+	verifier.Add(verifying)
+	if _, err := verifier.ValidateJWT(token); err != nil {
+		t.Errorf("Expected public key to verify token: %s", err)
+	}
+
+	if err := verifier.SetActive("ed-1"); err == nil {
+		t.Errorf("Expected verify-only key to be refused as active key")
+	}
+}
+
+func TestMFAToken(t *testing.T) {
+	keys := NewKeyring()
+	keys.Add(NewHMACKey("", []byte("secret")))
+
+	userID := uuid.New()
+	challenge, err := keys.MakeMFAToken(userID, time.Minute)
+	if err != nil {
+		t.Fatalf("Error making MFA token: %s", err)
+	}
+
+	if got, err := keys.ValidateMFAToken(challenge); err != nil || got != userID {
+		t.Errorf("ValidateMFAToken = %s, %v, want %s", got, err, userID)
+	}
+
+	if _, err := keys.ValidateAccessToken(challenge); !errors.Is(err, ErrTokenType) {
+		t.Errorf("Expected an MFA token to be refused as an access token, got %v", err)
+	}
+
+	access, _ := keys.MakeJWT(userID, time.Minute)
+	if _, err := keys.ValidateMFAToken(access); !errors.Is(err, ErrTokenType) {
+		t.Errorf("Expected an access token to be refused as an MFA token, got %v", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B SHA1 vectors, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, want := range vectors {
+		if got := TOTPCode(secret, time.Unix(unix, 0)); got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	step, ok := ValidateTOTP(secret, TOTPCode(secret, now.Add(-TOTPPeriod)), now)
+	if !ok || step != totpStep(now)-1 {
+		t.Errorf("Expected the previous step's code to be accepted")
+	}
+
+	if _, ok := ValidateTOTP(secret, TOTPCode(secret, now.Add(-2*TOTPPeriod)), now); ok {
+		t.Errorf("Expected a code two steps old to be refused")
+	}
+
+	if _, ok := ValidateTOTP(secret, "12345", now); ok {
+		t.Errorf("Expected a short code to be refused")
+	}
+
+	uri := TOTPURI("Chirpy", "walt@example.com", secret)
+	if uri != "otpauth://totp/Chirpy:walt@example.com?algorithm=SHA1&digits=6"+
+		"&issuer=Chirpy&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Errorf("Unexpected otpauth URI %s", uri)
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	box, err := NewSecretBox(key)
+	if err != nil {
+		t.Fatalf("Error creating secret box: %s", err)
+	}
+
+	sealed, err := box.Seal([]byte("seed"), []byte("walt"))
+	if err != nil {
+		t.Fatalf("Error sealing: %s", err)
+	}
+
+	if opened, err := box.Open(sealed, []byte("walt")); err != nil || string(opened) != "seed" {
+		t.Errorf("Open = %q, %v, want seed", opened, err)
+	}
+
+	if _, err := box.Open(sealed, []byte("jesse")); err == nil {
+		t.Errorf("Expected a ciphertext bound to another owner to be refused")
+	}
+
+	if _, err := NewSecretBox([]byte("short")); err == nil {
+		t.Errorf("Expected a short key to be refused")
+	}
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	first, _ := MakePersonalAccessToken()
+	second, _ := MakePersonalAccessToken()
+
+	if first == second || !IsPersonalAccessToken(first) {
+		t.Errorf("Expected distinct personal access tokens, got %q and %q", first, second)
+	}
+
+	keys := NewKeyring()
+	keys.Add(NewHMACKey("", []byte("secret")))
+
+	jwt, _ := keys.MakeJWT(uuid.New(), time.Minute)
+	if IsPersonalAccessToken(jwt) {
+		t.Errorf("Expected a JWT not to look like a personal access token")
+	}
+}
+
 func TestGetBearerToken(t *testing.T) {
 	header := http.Header{}
 	expected := "token"
@@ -54,6 +397,13 @@ func TestGetBearerToken(t *testing.T) {
 	if _, err := GetBearerToken(header); err == nil {
 		t.Errorf("Expected error due to absence of the token")
 	}
+
+	for _, value := range []string{"Bearer", "Bearer ", "Basic dXNlcjpwYXNz", "token"} {
+		header = http.Header{"Authorization": {value}}
+		if _, err := GetBearerToken(header); err == nil {
+			t.Errorf("Expected error for Authorization header %q", value)
+		}
+	}
 }
 
 func TestGetAPIKey(t *testing.T) {
@@ -62,12 +412,63 @@ func TestGetAPIKey(t *testing.T) {
 
 	header.Add("Authorization", fmt.Sprintf("ApiKey %s", expected))
 
-	if value, _ := GetBearerToken(header); value != expected {
+	if value, _ := GetAPIKey(header); value != expected {
 		t.Errorf("API key mismatch %s != %s", value, expected)
 	}
 
 	header = http.Header{}
-	if _, err := GetBearerToken(header); err == nil {
+	if _, err := GetAPIKey(header); err == nil {
 		t.Errorf("Expected error due to absence of the API key")
 	}
+
+	header = http.Header{"Authorization": {"Bearer token", "ApiKey " + expected}}
+	if value, _ := GetAPIKey(header); value != expected {
+		t.Errorf("API key mismatch %s != %s", value, expected)
+	}
+
+	for _, value := range []string{"ApiKey", "ApiKey ", "Bearer key", "MyApiKey key", "key"} {
+		header = http.Header{"Authorization": {value}}
+		if _, err := GetAPIKey(header); err == nil {
+			t.Errorf("Expected error for Authorization header %q", value)
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"event":"user.upgraded"}`)
+	now := time.Now()
+	tolerance := 5 * time.Minute
+
+	signature := SignWebhook(secret, now, body)
+	if err := VerifyWebhookSignature(secret, signature, body, now.Add(time.Minute), tolerance); err != nil {
+		t.Errorf("Error verifying signature: %s", err)
+	}
+
+	// Signed with the old and the new secret during a rotation.
+	rotated := SignWebhook([]byte("old"), now, body) + "," + signature[strings.Index(signature, "v1="):]
+	if err := VerifyWebhookSignature(secret, rotated, body, now, tolerance); err != nil {
+		t.Errorf("Error verifying signature among several: %s", err)
+	}
+
+	tests := map[string]struct {
+		header string
+		body   []byte
+		now    time.Time
+	}{
+		"tampered body":   {signature, []byte(`{"event":"user.downgraded"}`), now},
+		"wrong secret":    {SignWebhook([]byte("other"), now, body), body, now},
+		"replayed":        {signature, body, now.Add(tolerance + time.Second)},
+		"from the future": {signature, body, now.Add(-tolerance - time.Second)},
+		"no timestamp":    {signature[strings.Index(signature, ",")+1:], body, now},
+		"no signature":    {fmt.Sprintf("t=%d", now.Unix()), body, now},
+		"malformed":       {"t=soon,v1=abc", body, now},
+		"empty":           {"", body, now},
+	}
+
+	for name, test := range tests {
+		if err := VerifyWebhookSignature(secret, test.header, test.body, test.now, tolerance); err == nil {
+			t.Errorf("%s: expected signature to be rejected", name)
+		}
+	}
 }
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIssuer   = "chirpy-access"
+	DefaultAudience = "chirpy-api"
+)
+
+// SigningKey is a JWT key identified by the kid header of the tokens it
+// signs. Keys without a private half only verify tokens, which is how a
+// retired key is kept around until the tokens it signed have expired.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+func NewHMACKey(id string, secret []byte) SigningKey {
+	return SigningKey{ID: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+func NewRSAKey(id string, key *rsa.PrivateKey) SigningKey {
+	return SigningKey{ID: id, Method: jwt.SigningMethodRS256, signKey: key, verifyKey: &key.PublicKey}
+}
+
+func NewEd25519Key(id string, key ed25519.PrivateKey) SigningKey {
+	return SigningKey{
+		ID: id, Method: jwt.SigningMethodEdDSA, signKey: key, verifyKey: key.Public(),
+	}
+}
+
+// ParsePEMKey reads an RSA or Ed25519 key from PEM. Private keys may be PKCS#1
+// or PKCS#8, public keys PKIX.
+func ParsePEMKey(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("No PEM block found")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("Unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return NewRSAKey(id, key), nil
+	case ed25519.PrivateKey:
+		return NewEd25519Key(id, key), nil
+	case *rsa.PublicKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodRS256, verifyKey: key}, nil
+	case ed25519.PublicKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, verifyKey: key}, nil
+	}
+
+	return SigningKey{}, fmt.Errorf("Unsupported key type %T", key)
+}
+
+// Keyring holds every key tokens are accepted from and the one new tokens are
+// signed with. A planned rotation adds the new key, makes it active once all
+// instances have it, and removes the old key after the last token it signed
+// has expired.
+//
+// Issuer and Audience are stamped on every token and required when
+// validating; Leeway is the clock skew tolerated on exp, nbf and iat. They
+// must be set before the keyring is used.
+type Keyring struct {
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+
+	mu     sync.RWMutex
+	keys   map[string]SigningKey
+	active string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		Issuer:   DefaultIssuer,
+		Audience: DefaultAudience,
+		keys:     map[string]SigningKey{},
+	}
+}
+
+// Add adds a key to the ring. The first signing key added becomes active.
+func (k *Keyring) Add(key SigningKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[key.ID]; ok {
+		return fmt.Errorf("Duplicate key ID %q", key.ID)
+	}
+
+	k.keys[key.ID] = key
+	if key.signKey != nil && k.active == "" {
+		k.active = key.ID
+	}
+
+	return nil
+}
+
+func (k *Keyring) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, id)
+	if k.active == id {
+		k.active = ""
+	}
+}
+
+func (k *Keyring) SetActive(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("Unknown key ID %q", id)
+	}
+
+	if key.signKey == nil {
+		return fmt.Errorf("Key %q has no private key", id)
+	}
+
+	k.active = id
+	return nil
+}
+
+// CanSign reports whether the ring has an active key to sign tokens with.
+func (k *Keyring) CanSign() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[k.active]
+	return ok && key.signKey != nil
+}
+
+// LoadDir adds every <kid>.pem file in dir to the ring.
+func (k *Keyring) LoadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := ParsePEMKey(id, data)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s: %w", path, err)
+		}
+
+		if err := k.Add(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (k *Keyring) sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key, ok := k.keys[k.active]
+	k.mu.RUnlock()
+
+	if !ok || key.signKey == nil {
+		return "", errors.New("No active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+
+	return token.SignedString(key.signKey)
+}
+
+// keyFunc picks the verification key by kid. Tokens without one are checked
+// against the key with an empty ID, which is what JWTSECRET is loaded as.
+func (k *Keyring) keyFunc(token *jwt.Token) (any, error) {
+	id, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown key ID %q", id)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("Key %q does not sign with %s", id, token.Method.Alg())
+	}
+
+	return key.verifyKey, nil
+}
+
+// JWK is the public half of a signing key as published in a JWK set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys in the ring, sorted by ID. Symmetric keys are
+// never published.
+func (k *Keyring) JWKS() []JWK {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	encode := base64.RawURLEncoding.EncodeToString
+
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		jwk := JWK{Kid: key.ID, Alg: key.Method.Alg(), Use: "sig"}
+
+		switch verifyKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encode(verifyKey.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(verifyKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = encode(verifyKey)
+		default:
+			continue
+		}
+
+		jwks = append(jwks, jwk)
+	}
+
+	slices.SortFunc(jwks, func(a, b JWK) int {
+		return strings.Compare(a.Kid, b.Kid)
+	})
+
+	return jwks
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook signatures are HMAC-SHA256 over "<unix timestamp>.<body>", sent as
+// "t=<unix timestamp>,v1=<hex signature>". The timestamp is signed so an old
+// delivery cannot be replayed once it falls outside the tolerance. Several
+// v1 entries may be given while the secret is being rotated.
+
+func SignWebhook(secret []byte, timestamp time.Time, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), webhookMAC(secret, timestamp.Unix(), body))
+}
+
+// VerifyWebhookSignature checks header, as made by SignWebhook, against body.
+// Signatures made more than tolerance before or after now are rejected.
+func VerifyWebhookSignature(secret []byte, header string, body []byte, now time.Time,
+	tolerance time.Duration,
+) error {
+	timestamp := int64(0)
+	signatures := []string{}
+
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+		switch key {
+		case "t":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New("Malformed webhook signature timestamp")
+			}
+
+			timestamp = parsed
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	if timestamp == 0 || len(signatures) == 0 {
+		return errors.New("Webhook signature not found")
+	}
+
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > tolerance || skew < -tolerance {
+		return errors.New("Webhook signature timestamp is outside the tolerance")
+	}
+
+	expected := webhookMAC(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+
+	return errors.New("Webhook signature mismatch")
+}
+
+func webhookMAC(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,50 @@
+// Package chirplen measures chirps the way people count characters: in
+// grapheme clusters of the NFC-normalized text, with every URL weighted to
+// URLLength however long it actually is.
+package chirplen
+
+import (
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+)
+
+// URLLength is what each URL counts for, so links don't eat into the limit
+// and shortening them gains nothing.
+const URLLength = 23
+
+// MaxURLBytes is the longest URL that is weighted to URLLength. Longer
+// matches are not plausible links and count character by character.
+const MaxURLBytes = 2048
+
+// urlPattern matches http(s) URLs up to the next space, leaving off
+// punctuation that more likely ends the sentence than the URL.
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s]*[^\s.,;:!?'")\]]`)
+
+// Normalize returns body in NFC, the form chirps are measured and stored in.
+func Normalize(body string) string {
+	return norm.NFC.String(body)
+}
+
+// Length returns the length of body in characters.
+func Length(body string) int {
+	body = Normalize(body)
+
+	length := 0
+	last := 0
+	for _, loc := range urlPattern.FindAllStringIndex(body, -1) {
+		if loc[1]-loc[0] > MaxURLBytes {
+			continue
+		}
+
+		length += Graphemes(body[last:loc[0]]) + URLLength
+		last = loc[1]
+	}
+
+	return length + Graphemes(body[last:])
+}
+
+// Graphemes counts the extended grapheme clusters in s.
+func Graphemes(s string) int {
+	return uniseg.GraphemeClusterCount(s)
+}
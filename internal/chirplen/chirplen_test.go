@@ -0,0 +1,55 @@
+package chirplen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphemes(t *testing.T) {
+	tests := map[string]int{
+		"":            0,
+		"hello":       5,
+		"Привет, мир": 11,
+		"e\u0301":     1,
+		"a\r\nb":      3,
+		"👍":           1,
+		"👍🏽":          1,
+		"👩‍👩‍👧‍👦":     1,
+		"❤️":          1,
+		"🇺🇦🇫🇷":        2,
+		"🇺🇦🇫":         2,
+		"🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F": 1,
+		"한":                1,
+		"한국어":                3,
+		"\u1100\u1161\u11A8": 1,
+	}
+
+	for s, expected := range tests {
+		if got := Graphemes(s); got != expected {
+			t.Errorf("Graphemes(%q) = %d, expected %d", s, got, expected)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := map[string]int{
+		strings.Repeat("😀", 50): 50,
+		"cafe\u0301":            4,
+		"see https://example.com/a/very/long/path?with=query": 4 + URLLength,
+		"http://a.io, then https://b.io.":                     URLLength + 7 + URLLength + 1,
+		"no links here, just http:// alone":                   33,
+		"https://" + strings.Repeat("x", MaxURLBytes):         MaxURLBytes + 8,
+	}
+
+	for body, expected := range tests {
+		if got := Length(body); got != expected {
+			t.Errorf("Length(%q) = %d, expected %d", body, got, expected)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if got := Normalize("cafe\u0301"); got != "caf\u00e9" {
+		t.Errorf("Normalize did not compose: %q", got)
+	}
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var ErrInvalidAddress = errors.New("Invalid email address")
+
+// NormalizeAddress checks that address is a bare addr-spec such as
+// walt@example.com and returns it with surrounding space trimmed and the
+// domain lowercased. Only the domain is case-insensitive; RFC 5321 leaves the
+// local part to the receiving server, so it is kept as typed. Display names,
+// quoted local parts, domain literals and dotless domains are rejected since
+// they are not addresses people sign up with.
+func NormalizeAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+
+	// RFC 5321 limits a forward path to 256 octets including the angle brackets.
+	if len(address) > 254 {
+		return "", ErrInvalidAddress
+	}
+
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Name != "" || parsed.Address != address {
+		return "", ErrInvalidAddress
+	}
+
+	at := strings.LastIndex(address, "@")
+	local, domain := address[:at], address[at+1:]
+
+	if len(local) > 64 || strings.HasPrefix(domain, "[") ||
+		!strings.Contains(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrInvalidAddress
+	}
+
+	return local + "@" + strings.ToLower(domain), nil
+}
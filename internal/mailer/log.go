@@ -0,0 +1,17 @@
+package mailer
+
+import (
+	"context"
+	"log"
+)
+
+// Log writes messages to the standard logger instead of sending them, so a
+// development server without SMTP still shows reset and verification links.
+type Log struct{}
+
+var _ Mailer = Log{}
+
+func (Log) Send(ctx context.Context, msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	outbox := NewOutbox()
+
+	outbox.Send(context.Background(), Message{To: "a@example.com", Subject: "first"})
+	outbox.Send(context.Background(), Message{To: "b@example.com", Subject: "other"})
+	outbox.Send(context.Background(), Message{To: "a@example.com", Subject: "second"})
+
+	if msg, ok := outbox.Last("a@example.com"); !ok || msg.Subject != "second" {
+		t.Errorf("Expected the latest message, got %+v", msg)
+	}
+
+	if _, ok := outbox.Last("c@example.com"); ok {
+		t.Errorf("Expected no message for unknown address")
+	}
+
+	if len(outbox.Messages()) != 3 {
+		t.Errorf("Expected 3 messages, got %d", len(outbox.Messages()))
+	}
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir := t.TempDir()
+
+	outbox, err := NewFileOutbox(dir, "chirpy@example.com")
+	if err != nil {
+		t.Fatalf("Error creating outbox: %s", err)
+	}
+
+	err = outbox.Send(context.Background(), Message{
+		To: "a@example.com", Subject: "Hello\r\nBcc: victim@example.com", Body: "line one\nline two",
+	})
+	if err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(paths) != 1 {
+		t.Fatalf("Expected one message file, got %d", len(paths))
+	}
+
+	data, _ := os.ReadFile(paths[0])
+	if !bytes.Contains(data, []byte("Subject: HelloBcc: victim@example.com\r\n")) {
+		t.Errorf("Expected line breaks to be stripped from headers, got %q", data)
+	}
+
+	if !bytes.HasSuffix(data, []byte("\r\n\r\nline one\r\nline two")) {
+		t.Errorf("Expected CRLF body, got %q", data)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := format("from@example.com", Message{To: "to@example.com", Subject: "Hi"}, date)
+
+	for _, header := range []string{
+		"From: from@example.com\r\n", "To: to@example.com\r\n", "Subject: Hi\r\n",
+		"Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+	} {
+		if !bytes.Contains(data, []byte(header)) {
+			t.Errorf("Expected header %q in %q", header, data)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	valid := map[string]string{
+		"walt@example.com":            "walt@example.com",
+		"  Walt.White@Example.COM ":   "Walt.White@example.com",
+		"walt+chirpy@mail.example.io": "walt+chirpy@mail.example.io",
+	}
+
+	for input, want := range valid {
+		got, err := NormalizeAddress(input)
+		if err != nil || got != want {
+			t.Errorf("NormalizeAddress(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"walt",
+		"walt@",
+		"@example.com",
+		"walt@localhost",
+		"walt@example.com.",
+		"walt@[127.0.0.1]",
+		"Walt <walt@example.com>",
+		"<walt@example.com>",
+		"walt@example.com, jesse@example.com",
+		"walt@@example.com",
+	}
+
+	for _, input := range invalid {
+		if got, err := NormalizeAddress(input); err == nil {
+			t.Errorf("NormalizeAddress(%q) = %q, expected an error", input, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outbox keeps sent messages instead of delivering them, for development and
+// tests. With a directory it also writes each message there as an .eml file.
+type Outbox struct {
+	mu       sync.Mutex
+	dir      string
+	from     string
+	messages []Message
+}
+
+var _ Mailer = (*Outbox)(nil)
+
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+func NewFileOutbox(dir, from string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Outbox{dir: dir, from: from}, nil
+}
+
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.messages = append(o.messages, msg)
+
+	if o.dir == "" {
+		return nil
+	}
+
+	currentTime := time.Now()
+	name := fmt.Sprintf("%s-%03d.eml", currentTime.Format("20060102T150405.000000000"), len(o.messages))
+
+	return os.WriteFile(filepath.Join(o.dir, name), format(o.from, msg, currentTime), 0o644)
+}
+
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]Message{}, o.messages...)
+}
+
+// Last returns the most recent message sent to the given address.
+func (o *Outbox) Last(to string) (Message, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := len(o.messages) - 1; i >= 0; i-- {
+		if o.messages[i].To == to {
+			return o.messages[i], true
+		}
+	}
+
+	return Message{}, false
+}
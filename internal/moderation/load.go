@@ -0,0 +1,70 @@
+package moderation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LoadRules reads a rules file. Each non-empty line that does not start with
+// "#" holds a word or a /regex/ followed by an optional action, which
+// defaults to mask:
+//
+//	kerfuffle
+//	fornax reject
+//	/(?i)buy\s+followers/ flag
+func LoadRules(r io.Reader, source string) ([]Rule, error) {
+	words := map[string]Action{}
+	regexRules := []Rule{}
+	scanner := bufio.NewScanner(r)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern, action := line, ActionMask
+		if i := strings.LastIndexAny(line, " \t"); i >= 0 {
+			if parsed, ok := ParseAction(line[i+1:]); ok {
+				pattern, action = strings.TrimSpace(line[:i]), parsed
+			}
+		}
+
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			name := fmt.Sprintf("%s:%d", source, lineNumber)
+
+			rule, err := NewRegexRule(name, action, pattern[1:len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", source, lineNumber, err)
+			}
+
+			regexRules = append(regexRules, rule)
+			continue
+		}
+
+		if tokens := Tokenize(pattern); len(tokens) != 1 || tokens[0].Normalized != Normalize(pattern) {
+			return nil, fmt.Errorf("%s line %d: %q is not a single word", source, lineNumber, pattern)
+		}
+
+		words[Normalize(pattern)] = action
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return append(WordRules(source, words), regexRules...), nil
+}
+
+func LoadRulesFile(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadRules(file, path)
+}
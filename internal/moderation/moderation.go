@@ -0,0 +1,137 @@
+package moderation
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Action string
+
+const (
+	ActionMask   Action = "mask"
+	ActionReject Action = "reject"
+	ActionFlag   Action = "flag"
+)
+
+const maskReplacement = "****"
+
+func ParseAction(s string) (Action, bool) {
+	switch action := Action(strings.ToLower(s)); action {
+	case ActionMask, ActionReject, ActionFlag:
+		return action, true
+	}
+
+	return "", false
+}
+
+// Match is a span of the moderated text, in byte offsets, that a rule hit.
+type Match struct {
+	Start  int
+	End    int
+	Rule   string
+	Action Action
+}
+
+type Rule interface {
+	Name() string
+	Action() Action
+	Match(text string, tokens []Token) []Match
+}
+
+type Result struct {
+	// Text is the input with every masked span replaced.
+	Text     string
+	Rejected bool
+	// Flags lists the names of the flagging rules that matched.
+	Flags   []string
+	Matches []Match
+}
+
+// Pipeline runs a chain of rules over a text. The chain can be swapped at
+// runtime while other goroutines are moderating.
+type Pipeline struct {
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+func NewPipeline(rules ...Rule) *Pipeline {
+	return &Pipeline{rules: rules}
+}
+
+func (p *Pipeline) SetRules(rules ...Rule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rules = rules
+}
+
+func (p *Pipeline) Rules() []Rule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]Rule{}, p.rules...)
+}
+
+func (p *Pipeline) Moderate(text string) Result {
+	tokens := Tokenize(text)
+	result := Result{Text: text}
+	masks := []Match{}
+
+	for _, rule := range p.Rules() {
+		matches := rule.Match(text, tokens)
+		if len(matches) == 0 {
+			continue
+		}
+
+		result.Matches = append(result.Matches, matches...)
+
+		switch rule.Action() {
+		case ActionReject:
+			result.Rejected = true
+		case ActionFlag:
+			result.Flags = append(result.Flags, rule.Name())
+		case ActionMask:
+			masks = append(masks, matches...)
+		}
+	}
+
+	result.Text = mask(text, masks)
+
+	return result
+}
+
+// mask replaces every matched span with a fixed replacement, merging
+// overlapping spans so each stretch of text is masked once.
+func mask(text string, matches []Match) string {
+	if len(matches) == 0 {
+		return text
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+
+	var builder strings.Builder
+	position := 0
+
+	for _, match := range matches {
+		if match.End <= position {
+			continue
+		}
+
+		// Overlaps the previous mask, so extend it instead of starting another.
+		if match.Start < position {
+			position = match.End
+			continue
+		}
+
+		builder.WriteString(text[position:match.Start])
+		builder.WriteString(maskReplacement)
+		position = match.End
+	}
+
+	builder.WriteString(text[position:])
+
+	return builder.String()
+}
@@ -0,0 +1,115 @@
+package moderation
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := map[string][]string{
+		"hello world":        {"hello", "world"},
+		"What a kerfuffle!":  {"what", "a", "kerfuffle"},
+		"don't\tstop now":    {"don't", "stop", "now"},
+		"Привет, МИР... 123": {"привет", "мир", "123"},
+		"  --  ":             {},
+		"café naïve étude":  {"café", "naïve", "étude"},
+	}
+
+	for text, expected := range tests {
+		words := []string{}
+		for _, token := range Tokenize(text) {
+			words = append(words, token.Normalized)
+		}
+
+		if !slices.Equal(words, expected) {
+			t.Errorf("Tokenize(%q) = %q, expected %q", text, words, expected)
+		}
+	}
+}
+
+func TestPipelineMask(t *testing.T) {
+	pipeline := NewPipeline(NewWordListRule("words", ActionMask,
+		[]string{"kerfuffle", "sharbert", "ФОРНАКС"}))
+
+	tests := map[string]string{
+		"What a kerfuffle!":             "What a ****!",
+		"Kerfuffle, sharbert.":          "****, ****.",
+		"форнакс и kerfuffles":          "**** и kerfuffles",
+		"nothing to see here":           "nothing to see here",
+		"(sharbert)(kerfuffle)":         "(****)(****)",
+		"kerfuffle\nsharbert kerfuffle": "****\n**** ****",
+	}
+
+	for text, expected := range tests {
+		if result := pipeline.Moderate(text); result.Text != expected {
+			t.Errorf("Moderate(%q) = %q, expected %q", text, result.Text, expected)
+		}
+	}
+}
+
+func TestPipelineActions(t *testing.T) {
+	spam, err := NewRegexRule("spam", ActionFlag, `(?i)buy\s+followers`)
+	if err != nil {
+		t.Fatalf("Error compiling regex rule: %s", err)
+	}
+
+	pipeline := NewPipeline(
+		NewWordListRule("masked", ActionMask, []string{"fornax"}),
+		NewWordListRule("banned", ActionReject, []string{"slur"}),
+		spam,
+	)
+
+	result := pipeline.Moderate("Buy  followers now, fornax")
+	if result.Rejected || !slices.Equal(result.Flags, []string{"spam"}) {
+		t.Errorf("Expected only the spam flag, got %+v", result)
+	}
+
+	if result.Text != "Buy  followers now, ****" {
+		t.Errorf("Flagged text should only be masked by mask rules, got %q", result.Text)
+	}
+
+	if result := pipeline.Moderate("what a SLUR"); !result.Rejected {
+		t.Errorf("Expected rejection, got %+v", result)
+	}
+
+	pipeline.SetRules()
+	if result := pipeline.Moderate("what a slur, fornax"); result.Rejected ||
+		result.Text != "what a slur, fornax" {
+		t.Errorf("Expected empty rule chain to pass text through, got %+v", result)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules(strings.NewReader(`
+# default words
+kerfuffle
+Fornax reject
+/\d{3}-\d{4}/ flag
+/bad word/
+`), "rules.txt")
+	if err != nil {
+		t.Fatalf("Error loading rules: %s", err)
+	}
+
+	result := NewPipeline(rules...).Moderate("kerfuffle, call 555-1234 about a bad word")
+	if result.Text != "****, call 555-1234 about a ****" {
+		t.Errorf("Unexpected masked text %q", result.Text)
+	}
+
+	if !slices.Equal(result.Flags, []string{"rules.txt:5"}) {
+		t.Errorf("Unexpected flags %q", result.Flags)
+	}
+
+	if result := NewPipeline(rules...).Moderate("FORNAX"); !result.Rejected {
+		t.Errorf("Expected rejection for fornax")
+	}
+
+	if _, err := LoadRules(strings.NewReader("two words"), "rules.txt"); err == nil {
+		t.Errorf("Expected error for multi-word entry")
+	}
+
+	if _, err := LoadRules(strings.NewReader("/(/"), "rules.txt"); err == nil {
+		t.Errorf("Expected error for invalid regex")
+	}
+}
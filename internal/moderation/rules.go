@@ -0,0 +1,100 @@
+package moderation
+
+import (
+	"regexp"
+	"strings"
+)
+
+// WordListRule matches whole words from a fixed list, case-insensitively.
+type WordListRule struct {
+	name   string
+	action Action
+	words  map[string]struct{}
+}
+
+func NewWordListRule(name string, action Action, words []string) *WordListRule {
+	rule := &WordListRule{
+		name:   name,
+		action: action,
+		words:  map[string]struct{}{},
+	}
+
+	for _, word := range words {
+		rule.words[Normalize(strings.TrimSpace(word))] = struct{}{}
+	}
+
+	return rule
+}
+
+func (rule *WordListRule) Name() string {
+	return rule.name
+}
+
+func (rule *WordListRule) Action() Action {
+	return rule.action
+}
+
+func (rule *WordListRule) Match(text string, tokens []Token) []Match {
+	matches := []Match{}
+
+	for _, token := range tokens {
+		if _, ok := rule.words[token.Normalized]; ok {
+			matches = append(matches, Match{token.Start, token.End, rule.name, rule.action})
+		}
+	}
+
+	return matches
+}
+
+type RegexRule struct {
+	name   string
+	action Action
+	re     *regexp.Regexp
+}
+
+func NewRegexRule(name string, action Action, pattern string) (*RegexRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegexRule{name: name, action: action, re: re}, nil
+}
+
+func (rule *RegexRule) Name() string {
+	return rule.name
+}
+
+func (rule *RegexRule) Action() Action {
+	return rule.action
+}
+
+func (rule *RegexRule) Match(text string, tokens []Token) []Match {
+	matches := []Match{}
+
+	for _, span := range rule.re.FindAllStringIndex(text, -1) {
+		matches = append(matches, Match{span[0], span[1], rule.name, rule.action})
+	}
+
+	return matches
+}
+
+// WordRules groups words by action into one word list rule per action, in
+// mask, flag, reject order.
+func WordRules(source string, words map[string]Action) []Rule {
+	grouped := map[Action][]string{}
+	for word, action := range words {
+		grouped[action] = append(grouped[action], word)
+	}
+
+	rules := []Rule{}
+	for _, action := range []Action{ActionMask, ActionFlag, ActionReject} {
+		if len(grouped[action]) == 0 {
+			continue
+		}
+
+		rules = append(rules, NewWordListRule(source+":"+string(action), action, grouped[action]))
+	}
+
+	return rules
+}
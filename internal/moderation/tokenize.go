@@ -0,0 +1,67 @@
+package moderation
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token is a word in the moderated text. Start and End are byte offsets and
+// Normalized is the lowercased word used for comparisons.
+type Token struct {
+	Start      int
+	End        int
+	Normalized string
+}
+
+// Tokenize splits text into words made of letters, digits and combining
+// marks, so punctuation and any kind of Unicode whitespace act as separators.
+// Apostrophes between letters, as in "don't", stay part of the word.
+func Tokenize(text string) []Token {
+	tokens := []Token{}
+	start := -1
+
+	for i, r := range text {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+
+			continue
+		}
+
+		if start >= 0 && isApostrophe(r) && i+utf8.RuneLen(r) < len(text) {
+			next, _ := utf8.DecodeRuneInString(text[i+utf8.RuneLen(r):])
+			if isWordRune(next) {
+				continue
+			}
+		}
+
+		if start >= 0 {
+			tokens = append(tokens, newToken(text, start, i))
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, newToken(text, start, len(text)))
+	}
+
+	return tokens
+}
+
+func Normalize(word string) string {
+	return strings.ToLower(word)
+}
+
+func newToken(text string, start, end int) Token {
+	return Token{Start: start, End: end, Normalized: Normalize(text[start:end])}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
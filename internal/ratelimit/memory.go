@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// Memory keeps buckets in process. Limits only hold per instance, which is
+// fine for a single server and for tests.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]memoryBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	fullAt time.Time
+}
+
+var _ Limiter = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]memoryBucket{}, now: time.Now}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, policy Policy) (Decision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	key = policy.Name + ":" + key
+	b, decision := take(m.buckets[key].bucket, policy, now)
+	m.buckets[key] = memoryBucket{bucket: b, fullAt: now.Add(decision.Reset)}
+
+	return decision, nil
+}
+
+// sweep forgets full buckets, which behave the same as missing ones.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+
+	for key, b := range m.buckets {
+		if !b.fullAt.After(now) {
+			delete(m.buckets, key)
+		}
+	}
+
+	m.lastSweep = now
+}
@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"log"
+	"sync"
+	"time"
+)
+
+// Postgres keeps buckets in the rate_limit_buckets table so every instance
+// sharing the database enforces the same limits. Each request locks its
+// bucket row for the length of a short transaction.
+type Postgres struct {
+	db      *sql.DB
+	queries *database.Queries
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+var _ Limiter = (*Postgres)(nil)
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db, queries: database.New(db)}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, policy Policy) (Decision, error) {
+	now := time.Now().UTC()
+	key = policy.Name + ":" + key
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer tx.Rollback()
+
+	queries := p.queries.WithTx(tx)
+
+	err = queries.CreateRateLimitBucket(ctx, database.CreateRateLimitBucketParams{
+		Key:       key,
+		Tokens:    float64(policy.Limit),
+		UpdatedAt: now,
+		FullAt:    now,
+	})
+	if err != nil {
+		return Decision{}, err
+	}
+
+	row, err := queries.GetRateLimitBucketForUpdate(ctx, key)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	b, decision := take(bucket{tokens: row.Tokens, updatedAt: row.UpdatedAt}, policy, now)
+
+	err = queries.UpdateRateLimitBucket(ctx, database.UpdateRateLimitBucketParams{
+		Key:       key,
+		Tokens:    b.tokens,
+		UpdatedAt: b.updatedAt,
+		FullAt:    now.Add(decision.Reset),
+	})
+	if err != nil {
+		return Decision{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Decision{}, err
+	}
+
+	p.sweep(ctx, now)
+
+	return decision, nil
+}
+
+// sweep deletes full buckets now and then, which behave the same as missing
+// ones.
+func (p *Postgres) sweep(ctx context.Context, now time.Time) {
+	p.mu.Lock()
+	if now.Sub(p.lastSweep) < sweepInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastSweep = now
+	p.mu.Unlock()
+
+	err := p.queries.DeleteFullRateLimitBuckets(ctx, now)
+	if err != nil {
+		log.Printf("Error deleting full rate limit buckets: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Policy is a token bucket holding up to Limit requests that refills
+// completely over Window, so a client can burst Limit requests and then
+// sustain Limit per Window. Name keeps the buckets of different policies
+// apart.
+type Policy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// String is the policy in RateLimit-Policy header form, e.g. 10;w=60.
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Limit, int(p.Window.Seconds()))
+}
+
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Window.Seconds()
+}
+
+// Decision is the outcome of one request against a bucket. Reset is how long
+// until the bucket is full again, RetryAfter how long until the next request
+// is allowed when this one was not.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter takes a token for key from the bucket policy describes.
+type Limiter interface {
+	Allow(ctx context.Context, key string, policy Policy) (Decision, error)
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take refills b for the time since it was last used, then takes a token from
+// it if a whole one is available. A zero bucket is a full one.
+func take(b bucket, policy Policy, now time.Time) (bucket, Decision) {
+	limit := float64(policy.Limit)
+	rate := policy.rate()
+
+	tokens := limit
+	if !b.updatedAt.IsZero() {
+		elapsed := max(now.Sub(b.updatedAt).Seconds(), 0)
+		tokens = min(limit, b.tokens+elapsed*rate)
+	}
+
+	decision := Decision{Limit: policy.Limit}
+	if tokens >= 1 {
+		tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = seconds((1 - tokens) / rate)
+	}
+
+	decision.Remaining = int(math.Floor(tokens))
+	decision.Reset = seconds((limit - tokens) / rate)
+
+	return bucket{tokens: tokens, updatedAt: now}, decision
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
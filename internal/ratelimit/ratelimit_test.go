@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	policy := Policy{Name: "test", Limit: 3, Window: 30 * time.Second}
+	now := time.Unix(1_000_000, 0)
+
+	b := bucket{}
+	for i := range 3 {
+		var decision Decision
+		b, decision = take(b, policy, now)
+		if !decision.Allowed || decision.Remaining != 2-i {
+			t.Fatalf("Request %d: unexpected decision %+v", i, decision)
+		}
+	}
+
+	b, decision := take(b, policy, now)
+	if decision.Allowed || decision.RetryAfter != 10*time.Second || decision.Reset != 30*time.Second {
+		t.Fatalf("Expected the fourth request to wait 10s, got %+v", decision)
+	}
+
+	// A token comes back every Window / Limit.
+	b, decision = take(b, policy, now.Add(10*time.Second))
+	if !decision.Allowed || decision.Remaining != 0 {
+		t.Fatalf("Expected a refilled token, got %+v", decision)
+	}
+
+	_, decision = take(b, policy, now.Add(time.Hour))
+	if !decision.Allowed || decision.Remaining != 2 || decision.Reset != 10*time.Second {
+		t.Fatalf("Expected a full bucket after an hour, got %+v", decision)
+	}
+
+	if policy.String() != "3;w=30" {
+		t.Errorf("Unexpected policy header %q", policy.String())
+	}
+}
+
+func TestMemory(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	login := Policy{Name: "login", Limit: 1, Window: time.Minute}
+	signup := Policy{Name: "signup", Limit: 1, Window: time.Minute}
+
+	if d, _ := m.Allow(context.Background(), "ip:10.0.0.1", login); !d.Allowed {
+		t.Errorf("Expected the first login to be allowed")
+	}
+
+	if d, _ := m.Allow(context.Background(), "ip:10.0.0.1", login); d.Allowed {
+		t.Errorf("Expected the second login to be limited")
+	}
+
+	if d, _ := m.Allow(context.Background(), "ip:10.0.0.2", login); !d.Allowed {
+		t.Errorf("Expected another client to have its own bucket")
+	}
+
+	if d, _ := m.Allow(context.Background(), "ip:10.0.0.1", signup); !d.Allowed {
+		t.Errorf("Expected another policy to have its own bucket")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if d, _ := m.Allow(context.Background(), "ip:10.0.0.3", login); !d.Allowed {
+		t.Errorf("Expected a new client to be allowed")
+	}
+
+	if len(m.buckets) != 1 {
+		t.Errorf("Expected full buckets to be swept, %d left", len(m.buckets))
+	}
+}
@@ -0,0 +1,1631 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrDuplicateKey = errors.New("Duplicate key value violates unique constraint")
+
+// Memory is a concurrency-safe in-memory Store. It follows the semantics of
+// the Postgres queries: lookups of missing rows return sql.ErrNoRows, exec
+// queries affecting no rows succeed, and deleting a user cascades to their
+// chirps and refresh tokens. A new Memory holds the same seed data as the
+// migrated database.
+type Memory struct {
+	mu                 sync.RWMutex
+	users              map[uuid.UUID]database.User
+	userRoles          map[roleKey]database.UserRole
+	chirps             map[uuid.UUID]database.Chirp
+	chirpRevisions     map[uuid.UUID][]database.ChirpRevision
+	chirpFlags         map[uuid.UUID]database.ChirpFlag
+	sessions           map[uuid.UUID]database.Session
+	passwordResets     map[string]database.PasswordResetToken
+	verifications      map[string]database.EmailVerificationToken
+	totp               map[uuid.UUID]database.UserTotp
+	recoveryCodes      map[recoveryCodeKey]database.TotpRecoveryCode
+	loginFailures      map[loginFailureKey]database.LoginFailure
+	personalTokens     map[uuid.UUID]database.PersonalAccessToken
+	subscriptions      map[uuid.UUID]database.Subscription
+	subscriptionEvents []database.SubscriptionEvent
+	polkaEvents        map[string]database.PolkaEvent
+	refreshTokens      map[string]database.RefreshToken
+	moderationWords    map[string]database.ModerationWord
+	follows            map[followKey]database.Follow
+	likes              map[reactionKey]time.Time
+	rechirps           map[reactionKey]time.Time
+}
+
+type reactionKey struct {
+	chirpID uuid.UUID
+	userID  uuid.UUID
+}
+
+type roleKey struct {
+	userID uuid.UUID
+	role   string
+}
+
+type recoveryCodeKey struct {
+	userID   uuid.UUID
+	codeHash string
+}
+
+type loginFailureKey struct {
+	scope   string
+	subject string
+}
+
+type followKey struct {
+	followerID uuid.UUID
+	followeeID uuid.UUID
+}
+
+var _ Store = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	m := &Memory{
+		users:           map[uuid.UUID]database.User{},
+		userRoles:       map[roleKey]database.UserRole{},
+		chirps:          map[uuid.UUID]database.Chirp{},
+		chirpRevisions:  map[uuid.UUID][]database.ChirpRevision{},
+		chirpFlags:      map[uuid.UUID]database.ChirpFlag{},
+		sessions:        map[uuid.UUID]database.Session{},
+		passwordResets:  map[string]database.PasswordResetToken{},
+		verifications:   map[string]database.EmailVerificationToken{},
+		totp:            map[uuid.UUID]database.UserTotp{},
+		recoveryCodes:   map[recoveryCodeKey]database.TotpRecoveryCode{},
+		loginFailures:   map[loginFailureKey]database.LoginFailure{},
+		personalTokens:  map[uuid.UUID]database.PersonalAccessToken{},
+		subscriptions:   map[uuid.UUID]database.Subscription{},
+		polkaEvents:     map[string]database.PolkaEvent{},
+		refreshTokens:   map[string]database.RefreshToken{},
+		moderationWords: map[string]database.ModerationWord{},
+		follows:         map[followKey]database.Follow{},
+		likes:           map[reactionKey]time.Time{},
+		rechirps:        map[reactionKey]time.Time{},
+	}
+
+	currentTime := time.Now()
+	for _, word := range []string{"kerfuffle", "sharbert", "fornax"} {
+		m.moderationWords[word] = database.ModerationWord{
+			Word:      word,
+			Action:    "mask",
+			CreatedAt: currentTime,
+			UpdatedAt: currentTime,
+		}
+	}
+
+	return m
+}
+
+func (m *Memory) CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[arg.ID]; ok {
+		return database.User{}, ErrDuplicateKey
+	}
+
+	for _, user := range m.users {
+		if normalizedEmail(user.Email) == normalizedEmail(arg.Email) {
+			return database.User{}, ErrDuplicateKey
+		}
+	}
+
+	user := database.User{
+		ID:             arg.ID,
+		CreatedAt:      arg.CreatedAt,
+		UpdatedAt:      arg.UpdatedAt,
+		Email:          arg.Email,
+		HashedPassword: arg.HashedPassword,
+	}
+	m.users[user.ID] = user
+
+	return user, nil
+}
+
+func (m *Memory) DeleteAll(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clear(m.users)
+	clear(m.userRoles)
+	clear(m.chirps)
+	clear(m.chirpRevisions)
+	clear(m.chirpFlags)
+	clear(m.sessions)
+	clear(m.passwordResets)
+	clear(m.verifications)
+	clear(m.totp)
+	clear(m.recoveryCodes)
+	clear(m.loginFailures)
+	clear(m.personalTokens)
+	clear(m.subscriptions)
+	m.subscriptionEvents = nil
+	clear(m.polkaEvents)
+	clear(m.refreshTokens)
+	clear(m.follows)
+	clear(m.likes)
+	clear(m.rechirps)
+
+	return nil
+}
+
+func (m *Memory) GetUserByEmail(ctx context.Context, email string) (database.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if normalizedEmail(user.Email) == normalizedEmail(email) {
+			return user, nil
+		}
+	}
+
+	return database.User{}, sql.ErrNoRows
+}
+
+// normalizedEmail does what the normalized_email SQL function does: trim the
+// address and lowercase its domain. Users are unique by it.
+func normalizedEmail(email string) string {
+	email = strings.TrimSpace(email)
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	return email[:at+1] + strings.ToLower(email[at+1:])
+}
+
+func (m *Memory) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+
+	return user, nil
+}
+
+func (m *Memory) UpdateUser(ctx context.Context, arg database.UpdateUserParams) (database.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[arg.ID]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+
+	for _, other := range m.users {
+		if other.ID != arg.ID && normalizedEmail(other.Email) == normalizedEmail(arg.Email) {
+			return database.User{}, ErrDuplicateKey
+		}
+	}
+
+	user.Email = arg.Email
+	user.HashedPassword = arg.HashedPassword
+	user.UpdatedAt = time.Now()
+	m.users[user.ID] = user
+
+	return user, nil
+}
+
+func (m *Memory) SetUserChirpyRed(ctx context.Context, arg database.SetUserChirpyRedParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[arg.ID]
+	if !ok {
+		return nil
+	}
+
+	user.IsChirpyRed = arg.IsChirpyRed
+	m.users[arg.ID] = user
+
+	return nil
+}
+
+func (m *Memory) UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[arg.ID]
+	if !ok {
+		return nil
+	}
+
+	user.HashedPassword = arg.HashedPassword
+	user.UpdatedAt = time.Now()
+	m.users[user.ID] = user
+
+	return nil
+}
+
+func (m *Memory) ListUserRoles(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	roles := []string{}
+	for key := range m.userRoles {
+		if key.userID == userID {
+			roles = append(roles, key.role)
+		}
+	}
+
+	slices.Sort(roles)
+
+	return roles, nil
+}
+
+func (m *Memory) GrantUserRole(ctx context.Context, arg database.GrantUserRoleParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return errors.New("Role holder does not exist")
+	}
+
+	if arg.Role != "moderator" && arg.Role != "admin" {
+		return fmt.Errorf("Unknown role %q", arg.Role)
+	}
+
+	key := roleKey{arg.UserID, arg.Role}
+	if _, ok := m.userRoles[key]; ok {
+		return nil
+	}
+
+	m.userRoles[key] = database.UserRole{
+		UserID:    arg.UserID,
+		Role:      arg.Role,
+		GrantedAt: arg.GrantedAt,
+		GrantedBy: arg.GrantedBy,
+	}
+
+	return nil
+}
+
+func (m *Memory) RevokeUserRole(ctx context.Context, arg database.RevokeUserRoleParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := roleKey{arg.UserID, arg.Role}
+	if _, ok := m.userRoles[key]; !ok {
+		return 0, nil
+	}
+
+	delete(m.userRoles, key)
+
+	return 1, nil
+}
+
+func (m *Memory) RevokeUserRoleUnlessLastAdmin(ctx context.Context, arg database.RevokeUserRoleUnlessLastAdminParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := roleKey{arg.UserID, arg.Role}
+	if _, ok := m.userRoles[key]; !ok {
+		return 0, nil
+	}
+
+	if arg.Role == "admin" {
+		admins := 0
+		for key := range m.userRoles {
+			if key.role == "admin" {
+				admins++
+			}
+		}
+
+		if admins <= 1 {
+			return 0, nil
+		}
+	}
+
+	delete(m.userRoles, key)
+
+	return 1, nil
+}
+
+func (m *Memory) CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.chirps[arg.ID]; ok {
+		return database.Chirp{}, ErrDuplicateKey
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return database.Chirp{}, errors.New("Chirp author does not exist")
+	}
+
+	if arg.InReplyTo.Valid {
+		parent, ok := m.chirps[arg.InReplyTo.UUID]
+		if !ok {
+			return database.Chirp{}, errors.New("Replied to chirp does not exist")
+		}
+
+		parent.ReplyCount++
+		m.chirps[parent.ID] = parent
+	}
+
+	chirp := database.Chirp{
+		ID:        arg.ID,
+		CreatedAt: arg.CreatedAt,
+		UpdatedAt: arg.UpdatedAt,
+		Body:      arg.Body,
+		UserID:    arg.UserID,
+		InReplyTo: arg.InReplyTo,
+	}
+	m.chirps[chirp.ID] = chirp
+
+	return chirp, nil
+}
+
+func (m *Memory) GetChirpByID(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	chirp, ok := m.chirps[id]
+	if !ok {
+		return database.Chirp{}, sql.ErrNoRows
+	}
+
+	return chirp, nil
+}
+
+func (m *Memory) ListChirpsAsc(ctx context.Context, arg database.ListChirpsAscParams) ([]database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listChirps(authoredBy(arg.AuthorID), arg.CursorCreatedAt, arg.CursorID, arg.Limit, false), nil
+}
+
+func (m *Memory) ListChirpsDesc(ctx context.Context, arg database.ListChirpsDescParams) ([]database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listChirps(authoredBy(arg.AuthorID), arg.CursorCreatedAt, arg.CursorID, arg.Limit, true), nil
+}
+
+func (m *Memory) DeleteChirp(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	chirp, ok := m.chirps[id]
+	if !ok {
+		return nil
+	}
+
+	if parent, ok := m.chirps[chirp.InReplyTo.UUID]; chirp.InReplyTo.Valid && ok {
+		parent.ReplyCount--
+		m.chirps[parent.ID] = parent
+	}
+
+	for replyID, reply := range m.chirps {
+		if reply.InReplyTo.Valid && reply.InReplyTo.UUID == id {
+			reply.InReplyTo = uuid.NullUUID{}
+			m.chirps[replyID] = reply
+		}
+	}
+
+	delete(m.chirps, id)
+	delete(m.chirpRevisions, id)
+	maps.DeleteFunc(m.likes, func(key reactionKey, _ time.Time) bool {
+		return key.chirpID == id
+	})
+	maps.DeleteFunc(m.rechirps, func(key reactionKey, _ time.Time) bool {
+		return key.chirpID == id
+	})
+	maps.DeleteFunc(m.chirpFlags, func(_ uuid.UUID, flag database.ChirpFlag) bool {
+		return flag.ChirpID == id
+	})
+
+	return nil
+}
+
+func (m *Memory) GetChirpThread(ctx context.Context, id uuid.UUID) ([]database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	chirp, ok := m.chirps[id]
+	if !ok {
+		return []database.Chirp{}, nil
+	}
+
+	inThread := map[uuid.UUID]bool{id: true}
+
+	for ancestor := chirp; ancestor.InReplyTo.Valid && !inThread[ancestor.InReplyTo.UUID]; {
+		ancestor, ok = m.chirps[ancestor.InReplyTo.UUID]
+		if !ok {
+			break
+		}
+
+		inThread[ancestor.ID] = true
+	}
+
+	descendants := map[uuid.UUID]bool{id: true}
+	for found := true; found; {
+		found = false
+
+		for _, reply := range m.chirps {
+			if reply.InReplyTo.Valid && descendants[reply.InReplyTo.UUID] && !descendants[reply.ID] {
+				descendants[reply.ID] = true
+				inThread[reply.ID] = true
+				found = true
+			}
+		}
+	}
+
+	return m.listChirps(func(chirp database.Chirp) bool {
+		return inThread[chirp.ID]
+	}, sql.NullTime{}, uuid.NullUUID{}, -1, false), nil
+}
+
+func (m *Memory) UpdateChirpBody(ctx context.Context, arg database.UpdateChirpBodyParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	chirp, ok := m.chirps[arg.ID]
+	if !ok {
+		return database.Chirp{}, sql.ErrNoRows
+	}
+
+	m.chirpRevisions[chirp.ID] = append(m.chirpRevisions[chirp.ID], database.ChirpRevision{
+		ID:         arg.RevisionID,
+		ChirpID:    chirp.ID,
+		Body:       chirp.Body,
+		CreatedAt:  chirp.UpdatedAt,
+		ReplacedAt: arg.UpdatedAt,
+	})
+
+	chirp.Body = arg.Body
+	chirp.UpdatedAt = arg.UpdatedAt
+	m.chirps[chirp.ID] = chirp
+
+	return chirp, nil
+}
+
+func (m *Memory) GetChirpRevisions(ctx context.Context, chirpID uuid.UUID) ([]database.ChirpRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revisions := slices.Clone(m.chirpRevisions[chirpID])
+	slices.Reverse(revisions)
+
+	return revisions, nil
+}
+
+func (m *Memory) LikeChirp(ctx context.Context, arg database.LikeChirpParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.react(m.likes, reactionKey{arg.ChirpID, arg.UserID}, arg.CreatedAt, true,
+		func(chirp *database.Chirp) *int32 { return &chirp.LikeCount })
+}
+
+func (m *Memory) UnlikeChirp(ctx context.Context, arg database.UnlikeChirpParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.react(m.likes, reactionKey{arg.ChirpID, arg.UserID}, time.Time{}, false,
+		func(chirp *database.Chirp) *int32 { return &chirp.LikeCount })
+}
+
+func (m *Memory) ListLikedChirpIDs(ctx context.Context, arg database.ListLikedChirpIDsParams) ([]uuid.UUID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	liked := []uuid.UUID{}
+	for _, chirpID := range arg.ChirpIds {
+		if _, ok := m.likes[reactionKey{chirpID, arg.UserID}]; ok {
+			liked = append(liked, chirpID)
+		}
+	}
+
+	return liked, nil
+}
+
+func (m *Memory) RechirpChirp(ctx context.Context, arg database.RechirpChirpParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.react(m.rechirps, reactionKey{arg.ChirpID, arg.UserID}, arg.CreatedAt, true,
+		func(chirp *database.Chirp) *int32 { return &chirp.RechirpCount })
+}
+
+func (m *Memory) UnrechirpChirp(ctx context.Context, arg database.UnrechirpChirpParams) (database.Chirp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.react(m.rechirps, reactionKey{arg.ChirpID, arg.UserID}, time.Time{}, false,
+		func(chirp *database.Chirp) *int32 { return &chirp.RechirpCount })
+}
+
+// react adds or removes a like or rechirp and adjusts the chirp's counter
+// only when the reaction set actually changed.
+func (m *Memory) react(reactions map[reactionKey]time.Time, key reactionKey,
+	createdAt time.Time, add bool, counter func(*database.Chirp) *int32,
+) (database.Chirp, error) {
+	chirp, ok := m.chirps[key.chirpID]
+	if !ok {
+		if add {
+			return database.Chirp{}, errors.New("Reacted to chirp does not exist")
+		}
+
+		return database.Chirp{}, sql.ErrNoRows
+	}
+
+	if _, ok := m.users[key.userID]; add && !ok {
+		return database.Chirp{}, errors.New("Reacting user does not exist")
+	}
+
+	_, exists := reactions[key]
+	switch {
+	case add && !exists:
+		reactions[key] = createdAt
+		*counter(&chirp)++
+	case !add && exists:
+		delete(reactions, key)
+		*counter(&chirp)--
+	}
+
+	m.chirps[chirp.ID] = chirp
+
+	return chirp, nil
+}
+
+func (m *Memory) FollowUser(ctx context.Context, arg database.FollowUserParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if arg.FollowerID == arg.FolloweeID {
+		return errors.New("Users cannot follow themselves")
+	}
+
+	_, followerExists := m.users[arg.FollowerID]
+	_, followeeExists := m.users[arg.FolloweeID]
+	if !followerExists || !followeeExists {
+		return errors.New("Followed or following user does not exist")
+	}
+
+	key := followKey{arg.FollowerID, arg.FolloweeID}
+	if _, ok := m.follows[key]; ok {
+		return nil
+	}
+
+	m.follows[key] = database.Follow{
+		FollowerID: arg.FollowerID,
+		FolloweeID: arg.FolloweeID,
+		CreatedAt:  arg.CreatedAt,
+	}
+
+	return nil
+}
+
+func (m *Memory) UnfollowUser(ctx context.Context, arg database.UnfollowUserParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.follows, followKey{arg.FollowerID, arg.FolloweeID})
+
+	return nil
+}
+
+func (m *Memory) ListFollowers(ctx context.Context, followeeID uuid.UUID) ([]database.Follow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listFollows(func(follow database.Follow) bool {
+		return follow.FolloweeID == followeeID
+	}), nil
+}
+
+func (m *Memory) ListFollowing(ctx context.Context, followerID uuid.UUID) ([]database.Follow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listFollows(func(follow database.Follow) bool {
+		return follow.FollowerID == followerID
+	}), nil
+}
+
+func (m *Memory) ListTimelineChirps(ctx context.Context, arg database.ListTimelineChirpsParams) ([]database.Chirp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	followed := func(chirp database.Chirp) bool {
+		_, ok := m.follows[followKey{arg.FollowerID, chirp.UserID}]
+		return ok
+	}
+
+	return m.listChirps(followed, arg.CursorCreatedAt, arg.CursorID, arg.Limit, true), nil
+}
+
+func (m *Memory) listFollows(keep func(database.Follow) bool) []database.Follow {
+	follows := []database.Follow{}
+	for _, follow := range m.follows {
+		if keep(follow) {
+			follows = append(follows, follow)
+		}
+	}
+
+	slices.SortFunc(follows, func(a, b database.Follow) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return follows
+}
+
+func (m *Memory) ListModerationWords(ctx context.Context) ([]database.ModerationWord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	words := slices.Collect(maps.Values(m.moderationWords))
+	slices.SortFunc(words, func(a, b database.ModerationWord) int {
+		return strings.Compare(a.Word, b.Word)
+	})
+
+	return words, nil
+}
+
+func (m *Memory) UpsertModerationWord(ctx context.Context, arg database.UpsertModerationWordParams) (database.ModerationWord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	word, ok := m.moderationWords[arg.Word]
+	if !ok {
+		word = database.ModerationWord{Word: arg.Word, CreatedAt: arg.CreatedAt}
+	}
+
+	word.Action = arg.Action
+	word.UpdatedAt = arg.CreatedAt
+	m.moderationWords[word.Word] = word
+
+	return word, nil
+}
+
+func (m *Memory) DeleteModerationWord(ctx context.Context, word string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.moderationWords[word]; !ok {
+		return 0, nil
+	}
+
+	delete(m.moderationWords, word)
+
+	return 1, nil
+}
+
+func (m *Memory) CreateChirpFlag(ctx context.Context, arg database.CreateChirpFlagParams) (database.ChirpFlag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.chirpFlags[arg.ID]; ok {
+		return database.ChirpFlag{}, ErrDuplicateKey
+	}
+
+	if _, ok := m.chirps[arg.ChirpID]; !ok {
+		return database.ChirpFlag{}, errors.New("Flagged chirp does not exist")
+	}
+
+	flag := database.ChirpFlag{
+		ID:        arg.ID,
+		ChirpID:   arg.ChirpID,
+		Rule:      arg.Rule,
+		CreatedAt: arg.CreatedAt,
+	}
+	m.chirpFlags[flag.ID] = flag
+
+	return flag, nil
+}
+
+func (m *Memory) ListChirpFlags(ctx context.Context) ([]database.ChirpFlag, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	flags := slices.Collect(maps.Values(m.chirpFlags))
+	slices.SortFunc(flags, func(a, b database.ChirpFlag) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return flags, nil
+}
+
+func (m *Memory) CreateRefreshToken(ctx context.Context, arg database.CreateRefreshTokenParams) (database.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.refreshTokens[arg.Token]; ok {
+		return database.RefreshToken{}, ErrDuplicateKey
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return database.RefreshToken{}, errors.New("Refresh token owner does not exist")
+	}
+
+	if _, ok := m.sessions[arg.FamilyID]; !ok {
+		return database.RefreshToken{}, errors.New("Refresh token session does not exist")
+	}
+
+	refreshToken := database.RefreshToken{
+		Token:     arg.Token,
+		CreatedAt: arg.CreatedAt,
+		UpdatedAt: arg.CreatedAt,
+		ExpiresAt: arg.ExpiresAt,
+		UserID:    arg.UserID,
+		FamilyID:  arg.FamilyID,
+	}
+	m.refreshTokens[refreshToken.Token] = refreshToken
+
+	return refreshToken, nil
+}
+
+func (m *Memory) GetRefreshTokenByValue(ctx context.Context, token string) (database.RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	refreshToken, ok := m.refreshTokens[token]
+	if !ok {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+
+	return refreshToken, nil
+}
+
+func (m *Memory) RevokeRefreshToken(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	refreshToken, ok := m.refreshTokens[token]
+	if !ok {
+		return nil
+	}
+
+	currentTime := time.Now()
+	refreshToken.RevokedAt = sql.NullTime{Time: currentTime, Valid: true}
+	refreshToken.UpdatedAt = currentTime
+	m.refreshTokens[token] = refreshToken
+
+	return nil
+}
+
+func (m *Memory) RotateRefreshToken(ctx context.Context, arg database.RotateRefreshTokenParams) (database.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.refreshTokens[arg.OldToken]
+	if !ok || old.RevokedAt.Valid || !old.ExpiresAt.After(arg.Now) {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+
+	if _, ok := m.refreshTokens[arg.NewToken]; ok {
+		return database.RefreshToken{}, ErrDuplicateKey
+	}
+
+	old.RevokedAt = sql.NullTime{Time: arg.Now, Valid: true}
+	old.UpdatedAt = arg.Now
+	old.ReplacedBy = sql.NullString{String: arg.NewToken, Valid: true}
+	m.refreshTokens[old.Token] = old
+
+	refreshToken := database.RefreshToken{
+		Token:     arg.NewToken,
+		CreatedAt: arg.Now,
+		UpdatedAt: arg.Now,
+		ExpiresAt: arg.ExpiresAt,
+		UserID:    old.UserID,
+		FamilyID:  old.FamilyID,
+	}
+	m.refreshTokens[refreshToken.Token] = refreshToken
+
+	return refreshToken, nil
+}
+
+func (m *Memory) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revokeRefreshTokens(func(refreshToken database.RefreshToken) bool {
+		return refreshToken.FamilyID == familyID
+	})
+
+	return nil
+}
+
+func (m *Memory) CreatePasswordResetToken(ctx context.Context, arg database.CreatePasswordResetTokenParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.passwordResets[arg.TokenHash]; ok {
+		return ErrDuplicateKey
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return errors.New("Password reset token owner does not exist")
+	}
+
+	m.passwordResets[arg.TokenHash] = database.PasswordResetToken{
+		TokenHash: arg.TokenHash,
+		UserID:    arg.UserID,
+		CreatedAt: arg.CreatedAt,
+		ExpiresAt: arg.ExpiresAt,
+	}
+
+	return nil
+}
+
+func (m *Memory) ConsumePasswordResetToken(ctx context.Context, arg database.ConsumePasswordResetTokenParams) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resetToken, ok := m.passwordResets[arg.TokenHash]
+	if !ok || resetToken.UsedAt.Valid || !resetToken.ExpiresAt.After(arg.Now) {
+		return uuid.Nil, sql.ErrNoRows
+	}
+
+	resetToken.UsedAt = sql.NullTime{Time: arg.Now, Valid: true}
+	m.passwordResets[arg.TokenHash] = resetToken
+
+	return resetToken.UserID, nil
+}
+
+func (m *Memory) InvalidatePasswordResetTokens(ctx context.Context, arg database.InvalidatePasswordResetTokensParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for tokenHash, resetToken := range m.passwordResets {
+		if resetToken.UserID != arg.UserID || resetToken.UsedAt.Valid {
+			continue
+		}
+
+		resetToken.UsedAt = arg.UsedAt
+		m.passwordResets[tokenHash] = resetToken
+	}
+
+	return nil
+}
+
+func (m *Memory) VerifyUserEmail(ctx context.Context, arg database.VerifyUserEmailParams) (database.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[arg.ID]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+
+	for _, other := range m.users {
+		if other.ID != arg.ID && normalizedEmail(other.Email) == normalizedEmail(arg.Email) {
+			return database.User{}, ErrDuplicateKey
+		}
+	}
+
+	user.Email = arg.Email
+	user.EmailVerifiedAt = arg.EmailVerifiedAt
+	user.UpdatedAt = time.Now()
+	m.users[user.ID] = user
+
+	return user, nil
+}
+
+func (m *Memory) CreateEmailVerificationToken(ctx context.Context, arg database.CreateEmailVerificationTokenParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.verifications[arg.TokenHash]; ok {
+		return ErrDuplicateKey
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return errors.New("Email verification token owner does not exist")
+	}
+
+	m.verifications[arg.TokenHash] = database.EmailVerificationToken{
+		TokenHash: arg.TokenHash,
+		UserID:    arg.UserID,
+		Email:     arg.Email,
+		CreatedAt: arg.CreatedAt,
+		ExpiresAt: arg.ExpiresAt,
+	}
+
+	return nil
+}
+
+func (m *Memory) ConsumeEmailVerificationToken(ctx context.Context, arg database.ConsumeEmailVerificationTokenParams) (database.ConsumeEmailVerificationTokenRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	verification, ok := m.verifications[arg.TokenHash]
+	if !ok || verification.UsedAt.Valid || !verification.ExpiresAt.After(arg.Now) {
+		return database.ConsumeEmailVerificationTokenRow{}, sql.ErrNoRows
+	}
+
+	verification.UsedAt = sql.NullTime{Time: arg.Now, Valid: true}
+	m.verifications[arg.TokenHash] = verification
+
+	return database.ConsumeEmailVerificationTokenRow{
+		UserID: verification.UserID,
+		Email:  verification.Email,
+	}, nil
+}
+
+func (m *Memory) InvalidateEmailVerificationTokens(ctx context.Context, arg database.InvalidateEmailVerificationTokensParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for tokenHash, verification := range m.verifications {
+		if verification.UserID != arg.UserID || verification.UsedAt.Valid {
+			continue
+		}
+
+		verification.UsedAt = arg.UsedAt
+		m.verifications[tokenHash] = verification
+	}
+
+	return nil
+}
+
+func (m *Memory) UpsertUserTOTP(ctx context.Context, arg database.UpsertUserTOTPParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return errors.New("TOTP owner does not exist")
+	}
+
+	m.totp[arg.UserID] = database.UserTotp{
+		UserID:           arg.UserID,
+		SecretCiphertext: arg.SecretCiphertext,
+		CreatedAt:        arg.CreatedAt,
+	}
+
+	return nil
+}
+
+func (m *Memory) GetUserTOTP(ctx context.Context, userID uuid.UUID) (database.UserTotp, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	totp, ok := m.totp[userID]
+	if !ok {
+		return database.UserTotp{}, sql.ErrNoRows
+	}
+
+	return totp, nil
+}
+
+func (m *Memory) ConfirmUserTOTP(ctx context.Context, arg database.ConfirmUserTOTPParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totp[arg.UserID]
+	if !ok {
+		return nil
+	}
+
+	totp.ConfirmedAt = arg.ConfirmedAt
+	m.totp[arg.UserID] = totp
+
+	return nil
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totp[arg.UserID]
+	if !ok || totp.LastUsedStep >= arg.LastUsedStep {
+		return 0, nil
+	}
+
+	totp.LastUsedStep = arg.LastUsedStep
+	m.totp[arg.UserID] = totp
+
+	return 1, nil
+}
+
+func (m *Memory) DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.totp, userID)
+
+	return nil
+}
+
+func (m *Memory) CreateTOTPRecoveryCode(ctx context.Context, arg database.CreateTOTPRecoveryCodeParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := recoveryCodeKey{arg.UserID, arg.CodeHash}
+	if _, ok := m.recoveryCodes[key]; ok {
+		return ErrDuplicateKey
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return errors.New("Recovery code owner does not exist")
+	}
+
+	m.recoveryCodes[key] = database.TotpRecoveryCode{
+		UserID:    arg.UserID,
+		CodeHash:  arg.CodeHash,
+		CreatedAt: arg.CreatedAt,
+	}
+
+	return nil
+}
+
+func (m *Memory) UseTOTPRecoveryCode(ctx context.Context, arg database.UseTOTPRecoveryCodeParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := recoveryCodeKey{arg.UserID, arg.CodeHash}
+	code, ok := m.recoveryCodes[key]
+	if !ok || code.UsedAt.Valid {
+		return 0, nil
+	}
+
+	code.UsedAt = arg.UsedAt
+	m.recoveryCodes[key] = code
+
+	return 1, nil
+}
+
+func (m *Memory) DeleteTOTPRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.recoveryCodes {
+		if key.userID == userID {
+			delete(m.recoveryCodes, key)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) GetLoginFailure(ctx context.Context, arg database.GetLoginFailureParams) (database.LoginFailure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	failure, ok := m.loginFailures[loginFailureKey{arg.Scope, arg.Subject}]
+	if !ok {
+		return database.LoginFailure{}, sql.ErrNoRows
+	}
+
+	return failure, nil
+}
+
+func (m *Memory) RecordLoginAttempt(ctx context.Context, arg database.RecordLoginAttemptParams) (database.LoginFailure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := loginFailureKey{arg.Scope, arg.Subject}
+	failure, ok := m.loginFailures[key]
+	if !ok {
+		failure = database.LoginFailure{Scope: arg.Scope, Subject: arg.Subject}
+	}
+
+	if failure.BlockedUntil.Valid && failure.BlockedUntil.Time.After(arg.Now) {
+		return database.LoginFailure{}, sql.ErrNoRows
+	}
+
+	if !ok || failure.LastFailedAt.Before(arg.WindowStart) {
+		failure.Failures = 1
+	} else {
+		failure.Failures++
+	}
+
+	block := arg.Schedule[min(int(failure.Failures), len(arg.Schedule))-1]
+	failure.LastFailedAt = arg.Now
+	failure.BlockedUntil = sql.NullTime{Time: arg.Now.Add(time.Duration(block) * time.Second), Valid: true}
+	m.loginFailures[key] = failure
+
+	return failure, nil
+}
+
+func (m *Memory) ForgiveLoginAttempt(ctx context.Context, arg database.ForgiveLoginAttemptParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := loginFailureKey{arg.Scope, arg.Subject}
+	failure, ok := m.loginFailures[key]
+	if !ok {
+		return nil
+	}
+
+	failure.Failures = max(failure.Failures-1, 0)
+	failure.BlockedUntil = sql.NullTime{}
+	m.loginFailures[key] = failure
+
+	return nil
+}
+
+func (m *Memory) ClearLoginFailures(ctx context.Context, arg database.ClearLoginFailuresParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginFailures, loginFailureKey{arg.Scope, arg.Subject})
+
+	return nil
+}
+
+func (m *Memory) CreatePersonalAccessToken(ctx context.Context, arg database.CreatePersonalAccessTokenParams) (database.PersonalAccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.personalTokens[arg.ID]; ok {
+		return database.PersonalAccessToken{}, ErrDuplicateKey
+	}
+
+	for _, token := range m.personalTokens {
+		if token.TokenHash == arg.TokenHash {
+			return database.PersonalAccessToken{}, ErrDuplicateKey
+		}
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return database.PersonalAccessToken{}, errors.New("Personal access token owner does not exist")
+	}
+
+	token := database.PersonalAccessToken{
+		ID:        arg.ID,
+		UserID:    arg.UserID,
+		Name:      arg.Name,
+		TokenHash: arg.TokenHash,
+		Scopes:    slices.Clone(arg.Scopes),
+		CreatedAt: arg.CreatedAt,
+		ExpiresAt: arg.ExpiresAt,
+	}
+	m.personalTokens[token.ID] = token
+
+	return token, nil
+}
+
+func (m *Memory) GetPersonalAccessTokenByHash(ctx context.Context, tokenHash string) (database.PersonalAccessToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, token := range m.personalTokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+
+	return database.PersonalAccessToken{}, sql.ErrNoRows
+}
+
+func (m *Memory) ListPersonalAccessTokens(ctx context.Context, userID uuid.UUID) ([]database.PersonalAccessToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := []database.PersonalAccessToken{}
+	for _, token := range m.personalTokens {
+		if token.UserID == userID && !token.RevokedAt.Valid {
+			tokens = append(tokens, token)
+		}
+	}
+
+	slices.SortFunc(tokens, func(a, b database.PersonalAccessToken) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+func (m *Memory) TouchPersonalAccessToken(ctx context.Context, arg database.TouchPersonalAccessTokenParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.personalTokens[arg.ID]
+	if !ok {
+		return nil
+	}
+
+	token.LastUsedAt = arg.LastUsedAt
+	m.personalTokens[arg.ID] = token
+
+	return nil
+}
+
+func (m *Memory) RevokePersonalAccessToken(ctx context.Context, arg database.RevokePersonalAccessTokenParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.personalTokens[arg.ID]
+	if !ok || token.UserID != arg.UserID || token.RevokedAt.Valid {
+		return 0, nil
+	}
+
+	token.RevokedAt = arg.RevokedAt
+	m.personalTokens[arg.ID] = token
+
+	return 1, nil
+}
+
+func (m *Memory) RevokeUserPersonalAccessTokens(ctx context.Context, arg database.RevokeUserPersonalAccessTokensParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, token := range m.personalTokens {
+		if token.UserID != arg.UserID || token.RevokedAt.Valid {
+			continue
+		}
+
+		token.RevokedAt = arg.RevokedAt
+		m.personalTokens[id] = token
+	}
+
+	return nil
+}
+
+func (m *Memory) GetSubscription(ctx context.Context, userID uuid.UUID) (database.Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	subscription, ok := m.subscriptions[userID]
+	if !ok {
+		return database.Subscription{}, sql.ErrNoRows
+	}
+
+	return subscription, nil
+}
+
+func (m *Memory) SaveSubscription(ctx context.Context, arg database.SaveSubscriptionParams) (database.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[arg.UserID]
+	if !ok {
+		return database.Subscription{}, errors.New("Subscriber does not exist")
+	}
+
+	if previous, ok := m.subscriptions[arg.UserID]; ok &&
+		(!arg.PreviousUpdatedAt.Valid || !previous.UpdatedAt.Equal(arg.PreviousUpdatedAt.Time)) {
+		return database.Subscription{}, sql.ErrNoRows
+	}
+
+	subscription := database.Subscription{
+		UserID:     arg.UserID,
+		Plan:       arg.Plan,
+		Status:     arg.Status,
+		StartedAt:  arg.StartedAt,
+		RenewedAt:  arg.RenewedAt,
+		ExpiresAt:  arg.ExpiresAt,
+		GraceUntil: arg.GraceUntil,
+		CanceledAt: arg.CanceledAt,
+		UpdatedAt:  arg.UpdatedAt,
+	}
+	m.subscriptions[arg.UserID] = subscription
+	m.recordSubscriptionEvent(arg.EventID, arg.Event, subscription)
+
+	user.IsChirpyRed = subscription.Status != "expired"
+	m.users[user.ID] = user
+
+	return subscription, nil
+}
+
+func (m *Memory) ExpireLapsedSubscriptions(ctx context.Context, arg database.ExpireLapsedSubscriptionsParams) ([]database.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := []database.Subscription{}
+	for userID, subscription := range m.subscriptions {
+		lapsesAt := subscription.ExpiresAt
+		if subscription.GraceUntil.Valid {
+			lapsesAt = subscription.GraceUntil.Time
+		}
+
+		if subscription.Status == "expired" || lapsesAt.After(arg.Now) {
+			continue
+		}
+
+		subscription.Status = "expired"
+		subscription.UpdatedAt = arg.Now
+		m.subscriptions[userID] = subscription
+		m.recordSubscriptionEvent(uuid.New(), arg.Event, subscription)
+
+		if user, ok := m.users[userID]; ok {
+			user.IsChirpyRed = false
+			m.users[userID] = user
+		}
+
+		expired = append(expired, subscription)
+	}
+
+	return expired, nil
+}
+
+func (m *Memory) recordSubscriptionEvent(id uuid.UUID, event string, subscription database.Subscription) {
+	m.subscriptionEvents = append(m.subscriptionEvents, database.SubscriptionEvent{
+		ID:        id,
+		UserID:    subscription.UserID,
+		Event:     event,
+		Status:    subscription.Status,
+		ExpiresAt: subscription.ExpiresAt,
+		CreatedAt: subscription.UpdatedAt,
+	})
+}
+
+func (m *Memory) ListSubscriptionEvents(ctx context.Context, userID uuid.UUID) ([]database.SubscriptionEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := []database.SubscriptionEvent{}
+	for _, event := range slices.Backward(m.subscriptionEvents) {
+		if event.UserID == userID {
+			events = append(events, event)
+		}
+	}
+
+	// Stable, so events recorded at the same instant stay newest first.
+	slices.SortStableFunc(events, func(a, b database.SubscriptionEvent) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return events, nil
+}
+
+func (m *Memory) CreatePolkaEvent(ctx context.Context, arg database.CreatePolkaEventParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.polkaEvents[arg.ID]; ok {
+		return 0, nil
+	}
+
+	m.polkaEvents[arg.ID] = database.PolkaEvent{
+		ID:         arg.ID,
+		Event:      arg.Event,
+		Payload:    arg.Payload,
+		Status:     arg.Status,
+		ReceivedAt: arg.ReceivedAt,
+	}
+
+	return 1, nil
+}
+
+func (m *Memory) GetPolkaEvent(ctx context.Context, id string) (database.PolkaEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	event, ok := m.polkaEvents[id]
+	if !ok {
+		return database.PolkaEvent{}, sql.ErrNoRows
+	}
+
+	return event, nil
+}
+
+func (m *Memory) ListPolkaEvents(ctx context.Context, arg database.ListPolkaEventsParams) ([]database.PolkaEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := []database.PolkaEvent{}
+	for _, event := range m.polkaEvents {
+		if !arg.Status.Valid || event.Status == arg.Status.String {
+			events = append(events, event)
+		}
+	}
+
+	slices.SortFunc(events, func(a, b database.PolkaEvent) int {
+		if c := b.ReceivedAt.Compare(a.ReceivedAt); c != 0 {
+			return c
+		}
+
+		return strings.Compare(b.ID, a.ID)
+	})
+
+	if len(events) > int(arg.Limit) {
+		events = events[:arg.Limit]
+	}
+
+	return events, nil
+}
+
+func (m *Memory) ClaimPolkaEvent(ctx context.Context, arg database.ClaimPolkaEventParams) (database.PolkaEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event, ok := m.polkaEvents[arg.ID]
+	if !ok {
+		return database.PolkaEvent{}, sql.ErrNoRows
+	}
+
+	stale := event.Status == "processing" && event.ClaimedAt.Time.Before(arg.StaleBefore)
+	if event.Status != "received" && event.Status != "failed" && !stale {
+		return database.PolkaEvent{}, sql.ErrNoRows
+	}
+
+	event.Status = "processing"
+	event.ClaimedAt = sql.NullTime{Time: arg.Now, Valid: true}
+	m.polkaEvents[arg.ID] = event
+
+	return event, nil
+}
+
+func (m *Memory) FinishPolkaEvent(ctx context.Context, arg database.FinishPolkaEventParams) (database.PolkaEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event, ok := m.polkaEvents[arg.ID]
+	if !ok {
+		return database.PolkaEvent{}, sql.ErrNoRows
+	}
+
+	event.Status = arg.Status
+	event.Attempts++
+	event.LastError = arg.LastError
+	event.ProcessedAt = arg.ProcessedAt
+	m.polkaEvents[arg.ID] = event
+
+	return event, nil
+}
+
+func (m *Memory) CreateSession(ctx context.Context, arg database.CreateSessionParams) (database.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[arg.ID]; ok {
+		return database.Session{}, ErrDuplicateKey
+	}
+
+	if _, ok := m.users[arg.UserID]; !ok {
+		return database.Session{}, errors.New("Session owner does not exist")
+	}
+
+	session := database.Session{
+		ID:        arg.ID,
+		UserID:    arg.UserID,
+		CreatedAt: arg.CreatedAt,
+		UserAgent: arg.UserAgent,
+		Ip:        arg.Ip,
+	}
+	m.sessions[session.ID] = session
+
+	return session, nil
+}
+
+func (m *Memory) ListActiveSessions(ctx context.Context, arg database.ListActiveSessionsParams) ([]database.ListActiveSessionsRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := []database.ListActiveSessionsRow{}
+	for _, refreshToken := range m.refreshTokens {
+		session, ok := m.sessions[refreshToken.FamilyID]
+		if !ok || session.UserID != arg.UserID || refreshToken.RevokedAt.Valid ||
+			!refreshToken.ExpiresAt.After(arg.ExpiresAt) {
+			continue
+		}
+
+		sessions = append(sessions, database.ListActiveSessionsRow{
+			ID:          session.ID,
+			CreatedAt:   session.CreatedAt,
+			UserAgent:   session.UserAgent,
+			Ip:          session.Ip,
+			RefreshedAt: refreshToken.CreatedAt,
+			ExpiresAt:   refreshToken.ExpiresAt,
+		})
+	}
+
+	slices.SortFunc(sessions, func(a, b database.ListActiveSessionsRow) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return sessions, nil
+}
+
+func (m *Memory) RevokeSession(ctx context.Context, arg database.RevokeSessionParams) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.revokeRefreshTokens(func(refreshToken database.RefreshToken) bool {
+		return refreshToken.FamilyID == arg.FamilyID && refreshToken.UserID == arg.UserID
+	}), nil
+}
+
+func (m *Memory) RevokeUserSessions(ctx context.Context, arg database.RevokeUserSessionsParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revokeRefreshTokens(func(refreshToken database.RefreshToken) bool {
+		return refreshToken.UserID == arg.UserID &&
+			(!arg.ExceptSessionID.Valid || refreshToken.FamilyID != arg.ExceptSessionID.UUID)
+	})
+
+	return nil
+}
+
+func (m *Memory) IsSessionActive(ctx context.Context, arg database.IsSessionActiveParams) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, refreshToken := range m.refreshTokens {
+		if refreshToken.FamilyID == arg.FamilyID && !refreshToken.RevokedAt.Valid &&
+			refreshToken.ExpiresAt.After(arg.Now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *Memory) revokeRefreshTokens(keep func(database.RefreshToken) bool) int64 {
+	var revoked int64
+	currentTime := time.Now()
+	for token, refreshToken := range m.refreshTokens {
+		if refreshToken.RevokedAt.Valid || !keep(refreshToken) {
+			continue
+		}
+
+		refreshToken.RevokedAt = sql.NullTime{Time: currentTime, Valid: true}
+		refreshToken.UpdatedAt = currentTime
+		m.refreshTokens[token] = refreshToken
+		revoked++
+	}
+
+	return revoked
+}
+
+func authoredBy(authorID uuid.NullUUID) func(database.Chirp) bool {
+	return func(chirp database.Chirp) bool {
+		return !authorID.Valid || chirp.UserID == authorID.UUID
+	}
+}
+
+// listChirps orders chirps by (created_at, id) like the keyset queries do and
+// returns up to limit of them strictly after the cursor in that order.
+func (m *Memory) listChirps(keep func(database.Chirp) bool, cursorCreatedAt sql.NullTime,
+	cursorID uuid.NullUUID, limit int32, desc bool,
+) []database.Chirp {
+	compare := func(createdAtA time.Time, idA uuid.UUID, createdAtB time.Time, idB uuid.UUID) int {
+		if c := createdAtA.Compare(createdAtB); c != 0 {
+			return c
+		}
+
+		return bytes.Compare(idA[:], idB[:])
+	}
+
+	if desc {
+		ascCompare := compare
+		compare = func(createdAtA time.Time, idA uuid.UUID, createdAtB time.Time, idB uuid.UUID) int {
+			return -ascCompare(createdAtA, idA, createdAtB, idB)
+		}
+	}
+
+	chirps := []database.Chirp{}
+	for _, chirp := range m.chirps {
+		if !keep(chirp) {
+			continue
+		}
+
+		if cursorCreatedAt.Valid && compare(chirp.CreatedAt, chirp.ID,
+			cursorCreatedAt.Time, cursorID.UUID) <= 0 {
+			continue
+		}
+
+		chirps = append(chirps, chirp)
+	}
+
+	slices.SortFunc(chirps, func(a, b database.Chirp) int {
+		return compare(a.CreatedAt, a.ID, b.CreatedAt, b.ID)
+	})
+
+	if limit >= 0 && len(chirps) > int(limit) {
+		chirps = chirps[:limit]
+	}
+
+	return chirps
+}
@@ -0,0 +1,328 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createTestUser(t *testing.T, m *Memory, email string) database.User {
+	t.Helper()
+
+	user, err := m.CreateUser(context.Background(), database.CreateUserParams{
+		ID:             uuid.New(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		Email:          email,
+		HashedPassword: "hash",
+	})
+	if err != nil {
+		t.Fatalf("Error creating user: %s", err)
+	}
+
+	return user
+}
+
+func TestMemoryUsers(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	user := createTestUser(t, m, "a@example.com")
+
+	if _, err := m.CreateUser(ctx, database.CreateUserParams{
+		ID: uuid.New(), Email: "a@example.com",
+	}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("Expected duplicate email to be rejected, got %v", err)
+	}
+
+	if found, _ := m.GetUserByEmail(ctx, "a@example.com"); found.ID != user.ID {
+		t.Errorf("User mismatch %s != %s", found.ID, user.ID)
+	}
+
+	if _, err := m.GetUserByEmail(ctx, "b@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for unknown email, got %v", err)
+	}
+
+	// Only the domain is compared without regard to case.
+	legacy := createTestUser(t, m, "Bob@Example.COM")
+	if found, _ := m.GetUserByEmail(ctx, "Bob@example.com"); found.ID != legacy.ID {
+		t.Errorf("Expected the domain to be matched case-insensitively")
+	}
+	if _, err := m.GetUserByEmail(ctx, "bob@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected the local part to be matched as typed, got %v", err)
+	}
+	if _, err := m.CreateUser(ctx, database.CreateUserParams{
+		ID: uuid.New(), Email: "Bob@example.com",
+	}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("Expected address differing in domain case to be rejected, got %v", err)
+	}
+
+	if err := m.SetUserChirpyRed(ctx, database.SetUserChirpyRedParams{
+		ID: user.ID, IsChirpyRed: true,
+	}); err != nil {
+		t.Errorf("Error upgrading user: %s", err)
+	}
+
+	if found, _ := m.GetUserByEmail(ctx, "a@example.com"); !found.IsChirpyRed {
+		t.Errorf("Expected user to be upgraded to Chirpy Red")
+	}
+}
+
+func TestMemoryDeleteAllCascades(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	user := createTestUser(t, m, "a@example.com")
+
+	chirp, err := m.CreateChirp(ctx, database.CreateChirpParams{
+		ID: uuid.New(), CreatedAt: time.Now(), Body: "hello", UserID: user.ID,
+	})
+	if err != nil {
+		t.Fatalf("Error creating chirp: %s", err)
+	}
+
+	session, err := m.CreateSession(ctx, database.CreateSessionParams{
+		ID: uuid.New(), UserID: user.ID, CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Error creating session: %s", err)
+	}
+
+	_, err = m.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{
+		Token: "token", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour),
+		UserID: user.ID, FamilyID: session.ID,
+	})
+	if err != nil {
+		t.Fatalf("Error creating refresh token: %s", err)
+	}
+
+	if err := m.DeleteAll(ctx); err != nil {
+		t.Fatalf("Error deleting users: %s", err)
+	}
+
+	if _, err := m.GetChirpByID(ctx, chirp.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected chirp to be deleted with its author")
+	}
+
+	if _, err := m.GetRefreshTokenByValue(ctx, "token"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected refresh token to be deleted with its owner")
+	}
+}
+
+func TestMemoryIsSessionActive(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	user := createTestUser(t, m, "walt@example.com")
+
+	now := time.Now()
+	session := func(expiresAt time.Time) uuid.UUID {
+		session, err := m.CreateSession(ctx, database.CreateSessionParams{
+			ID: uuid.New(), UserID: user.ID, CreatedAt: now.Add(-time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+
+		_, err = m.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{
+			Token: uuid.NewString(), CreatedAt: now.Add(-time.Hour), ExpiresAt: expiresAt,
+			UserID: user.ID, FamilyID: session.ID,
+		})
+		if err != nil {
+			t.Fatalf("Error creating refresh token: %s", err)
+		}
+
+		return session.ID
+	}
+
+	live := session(now.Add(time.Hour))
+	lapsed := session(now.Add(-time.Minute))
+
+	for familyID, expected := range map[uuid.UUID]bool{live: true, lapsed: false, uuid.New(): false} {
+		active, err := m.IsSessionActive(ctx, database.IsSessionActiveParams{FamilyID: familyID, Now: now})
+		if err != nil || active != expected {
+			t.Errorf("IsSessionActive(%s) = %v, %v, expected %v", familyID, active, err, expected)
+		}
+	}
+}
+
+func TestMemoryConcurrentChirps(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	user := createTestUser(t, m, "a@example.com")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			m.CreateChirp(ctx, database.CreateChirpParams{
+				ID: uuid.New(), CreatedAt: time.Now(), Body: "hello", UserID: user.ID,
+			})
+			m.ListChirpsDesc(ctx, database.ListChirpsDescParams{Limit: 10})
+		}()
+	}
+	wg.Wait()
+
+	chirps, _ := m.ListChirpsAsc(ctx, database.ListChirpsAscParams{
+		AuthorID: uuid.NullUUID{UUID: user.ID, Valid: true},
+		Limit:    100,
+	})
+	if len(chirps) != 50 {
+		t.Errorf("Chirp count mismatch %d != 50", len(chirps))
+	}
+
+	for i := 1; i < len(chirps); i++ {
+		if chirps[i].CreatedAt.Before(chirps[i-1].CreatedAt) {
+			t.Errorf("Expected chirps in ascending creation order")
+		}
+	}
+}
+
+func TestMemoryListChirpsCursor(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	user := createTestUser(t, m, "a@example.com")
+	other := createTestUser(t, m, "b@example.com")
+
+	createdAt := time.Now()
+	ids := []uuid.UUID{}
+	for i := 0; i < 5; i++ {
+		chirp, err := m.CreateChirp(ctx, database.CreateChirpParams{
+			ID: uuid.New(), CreatedAt: createdAt.Add(time.Duration(i) * time.Second),
+			Body: "hello", UserID: user.ID,
+		})
+		if err != nil {
+			t.Fatalf("Error creating chirp: %s", err)
+		}
+
+		ids = append(ids, chirp.ID)
+	}
+
+	m.CreateChirp(ctx, database.CreateChirpParams{
+		ID: uuid.New(), CreatedAt: createdAt, Body: "other", UserID: other.ID,
+	})
+
+	page, _ := m.ListChirpsDesc(ctx, database.ListChirpsDescParams{
+		AuthorID:        uuid.NullUUID{UUID: user.ID, Valid: true},
+		CursorCreatedAt: sql.NullTime{Time: createdAt.Add(3 * time.Second), Valid: true},
+		CursorID:        uuid.NullUUID{UUID: ids[3], Valid: true},
+		Limit:           2,
+	})
+	if len(page) != 2 || page[0].ID != ids[2] || page[1].ID != ids[1] {
+		t.Errorf("Expected the two chirps preceding the cursor, got %+v", page)
+	}
+
+	page, _ = m.ListChirpsAsc(ctx, database.ListChirpsAscParams{
+		AuthorID:        uuid.NullUUID{UUID: user.ID, Valid: true},
+		CursorCreatedAt: sql.NullTime{Time: createdAt.Add(3 * time.Second), Valid: true},
+		CursorID:        uuid.NullUUID{UUID: ids[3], Valid: true},
+		Limit:           10,
+	})
+	if len(page) != 1 || page[0].ID != ids[4] {
+		t.Errorf("Expected the single chirp following the cursor, got %+v", page)
+	}
+}
+
+func TestMemorySaveSubscriptionConflict(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	user := createTestUser(t, m, "walt@example.com")
+
+	now := time.Now()
+	save := func(updatedAt time.Time, previous sql.NullTime) error {
+		_, err := m.SaveSubscription(ctx, database.SaveSubscriptionParams{
+			UserID: user.ID, Plan: "red", Status: "active", StartedAt: now,
+			ExpiresAt: now.Add(time.Hour), UpdatedAt: updatedAt, PreviousUpdatedAt: previous,
+			EventID: uuid.New(), Event: "user.upgraded",
+		})
+		return err
+	}
+
+	if err := save(now, sql.NullTime{}); err != nil {
+		t.Fatalf("Error creating subscription: %s", err)
+	}
+
+	if err := save(now.Add(time.Second), sql.NullTime{}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected a conflict creating an existing subscription, got %v", err)
+	}
+
+	if err := save(now.Add(time.Second), sql.NullTime{Time: now.Add(-time.Second), Valid: true}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected a conflict saving over a stale read, got %v", err)
+	}
+
+	if err := save(now.Add(time.Second), sql.NullTime{Time: now, Valid: true}); err != nil {
+		t.Errorf("Error saving over the current subscription: %s", err)
+	}
+}
+
+func TestMemoryExpireLapsedSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	now := time.Now()
+	subscribe := func(email, status string, expiresAt time.Time, graceUntil sql.NullTime) uuid.UUID {
+		user := createTestUser(t, m, email)
+
+		_, err := m.SaveSubscription(ctx, database.SaveSubscriptionParams{
+			UserID: user.ID, Plan: "red", Status: status, StartedAt: now.Add(-60 * 24 * time.Hour),
+			ExpiresAt: expiresAt, GraceUntil: graceUntil, UpdatedAt: now,
+			EventID: uuid.New(), Event: "user.upgraded",
+		})
+		if err != nil {
+			t.Fatalf("Error creating subscription: %s", err)
+		}
+
+		return user.ID
+	}
+
+	inGrace := subscribe("a@example.com", "past_due", now.Add(-time.Hour),
+		sql.NullTime{Time: now.Add(time.Hour), Valid: true})
+	graceOver := subscribe("b@example.com", "active", now.Add(-2*time.Hour),
+		sql.NullTime{Time: now.Add(-time.Hour), Valid: true})
+	canceled := subscribe("c@example.com", "canceled", now.Add(-time.Hour), sql.NullTime{})
+	subscribe("d@example.com", "expired", now.Add(-time.Hour), sql.NullTime{})
+
+	expire := database.ExpireLapsedSubscriptionsParams{Now: now, Event: "subscription.expired"}
+	expired, err := m.ExpireLapsedSubscriptions(ctx, expire)
+	if err != nil {
+		t.Fatalf("Error expiring subscriptions: %s", err)
+	}
+
+	expiredIDs := []uuid.UUID{}
+	for _, subscription := range expired {
+		expiredIDs = append(expiredIDs, subscription.UserID)
+	}
+
+	if len(expiredIDs) != 2 || !slices.Contains(expiredIDs, graceOver) || !slices.Contains(expiredIDs, canceled) {
+		t.Errorf("Expected only the lapsed subscriptions to expire, got %+v", expired)
+	}
+
+	if subscription, _ := m.GetSubscription(ctx, inGrace); subscription.Status != "past_due" {
+		t.Errorf("Expected subscription in its grace period to be kept, got %s", subscription.Status)
+	}
+
+	// Expiring takes Chirpy Red away and records why, along with the status.
+	if user, _ := m.GetUserByID(ctx, graceOver); user.IsChirpyRed {
+		t.Errorf("Expected Chirpy Red to end with the subscription")
+	}
+	if user, _ := m.GetUserByID(ctx, inGrace); !user.IsChirpyRed {
+		t.Errorf("Expected Chirpy Red to last through the grace period")
+	}
+	events, _ := m.ListSubscriptionEvents(ctx, graceOver)
+	if len(events) != 2 || events[0].Event != "subscription.expired" || events[0].Status != "expired" {
+		t.Errorf("Expected the expiry in the history, got %+v", events)
+	}
+
+	if again, _ := m.ExpireLapsedSubscriptions(ctx, expire); len(again) != 0 {
+		t.Errorf("Expected expired subscriptions to stay expired, got %+v", again)
+	}
+}
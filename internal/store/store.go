@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+)
+
+// Store is the persistence layer used by the API handlers. Its method set
+// mirrors the sqlc-generated queries, so *database.Queries satisfies it as is.
+type Store interface {
+	CreateUser(ctx context.Context, arg database.CreateUserParams) (database.User, error)
+	DeleteAll(ctx context.Context) error
+	GetUserByEmail(ctx context.Context, email string) (database.User, error)
+	GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error)
+	UpdateUser(ctx context.Context, arg database.UpdateUserParams) (database.User, error)
+	SetUserChirpyRed(ctx context.Context, arg database.SetUserChirpyRedParams) error
+	UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error
+
+	CreateChirp(ctx context.Context, arg database.CreateChirpParams) (database.Chirp, error)
+	GetChirpByID(ctx context.Context, id uuid.UUID) (database.Chirp, error)
+	ListChirpsAsc(ctx context.Context, arg database.ListChirpsAscParams) ([]database.Chirp, error)
+	ListChirpsDesc(ctx context.Context, arg database.ListChirpsDescParams) ([]database.Chirp, error)
+	DeleteChirp(ctx context.Context, id uuid.UUID) error
+	GetChirpThread(ctx context.Context, id uuid.UUID) ([]database.Chirp, error)
+	UpdateChirpBody(ctx context.Context, arg database.UpdateChirpBodyParams) (database.Chirp, error)
+	GetChirpRevisions(ctx context.Context, chirpID uuid.UUID) ([]database.ChirpRevision, error)
+
+	LikeChirp(ctx context.Context, arg database.LikeChirpParams) (database.Chirp, error)
+	UnlikeChirp(ctx context.Context, arg database.UnlikeChirpParams) (database.Chirp, error)
+	ListLikedChirpIDs(ctx context.Context, arg database.ListLikedChirpIDsParams) ([]uuid.UUID, error)
+	RechirpChirp(ctx context.Context, arg database.RechirpChirpParams) (database.Chirp, error)
+	UnrechirpChirp(ctx context.Context, arg database.UnrechirpChirpParams) (database.Chirp, error)
+
+	FollowUser(ctx context.Context, arg database.FollowUserParams) error
+	UnfollowUser(ctx context.Context, arg database.UnfollowUserParams) error
+	ListFollowers(ctx context.Context, followeeID uuid.UUID) ([]database.Follow, error)
+	ListFollowing(ctx context.Context, followerID uuid.UUID) ([]database.Follow, error)
+	ListTimelineChirps(ctx context.Context, arg database.ListTimelineChirpsParams) ([]database.Chirp, error)
+
+	ListModerationWords(ctx context.Context) ([]database.ModerationWord, error)
+	UpsertModerationWord(ctx context.Context, arg database.UpsertModerationWordParams) (database.ModerationWord, error)
+	DeleteModerationWord(ctx context.Context, word string) (int64, error)
+	CreateChirpFlag(ctx context.Context, arg database.CreateChirpFlagParams) (database.ChirpFlag, error)
+	ListChirpFlags(ctx context.Context) ([]database.ChirpFlag, error)
+
+	ListUserRoles(ctx context.Context, userID uuid.UUID) ([]string, error)
+	GrantUserRole(ctx context.Context, arg database.GrantUserRoleParams) error
+	RevokeUserRole(ctx context.Context, arg database.RevokeUserRoleParams) (int64, error)
+	RevokeUserRoleUnlessLastAdmin(ctx context.Context, arg database.RevokeUserRoleUnlessLastAdminParams) (int64, error)
+
+	CreateRefreshToken(ctx context.Context, arg database.CreateRefreshTokenParams) (database.RefreshToken, error)
+	GetRefreshTokenByValue(ctx context.Context, token string) (database.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, token string) error
+	RotateRefreshToken(ctx context.Context, arg database.RotateRefreshTokenParams) (database.RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error
+
+	CreatePasswordResetToken(ctx context.Context, arg database.CreatePasswordResetTokenParams) error
+	ConsumePasswordResetToken(ctx context.Context, arg database.ConsumePasswordResetTokenParams) (uuid.UUID, error)
+	InvalidatePasswordResetTokens(ctx context.Context, arg database.InvalidatePasswordResetTokensParams) error
+
+	VerifyUserEmail(ctx context.Context, arg database.VerifyUserEmailParams) (database.User, error)
+	CreateEmailVerificationToken(ctx context.Context, arg database.CreateEmailVerificationTokenParams) error
+	ConsumeEmailVerificationToken(ctx context.Context, arg database.ConsumeEmailVerificationTokenParams) (database.ConsumeEmailVerificationTokenRow, error)
+	InvalidateEmailVerificationTokens(ctx context.Context, arg database.InvalidateEmailVerificationTokensParams) error
+
+	UpsertUserTOTP(ctx context.Context, arg database.UpsertUserTOTPParams) error
+	GetUserTOTP(ctx context.Context, userID uuid.UUID) (database.UserTotp, error)
+	ConfirmUserTOTP(ctx context.Context, arg database.ConfirmUserTOTPParams) error
+	UseTOTPStep(ctx context.Context, arg database.UseTOTPStepParams) (int64, error)
+	DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error
+	CreateTOTPRecoveryCode(ctx context.Context, arg database.CreateTOTPRecoveryCodeParams) error
+	UseTOTPRecoveryCode(ctx context.Context, arg database.UseTOTPRecoveryCodeParams) (int64, error)
+	DeleteTOTPRecoveryCodes(ctx context.Context, userID uuid.UUID) error
+
+	GetLoginFailure(ctx context.Context, arg database.GetLoginFailureParams) (database.LoginFailure, error)
+	RecordLoginAttempt(ctx context.Context, arg database.RecordLoginAttemptParams) (database.LoginFailure, error)
+	ForgiveLoginAttempt(ctx context.Context, arg database.ForgiveLoginAttemptParams) error
+	ClearLoginFailures(ctx context.Context, arg database.ClearLoginFailuresParams) error
+
+	CreatePersonalAccessToken(ctx context.Context, arg database.CreatePersonalAccessTokenParams) (database.PersonalAccessToken, error)
+	GetPersonalAccessTokenByHash(ctx context.Context, tokenHash string) (database.PersonalAccessToken, error)
+	ListPersonalAccessTokens(ctx context.Context, userID uuid.UUID) ([]database.PersonalAccessToken, error)
+	TouchPersonalAccessToken(ctx context.Context, arg database.TouchPersonalAccessTokenParams) error
+	RevokePersonalAccessToken(ctx context.Context, arg database.RevokePersonalAccessTokenParams) (int64, error)
+	RevokeUserPersonalAccessTokens(ctx context.Context, arg database.RevokeUserPersonalAccessTokensParams) error
+
+	GetSubscription(ctx context.Context, userID uuid.UUID) (database.Subscription, error)
+	SaveSubscription(ctx context.Context, arg database.SaveSubscriptionParams) (database.Subscription, error)
+	ExpireLapsedSubscriptions(ctx context.Context, arg database.ExpireLapsedSubscriptionsParams) ([]database.Subscription, error)
+	ListSubscriptionEvents(ctx context.Context, userID uuid.UUID) ([]database.SubscriptionEvent, error)
+
+	CreatePolkaEvent(ctx context.Context, arg database.CreatePolkaEventParams) (int64, error)
+	GetPolkaEvent(ctx context.Context, id string) (database.PolkaEvent, error)
+	ListPolkaEvents(ctx context.Context, arg database.ListPolkaEventsParams) ([]database.PolkaEvent, error)
+	ClaimPolkaEvent(ctx context.Context, arg database.ClaimPolkaEventParams) (database.PolkaEvent, error)
+	FinishPolkaEvent(ctx context.Context, arg database.FinishPolkaEventParams) (database.PolkaEvent, error)
+
+	CreateSession(ctx context.Context, arg database.CreateSessionParams) (database.Session, error)
+	ListActiveSessions(ctx context.Context, arg database.ListActiveSessionsParams) ([]database.ListActiveSessionsRow, error)
+	RevokeSession(ctx context.Context, arg database.RevokeSessionParams) (int64, error)
+	RevokeUserSessions(ctx context.Context, arg database.RevokeUserSessionsParams) error
+	IsSessionActive(ctx context.Context, arg database.IsSessionActiveParams) (bool, error)
+}
+
+var _ Store = (*database.Queries)(nil)
+
+func NewPostgres(db *sql.DB) Store {
+	return database.New(db)
+}
@@ -1,66 +1,361 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-	"github.com/rQxwX3/chirpy/internal/database"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/mailer"
+	"github.com/rQxwX3/chirpy/internal/moderation"
+	"github.com/rQxwX3/chirpy/internal/ratelimit"
+	"github.com/rQxwX3/chirpy/internal/store"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout bounds how long in-flight requests get to finish once the
+// server is asked to stop.
+const shutdownTimeout = 30 * time.Second
+
 type apiConfig struct {
-	fileserverHits atomic.Int32
-	db             *database.Queries
-	platform       string
-	jwtSecret      string
-	polkaKey       string
+	fileserverHits      atomic.Int32
+	db                  store.Store
+	platform            string
+	jwtKeys             *auth.Keyring
+	totpBox             *auth.SecretBox
+	polkaKey            string
+	polkaWebhookSecret  string
+	mailer              mailer.Mailer
+	limiter             ratelimit.Limiter
+	publicURL           string
+	moderator           *moderation.Pipeline
+	moderationFileRules []moderation.Rule
+	moderationMu        sync.Mutex
+	chirpLimits         chirpLimits
+	// background tracks work that outlives the request that started it.
+	background sync.WaitGroup
 }
 
 func main() {
 	godotenv.Load()
 
-	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+	cfg := apiConfig{
+		platform:           os.Getenv("PLATFORM"),
+		polkaKey:           os.Getenv("POLKA_KEY"),
+		polkaWebhookSecret: os.Getenv("POLKA_WEBHOOK_SECRET"),
+		publicURL:          os.Getenv("PUBLIC_URL"),
+	}
+
+	if cfg.polkaWebhookSecret == "" {
+		log.Printf("POLKA_WEBHOOK_SECRET is not set, Polka webhooks are checked against POLKA_KEY only")
+	}
+
+	if cfg.publicURL == "" {
+		cfg.publicURL = "http://localhost:8080"
+	}
+
+	jwtKeys, err := loadJWTKeys()
 	if err != nil {
-		log.Fatalf("Eror")
-		log.Fatalf("Error connecting to the database: %s", err)
+		log.Fatalf("Error loading JWT keys: %s", err)
 	}
 
-	cfg := apiConfig{
-		db:        database.New(db),
-		platform:  os.Getenv("PLATFORM"),
-		jwtSecret: os.Getenv("JWTSECRET"),
-		polkaKey:  os.Getenv("POLKA_KEY"),
+	cfg.jwtKeys = jwtKeys
+
+	cfg.totpBox, err = loadTOTPBox()
+	if err != nil {
+		log.Fatalf("Error loading TOTP_ENCRYPTION_KEY: %s", err)
 	}
 
-	mux := http.NewServeMux()
+	cfg.mailer, err = loadMailer()
+	if err != nil {
+		log.Fatalf("Error configuring mailer: %s", err)
+	}
 
-	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
-	mux.Handle("/app/", cfg.middlewareMetricsInc(fsHandler))
+	cfg.chirpLimits, err = loadChirpLimits()
+	if err != nil {
+		log.Fatalf("Error loading chirp limits: %s", err)
+	}
 
-	mux.HandleFunc("GET /api/healthz", handlerHealth)
-	mux.HandleFunc("GET /admin/metrics", cfg.handlerMetrics)
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
-	mux.HandleFunc("POST /api/users", cfg.handlerCreateUser)
-	mux.HandleFunc("POST /api/chirps", cfg.handlerCreateChirp)
-	mux.HandleFunc("GET /api/chirps", cfg.handlerGetChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.handlerGetChirpByID)
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
-	mux.HandleFunc("PUT /api/users", cfg.handlerUpdateUser)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", cfg.handlerDeleteChirp)
-	mux.HandleFunc("POST /api/polka/webhooks", cfg.handlerUpgradeUserToRed)
+	switch os.Getenv("STORE") {
+	case "memory":
+		cfg.db = store.NewMemory()
+		cfg.limiter = ratelimit.NewMemory()
+		log.Printf("Using in-memory store")
+	case "", "postgres":
+		db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+		if err != nil {
+			log.Fatalf("Error connecting to the database: %s", err)
+		}
+
+		cfg.db = store.NewPostgres(db)
+		cfg.limiter = ratelimit.NewPostgres(db)
+	default:
+		log.Fatalf("Unknown STORE value %q, expected postgres or memory", os.Getenv("STORE"))
+	}
+
+	if len(os.Args) > 1 {
+		if err := cfg.runCommand(context.Background(), os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if rulesFile := os.Getenv("MODERATION_RULES_FILE"); rulesFile != "" {
+		rules, err := moderation.LoadRulesFile(rulesFile)
+		if err != nil {
+			log.Fatalf("Error loading moderation rules: %s", err)
+		}
+
+		cfg.moderationFileRules = rules
+	}
+
+	cfg.moderator = moderation.NewPipeline()
+	if err := cfg.reloadModeration(context.Background()); err != nil {
+		log.Fatalf("Error loading moderation words: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go cfg.runModerationReload(ctx, moderationReloadInterval)
+	go cfg.runSubscriptionExpiry(ctx, subscriptionExpiryInterval)
 
 	server := http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: cfg.routes(),
 	}
 
-	err = server.ListenAndServe()
-	if err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Server error: %v", err)
+	case <-ctx.Done():
+	}
+
+	stop()
+	log.Printf("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down server: %s", err)
+	}
+
+	// Password reset mails are sent after their request has been answered,
+	// so they may still be on their way.
+	cfg.background.Wait()
+}
+
+// loadJWTKeys builds the keyring from JWTSECRET, which signs tokens without a
+// kid as before, and the <kid>.pem files in JWT_KEYS_DIR. JWT_ACTIVE_KID picks
+// the key new tokens are signed with when there is more than one.
+// JWT_ISSUER, JWT_AUDIENCE and JWT_LEEWAY override the claim checks.
+func loadJWTKeys() (*auth.Keyring, error) {
+	keys := auth.NewKeyring()
+
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		keys.Issuer = issuer
+	}
+
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		keys.Audience = audience
+	}
+
+	if leeway := os.Getenv("JWT_LEEWAY"); leeway != "" {
+		duration, err := time.ParseDuration(leeway)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWT_LEEWAY: %w", err)
+		}
+
+		keys.Leeway = duration
 	}
+
+	if secret := os.Getenv("JWTSECRET"); secret != "" {
+		if err := keys.Add(auth.NewHMACKey("", []byte(secret))); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		if err := keys.LoadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if kid := os.Getenv("JWT_ACTIVE_KID"); kid != "" {
+		if err := keys.SetActive(kid); err != nil {
+			return nil, err
+		}
+	}
+
+	if !keys.CanSign() {
+		return nil, errors.New("No signing key, set JWTSECRET or add a private key to JWT_KEYS_DIR")
+	}
+
+	return keys, nil
+}
+
+// loadTOTPBox reads the key TOTP secrets are encrypted with at rest, 32 bytes
+// in base64. Without it users cannot enroll in two-factor authentication.
+func loadTOTPBox() (*auth.SecretBox, error) {
+	encoded := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if encoded == "" {
+		log.Printf("TOTP_ENCRYPTION_KEY is not set, two-factor authentication is disabled")
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.NewSecretBox(key)
+}
+
+// loadMailer sends mail through SMTP_ADDR when it is set. Otherwise mail is
+// written to MAIL_OUTBOX_DIR, or to the log if that is not set either.
+func loadMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@localhost>"
+	}
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return mailer.NewSMTP(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")), nil
+	}
+
+	if dir := os.Getenv("MAIL_OUTBOX_DIR"); dir != "" {
+		log.Printf("Writing outgoing mail to %s", dir)
+		return mailer.NewFileOutbox(dir, from)
+	}
+
+	log.Printf("SMTP_ADDR is not set, outgoing mail is logged")
+	return mailer.Log{}, nil
+}
+
+// loadChirpLimits reads the maximum chirp length of standard and Chirpy Red
+// accounts from CHIRP_MAX_LENGTH and CHIRP_MAX_LENGTH_RED.
+func loadChirpLimits() (chirpLimits, error) {
+	limits := defaultChirpLimits
+
+	for env, limit := range map[string]*int{
+		"CHIRP_MAX_LENGTH":     &limits.standard,
+		"CHIRP_MAX_LENGTH_RED": &limits.red,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return chirpLimits{}, fmt.Errorf("Invalid %s %q, expected a positive number", env, value)
+		}
+
+		*limit = n
+	}
+
+	return limits, nil
+}
+
+// Rate limits for the routes most worth abusing. Signed-in callers are
+// counted per user, everyone else per client IP.
+var (
+	loginRateLimit         = ratelimit.Policy{Name: "login", Limit: 10, Window: time.Minute}
+	signupRateLimit        = ratelimit.Policy{Name: "signup", Limit: 5, Window: time.Hour}
+	passwordResetRateLimit = ratelimit.Policy{Name: "password-reset", Limit: 5, Window: time.Hour}
+	chirpRateLimit         = ratelimit.Policy{Name: "chirps", Limit: 30, Window: time.Minute}
+)
+
+func (cfg *apiConfig) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
+	mux.Handle("/app/", cfg.middlewareMetricsInc(fsHandler))
+
+	requireAuth := func(scope, pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, cfg.middlewareRequireAuth(scope, handler))
+	}
+	optionalAuth := func(scope, pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, cfg.middlewareOptionalAuth(scope, handler))
+	}
+	requireRole := func(role, pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, cfg.middlewareRequireRole(role, handler))
+	}
+	rateLimit := func(policy ratelimit.Policy, handler http.HandlerFunc) http.HandlerFunc {
+		return cfg.middlewareRateLimit(policy, handler).ServeHTTP
+	}
+
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+	mux.HandleFunc("GET /api/healthz", handlerHealth)
+	requireRole(roleAdmin, "GET /admin/metrics", cfg.handlerMetrics)
+	requireRole(roleAdmin, "POST /admin/reset", cfg.handlerReset)
+	requireRole(roleAdmin, "GET /admin/users/{userID}/roles", cfg.handlerListUserRoles)
+	requireRole(roleAdmin, "PUT /admin/users/{userID}/roles/{role}", cfg.handlerGrantUserRole)
+	requireRole(roleAdmin, "DELETE /admin/users/{userID}/roles/{role}", cfg.handlerRevokeUserRole)
+	requireRole(roleAdmin, "POST /admin/users/{userID}/unlock", cfg.handlerUnlockUser)
+	requireRole(roleAdmin, "GET /admin/polka/events", cfg.handlerListPolkaEvents)
+	requireRole(roleAdmin, "GET /admin/polka/events/{eventID}", cfg.handlerGetPolkaEvent)
+	requireRole(roleAdmin, "POST /admin/polka/events/{eventID}/rerun", cfg.handlerRerunPolkaEvent)
+	requireRole(roleModerator, "GET /admin/moderation/words", cfg.handlerListModerationWords)
+	requireRole(roleModerator, "POST /admin/moderation/words", cfg.handlerPutModerationWord)
+	requireRole(roleModerator, "DELETE /admin/moderation/words/{word}", cfg.handlerDeleteModerationWord)
+	requireRole(roleModerator, "GET /admin/moderation/flags", cfg.handlerListChirpFlags)
+	mux.HandleFunc("POST /api/users", rateLimit(signupRateLimit, cfg.handlerCreateUser))
+	requireAuth(scopeSessionOnly, "PUT /api/users", cfg.handlerUpdateUser)
+	mux.HandleFunc("GET /api/users/verify", cfg.handlerVerifyEmail)
+	requireAuth(scopeSessionOnly, "POST /api/users/verify", cfg.handlerResendEmailVerification)
+	mux.HandleFunc("POST /api/login", rateLimit(loginRateLimit, cfg.handlerLogin))
+	mux.HandleFunc("POST /api/login/mfa", rateLimit(loginRateLimit, cfg.handlerLoginMFA))
+	requireAuth(scopeSessionOnly, "POST /api/users/mfa/totp", cfg.handlerEnrollTOTP)
+	requireAuth(scopeSessionOnly, "POST /api/users/mfa/totp/confirm", cfg.handlerConfirmTOTP)
+	requireAuth(scopeSessionOnly, "DELETE /api/users/mfa/totp", cfg.handlerDisableTOTP)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.HandleFunc("POST /api/password/forgot", rateLimit(passwordResetRateLimit, cfg.handlerForgotPassword))
+	mux.HandleFunc("POST /api/password/reset", cfg.handlerResetPassword)
+	requireAuth(scopeChirpsWrite, "POST /api/chirps", rateLimit(chirpRateLimit, cfg.handlerCreateChirp))
+	optionalAuth(scopeChirpsRead, "GET /api/chirps", cfg.handlerGetChirps)
+	optionalAuth(scopeChirpsRead, "GET /api/chirps/{chirpID}", cfg.handlerGetChirpByID)
+	requireAuth(scopeChirpsWrite, "PUT /api/chirps/{chirpID}", cfg.handlerUpdateChirp)
+	requireAuth(scopeChirpsWrite, "DELETE /api/chirps/{chirpID}", cfg.handlerDeleteChirp)
+	mux.HandleFunc("GET /api/chirps/{chirpID}/revisions", cfg.handlerGetChirpRevisions)
+	mux.HandleFunc("GET /api/chirps/{chirpID}/thread", cfg.handlerGetChirpThread)
+	requireAuth(scopeChirpsWrite, "POST /api/chirps/{chirpID}/likes", cfg.handlerLikeChirp)
+	requireAuth(scopeChirpsWrite, "DELETE /api/chirps/{chirpID}/likes", cfg.handlerUnlikeChirp)
+	requireAuth(scopeChirpsWrite, "POST /api/chirps/{chirpID}/rechirps", cfg.handlerRechirpChirp)
+	requireAuth(scopeChirpsWrite, "DELETE /api/chirps/{chirpID}/rechirps", cfg.handlerUnrechirpChirp)
+	mux.HandleFunc("POST /api/polka/webhooks", cfg.handlerPolkaWebhook)
+	requireAuth(scopeSessionOnly, "GET /api/users/me/subscription", cfg.handlerGetSubscription)
+	requireAuth(scopeFollowsWrite, "POST /api/users/{userID}/follow", cfg.handlerFollowUser)
+	requireAuth(scopeFollowsWrite, "DELETE /api/users/{userID}/follow", cfg.handlerUnfollowUser)
+	mux.HandleFunc("GET /api/users/{userID}/followers", cfg.handlerListFollowers)
+	mux.HandleFunc("GET /api/users/{userID}/following", cfg.handlerListFollowing)
+	requireAuth(scopeChirpsRead, "GET /api/timeline", cfg.handlerGetTimeline)
+	requireAuth(scopeSessionOnly, "GET /api/sessions", cfg.handlerListSessions)
+	requireAuth(scopeSessionOnly, "DELETE /api/sessions/{sessionID}", cfg.handlerRevokeSession)
+	requireAuth(scopeSessionOnly, "POST /api/sessions/revoke-all", cfg.handlerRevokeAllSessions)
+	requireAuth(scopeSessionOnly, "POST /api/tokens", cfg.handlerCreatePersonalToken)
+	requireAuth(scopeSessionOnly, "GET /api/tokens", cfg.handlerListPersonalTokens)
+	requireAuth(scopeSessionOnly, "DELETE /api/tokens/{tokenID}", cfg.handlerRevokePersonalToken)
+
+	return middlewareRequestID(mux)
 }
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"github.com/rQxwX3/chirpy/internal/ratelimit"
+	"log"
+	"math"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 )
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -11,3 +24,236 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		next.ServeHTTP(w, req)
 	})
 }
+
+type requestIDContextKey struct{}
+
+// middlewareRequestID gives every request an ID, echoed in the X-Request-ID
+// response header and in error bodies so a client's report can be matched to
+// the logs. An ID set by a proxy in front is kept when it looks sane.
+func middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := context.WithValue(req.Context(), requestIDContextKey{}, requestID)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+
+	for _, c := range requestID {
+		isAlnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !isAlnum && !strings.ContainsRune("-_.:", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func requestIDFromRequest(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+type authContextKey struct{}
+
+// requestAuth is the caller the auth middlewares put into the request
+// context. sessionID is uuid.Nil for tokens not issued at login, and scopes
+// only apply to personal access tokens.
+type requestAuth struct {
+	user          database.User
+	sessionID     uuid.UUID
+	personalToken bool
+	scopes        []string
+}
+
+// allows reports whether the caller may use a route needing scope. Access
+// tokens from a login can do anything their user can.
+func (a requestAuth) allows(scope string) bool {
+	if !a.personalToken {
+		return true
+	}
+
+	return scope != scopeSessionOnly && slices.Contains(a.scopes, scope)
+}
+
+func authFromRequest(r *http.Request) (requestAuth, bool) {
+	caller, ok := r.Context().Value(authContextKey{}).(requestAuth)
+	return caller, ok
+}
+
+// errAuthUnavailable wraps store errors met while authenticating, which say
+// nothing about the credentials and are answered with 500 rather than 401.
+var errAuthUnavailable = errors.New("Authentication unavailable")
+
+func authUnavailable(err error) error {
+	return fmt.Errorf("%w: %w", errAuthUnavailable, err)
+}
+
+func (cfg *apiConfig) authenticate(r *http.Request) (requestAuth, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return requestAuth{}, err
+	}
+
+	if auth.IsPersonalAccessToken(token) {
+		return cfg.authenticatePersonalToken(r.Context(), token)
+	}
+
+	accessToken, err := cfg.jwtKeys.ValidateAccessToken(token)
+	if err != nil {
+		return requestAuth{}, err
+	}
+
+	// Revoking a session only revokes its refresh tokens, so its access
+	// tokens are checked against them too.
+	if accessToken.SessionID != uuid.Nil {
+		active, err := cfg.db.IsSessionActive(r.Context(), database.IsSessionActiveParams{
+			FamilyID: accessToken.SessionID,
+			Now:      time.Now().UTC(),
+		})
+		if err != nil {
+			return requestAuth{}, authUnavailable(err)
+		}
+		if !active {
+			return requestAuth{}, errors.New("Session has been revoked")
+		}
+	}
+
+	user, err := cfg.db.GetUserByID(r.Context(), accessToken.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return requestAuth{}, errors.New("User not found")
+	}
+	if err != nil {
+		return requestAuth{}, authUnavailable(err)
+	}
+
+	return requestAuth{user: user, sessionID: accessToken.SessionID}, nil
+}
+
+// middlewareRequireAuth rejects requests without a valid access token for an
+// existing user, and personal access tokens lacking scope.
+func (cfg *apiConfig) middlewareRequireAuth(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		caller, err := cfg.authenticate(req)
+		if errors.Is(err, errAuthUnavailable) {
+			respondWithError(w, req, 500, errCodeInternal, "")
+			log.Printf("Error authenticating request: %s", err)
+			return
+		}
+		if err != nil {
+			writeUnauthorized(w, req, err)
+			log.Printf("Error authenticating request: %s", err)
+			return
+		}
+
+		if !caller.allows(scope) {
+			writeInsufficientScope(w, req, scope)
+			log.Printf("Error authenticating request: token lacks scope %q", scope)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), authContextKey{}, caller)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// middlewareOptionalAuth lets every request through and adds the caller when
+// it carries a valid access token. Invalid tokens, and personal access tokens
+// lacking scope, are treated as anonymous; store errors are not.
+func (cfg *apiConfig) middlewareOptionalAuth(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		caller, err := cfg.authenticate(req)
+		if errors.Is(err, errAuthUnavailable) {
+			respondWithError(w, req, 500, errCodeInternal, "")
+			log.Printf("Error authenticating request: %s", err)
+			return
+		}
+		if err != nil || !caller.allows(scope) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), authContextKey{}, caller)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// middlewareRequireRole lets through authenticated callers holding role. Roles
+// are read from the database rather than the token, so revoking one takes
+// effect before the caller's access token expires.
+func (cfg *apiConfig) middlewareRequireRole(role string, next http.Handler) http.Handler {
+	return cfg.middlewareRequireAuth(scopeSessionOnly, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		caller, _ := authFromRequest(req)
+
+		roles, err := cfg.userRoles(req.Context(), caller.user.ID)
+		if err != nil {
+			respondWithError(w, req, 500, errCodeInternal, "")
+			log.Printf("Error querying database for roles: %s", err)
+			return
+		}
+
+		if !hasRole(roles, role) {
+			respondWithError(w, req, 403, errCodeForbidden, fmt.Sprintf("This needs the %s role", role))
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	}))
+}
+
+// middlewareRateLimit takes a token from the caller's bucket for policy,
+// keyed by user when the request is authenticated and by client IP otherwise.
+// When the limiter fails the request is let through rather than refused.
+func (cfg *apiConfig) middlewareRateLimit(policy ratelimit.Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if cfg.limiter == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		key := "ip:" + clientIP(req)
+		if caller, ok := authFromRequest(req); ok {
+			key = "user:" + caller.user.ID.String()
+		}
+
+		decision, err := cfg.limiter.Allow(req.Context(), key, policy)
+		if err != nil {
+			log.Printf("Error checking rate limit: %s", err)
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("RateLimit-Policy", policy.String())
+		w.Header().Set("RateLimit-Limit", fmt.Sprint(decision.Limit))
+		w.Header().Set("RateLimit-Remaining", fmt.Sprint(decision.Remaining))
+		w.Header().Set("RateLimit-Reset", fmt.Sprint(ceilSeconds(decision.Reset)))
+
+		if !decision.Allowed {
+			w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(decision.RetryAfter)))
+			respondWithError(w, req, 429, errCodeRateLimited, "Too many requests, slow down")
+			log.Printf("Error handling request: rate limit %s exceeded by %s", policy.Name, key)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rQxwX3/chirpy/internal/database"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// encodeCursor produces an opaque cursor pointing at a row in a listing
+// ordered by (created_at, id).
+func encodeCursor(createdAt time.Time, id uuid.UUID) string {
+	raw := createdAt.Format(time.RFC3339Nano) + "," + id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errors.New("Malformed cursor")
+	}
+
+	createdAtString, idString, found := strings.Cut(string(raw), ",")
+	if !found {
+		return time.Time{}, uuid.Nil, errors.New("Malformed cursor")
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, createdAtString)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errors.New("Malformed cursor timestamp")
+	}
+
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		return time.Time{}, uuid.Nil, errors.New("Malformed cursor ID")
+	}
+
+	return createdAt, id, nil
+}
+
+type page struct {
+	limit           int32
+	cursorCreatedAt sql.NullTime
+	cursorID        uuid.NullUUID
+}
+
+func parsePage(query url.Values) (page, error) {
+	limit, err := parsePageLimit(query.Get("limit"))
+	if err != nil {
+		return page{}, err
+	}
+
+	p := page{limit: limit}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			return page{}, fieldError{Field: "cursor", Code: fieldCodeInvalid, Message: err.Error()}
+		}
+
+		p.cursorCreatedAt = sql.NullTime{Time: createdAt, Valid: true}
+		p.cursorID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	return p, nil
+}
+
+// trimPage drops the look-ahead row that listings fetch past the page limit
+// and returns the cursor of the following page, or "" on the last page.
+func trimPage(chirps []database.Chirp, limit int32) ([]database.Chirp, string) {
+	if len(chirps) <= int(limit) {
+		return chirps, ""
+	}
+
+	chirps = chirps[:limit]
+	last := chirps[len(chirps)-1]
+
+	return chirps, encodeCursor(last.CreatedAt, last.ID)
+}
+
+func parsePageLimit(limitString string) (int32, error) {
+	if limitString == "" {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(limitString)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fieldError{Field: "limit", Code: fieldCodeInvalid,
+			Message: fmt.Sprintf("Must be an integer between 1 and %d", maxPageLimit),
+		}
+	}
+
+	return int32(limit), nil
+}
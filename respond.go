@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Error codes tell clients what went wrong independently of the status and
+// the wording of the detail. They are part of the API and must not change.
+const (
+	errCodeInternal             = "internal_error"
+	errCodeUnavailable          = "service_unavailable"
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeInvalidJSON          = "invalid_json"
+	errCodeBodyTooLarge         = "request_too_large"
+	errCodeUnsupportedMediaType = "unsupported_media_type"
+	errCodeValidation           = "validation_failed"
+	errCodeUnauthorized         = "unauthorized"
+	errCodeInvalidCredentials   = "invalid_credentials"
+	errCodeInvalidToken         = "invalid_token"
+	errCodeInvalidMFACode       = "invalid_mfa_code"
+	errCodeForbidden            = "forbidden"
+	errCodeInsufficientScope    = "insufficient_scope"
+	errCodeNotFound             = "not_found"
+	errCodeEmailTaken           = "email_taken"
+	errCodeEmailVerified        = "email_already_verified"
+	errCodeMFAEnabled           = "mfa_already_enabled"
+	errCodeMFANotEnrolled       = "mfa_not_enrolled"
+	errCodeLastAdmin            = "last_admin"
+	errCodeLoginThrottled       = "login_throttled"
+	errCodeRateLimited          = "rate_limited"
+	errCodeEventNotRetryable    = "event_not_retryable"
+)
+
+// Field codes say what was wrong with a single field of a rejected request.
+const (
+	fieldCodeRequired = "required"
+	fieldCodeInvalid  = "invalid"
+	fieldCodeTooLong  = "too_long"
+	fieldCodeRejected = "rejected"
+	fieldCodeNotFound = "not_found"
+	fieldCodeUnknown  = "unknown"
+)
+
+// problem is an RFC 9457 problem details object. Code, RequestID and Errors
+// are extension members.
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+// fieldError explains why one field of a request was rejected. It is an
+// error itself, so validation helpers can return it as one. Length and Limit
+// are set for too_long fields.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Length  int    `json:"length,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+func (e fieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func respondWithJSON(w http.ResponseWriter, status int, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("Error marshalling JSON: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// respondWithError answers with a problem details object. Detail is shown to
+// the client, so it must not carry internal errors; those go to the log.
+func respondWithError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblem(w, r, problem{Status: status, Code: code, Detail: detail})
+}
+
+// respondWithValidationError answers 400 to a request rejected by err,
+// listing the offending fields when err is a fieldError or validationErrors.
+func respondWithValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	var fieldErrs validationErrors
+	var fieldErr fieldError
+
+	switch {
+	case errors.As(err, &fieldErrs):
+	case errors.As(err, &fieldErr):
+		fieldErrs = validationErrors{fieldErr}
+	default:
+		respondWithError(w, r, 400, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	detail := fmt.Sprintf("%d fields are invalid", len(fieldErrs))
+	if len(fieldErrs) == 1 {
+		detail = fieldErrs[0].Error()
+	}
+
+	writeProblem(w, r, problem{
+		Status: 400,
+		Code:   errCodeValidation,
+		Detail: detail,
+		Errors: fieldErrs,
+	})
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestIDFromRequest(r)
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("Error marshalling JSON: %s", err)
+		return
+	}
+
+	// Lets server errors be matched to the message the handler logs with them.
+	if p.Status >= 500 {
+		log.Printf("Error handling %s %s: request_id=%s status=%d", r.Method, r.URL.Path, p.RequestID, p.Status)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(data)
+}
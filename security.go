@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rQxwX3/chirpy/internal/auth"
+	"log"
+	"net"
+	"net/http"
+)
+
+// logSecurityEvent writes events operators should be alerted to with a fixed
+// prefix, so they can be filtered out of the regular request log.
+func logSecurityEvent(r *http.Request, event string, format string, args ...any) {
+	log.Printf("SECURITY %s request_id=%s remote_addr=%q user_agent=%q: %s",
+		event, requestIDFromRequest(r), r.RemoteAddr, r.UserAgent(), fmt.Sprintf(format, args...))
+}
+
+// clientIP returns the address of the peer the request came from, without
+// the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// writeUnauthorized answers 401 with a bearer challenge. Rejected tokens get
+// an invalid_token error naming the reason, as described in RFC 6750;
+// requests without credentials get the bare challenge.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	challenge := `Bearer realm="chirpy"`
+	code, detail := errCodeUnauthorized, "Authentication required"
+
+	var tokenErr auth.TokenError
+	if errors.As(err, &tokenErr) {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, tokenErr.Error())
+		code, detail = errCodeInvalidToken, tokenErr.Error()
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, r, 401, code, detail)
+}
+
+// writeInsufficientScope answers 403 to a token that is valid but was not
+// granted scope, as described in RFC 6750.
+func writeInsufficientScope(w http.ResponseWriter, r *http.Request, scope string) {
+	challenge := `Bearer realm="chirpy", error="insufficient_scope"`
+	detail := "Personal access tokens cannot be used here"
+	if scope != scopeSessionOnly {
+		challenge += fmt.Sprintf(`, scope=%q`, scope)
+		detail = fmt.Sprintf("Token lacks the %s scope", scope)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, r, 403, errCodeInsufficientScope, detail)
+}
@@ -1,23 +1,77 @@
 -- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id) 
+WITH parent AS (
+	UPDATE chirps
+	SET reply_count = reply_count + 1
+	WHERE id = $6
+)
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, in_reply_to)
 VALUES (
 	$1,
 	$2,
 	$3,
 	$4,
-	$5
+	$5,
+	$6
 ) RETURNING *;
 
--- name: GetAllChirps :many
-SELECT * FROM chirps
-ORDER BY created_at ASC;
-
 -- name: GetChirpByID :one
 SELECT * FROM chirps
 WHERE id = $1;
 
 -- name: DeleteChirp :exec
-DELETE FROM chirps WHERE id = $1;
+WITH deleted AS (
+	DELETE FROM chirps WHERE id = $1
+	RETURNING in_reply_to
+)
+UPDATE chirps
+SET reply_count = reply_count - 1
+WHERE id = (SELECT in_reply_to FROM deleted);
+
+-- name: ListChirpsAsc :many
+SELECT * FROM chirps
+WHERE (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id'))
+AND (
+	sqlc.narg('cursor_created_at')::timestamp IS NULL
+	OR (created_at, id) > (sqlc.narg('cursor_created_at'), sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg('limit');
 
--- name: GetChirpsByAuthorID :many
-SELECT * FROM chirps WHERE user_id = $1;
+-- name: ListChirpsDesc :many
+SELECT * FROM chirps
+WHERE (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id'))
+AND (
+	sqlc.narg('cursor_created_at')::timestamp IS NULL
+	OR (created_at, id) < (sqlc.narg('cursor_created_at'), sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('limit');
+
+-- name: UpdateChirpBody :one
+WITH previous AS (
+	INSERT INTO chirp_revisions (id, chirp_id, body, created_at, replaced_at)
+	SELECT sqlc.arg('revision_id'), id, body, updated_at, sqlc.arg('updated_at')
+	FROM chirps
+	WHERE id = sqlc.arg('id')
+	FOR UPDATE
+)
+UPDATE chirps
+SET body = sqlc.arg('body'), updated_at = sqlc.arg('updated_at')
+WHERE id = sqlc.arg('id')
+RETURNING *;
+
+-- name: GetChirpThread :many
+WITH RECURSIVE ancestors AS (
+	SELECT c.id, c.in_reply_to FROM chirps c WHERE c.id = $1
+	UNION
+	SELECT c.id, c.in_reply_to FROM chirps c
+	JOIN ancestors a ON c.id = a.in_reply_to
+), descendants AS (
+	SELECT c.id FROM chirps c WHERE c.id = $1
+	UNION
+	SELECT c.id FROM chirps c
+	JOIN descendants d ON c.in_reply_to = d.id
+)
+SELECT * FROM chirps
+WHERE id IN (SELECT id FROM ancestors UNION SELECT id FROM descendants)
+ORDER BY created_at ASC, id ASC;
@@ -0,0 +1,16 @@
+-- name: CreateEmailVerificationToken :exec
+INSERT INTO email_verification_tokens (token_hash, user_id, email, created_at, expires_at)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: ConsumeEmailVerificationToken :one
+UPDATE email_verification_tokens
+SET used_at = sqlc.arg('now')
+WHERE token_hash = sqlc.arg('token_hash')
+AND used_at IS NULL
+AND expires_at > sqlc.arg('now')
+RETURNING user_id, email;
+
+-- name: InvalidateEmailVerificationTokens :exec
+UPDATE email_verification_tokens
+SET used_at = $2
+WHERE user_id = $1 AND used_at IS NULL;
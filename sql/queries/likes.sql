@@ -0,0 +1,53 @@
+-- Counters are updated in the same statement as the row they count, and only
+-- by the number of rows actually inserted or deleted, so repeated and
+-- concurrent requests leave them consistent.
+
+-- name: LikeChirp :one
+WITH inserted AS (
+	INSERT INTO chirp_likes (chirp_id, user_id, created_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (chirp_id, user_id) DO NOTHING
+	RETURNING chirp_id
+)
+UPDATE chirps
+SET like_count = like_count + (SELECT COUNT(*) FROM inserted)
+WHERE id = $1
+RETURNING *;
+
+-- name: UnlikeChirp :one
+WITH deleted AS (
+	DELETE FROM chirp_likes
+	WHERE chirp_id = $1 AND user_id = $2
+	RETURNING chirp_id
+)
+UPDATE chirps
+SET like_count = like_count - (SELECT COUNT(*) FROM deleted)
+WHERE id = $1
+RETURNING *;
+
+-- name: ListLikedChirpIDs :many
+SELECT chirp_id FROM chirp_likes
+WHERE user_id = $1 AND chirp_id = ANY(sqlc.arg('chirp_ids')::uuid[]);
+
+-- name: RechirpChirp :one
+WITH inserted AS (
+	INSERT INTO rechirps (chirp_id, user_id, created_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (chirp_id, user_id) DO NOTHING
+	RETURNING chirp_id
+)
+UPDATE chirps
+SET rechirp_count = rechirp_count + (SELECT COUNT(*) FROM inserted)
+WHERE id = $1
+RETURNING *;
+
+-- name: UnrechirpChirp :one
+WITH deleted AS (
+	DELETE FROM rechirps
+	WHERE chirp_id = $1 AND user_id = $2
+	RETURNING chirp_id
+)
+UPDATE chirps
+SET rechirp_count = rechirp_count - (SELECT COUNT(*) FROM deleted)
+WHERE id = $1
+RETURNING *;
@@ -0,0 +1,43 @@
+-- name: GetLoginFailure :one
+SELECT * FROM login_failures
+WHERE scope = $1 AND subject = $2;
+
+-- name: RecordLoginAttempt :one
+-- Counts an attempt as failed before its credentials are checked and blocks
+-- the subject as the schedule says in the same statement, so parallel
+-- attempts cannot all get past a block that is still to be set. A blocked
+-- subject is left alone and no row is returned. schedule[n] is the block in
+-- seconds after n failures; its last entry applies beyond.
+INSERT INTO login_failures AS f (scope, subject, failures, last_failed_at, blocked_until)
+VALUES (
+	sqlc.arg('scope'), sqlc.arg('subject'), 1, sqlc.arg('now'),
+	sqlc.arg('now') + (sqlc.arg('schedule')::integer[])[1] * INTERVAL '1 second'
+)
+ON CONFLICT (scope, subject) DO UPDATE
+SET (failures, last_failed_at, blocked_until) = (
+	SELECT
+		attempt.failures,
+		sqlc.arg('now'),
+		sqlc.arg('now') + (sqlc.arg('schedule')::integer[])[
+			LEAST(attempt.failures, cardinality(sqlc.arg('schedule')::integer[]))
+		] * INTERVAL '1 second'
+	FROM (
+		SELECT CASE
+			WHEN f.last_failed_at < sqlc.arg('window_start') THEN 1
+			ELSE f.failures + 1
+		END AS failures
+	) AS attempt
+)
+WHERE f.blocked_until IS NULL OR f.blocked_until <= sqlc.arg('now')
+RETURNING *;
+
+-- name: ForgiveLoginAttempt :exec
+-- Takes back an attempt counted by RecordLoginAttempt that turned out not to
+-- be a failure, along with the block it set.
+UPDATE login_failures
+SET failures = GREATEST(failures - 1, 0), blocked_until = NULL
+WHERE scope = $1 AND subject = $2;
+
+-- name: ClearLoginFailures :exec
+DELETE FROM login_failures
+WHERE scope = $1 AND subject = $2;
@@ -0,0 +1,22 @@
+-- name: ListModerationWords :many
+SELECT * FROM moderation_words
+ORDER BY word ASC;
+
+-- name: UpsertModerationWord :one
+INSERT INTO moderation_words (word, action, created_at, updated_at)
+VALUES ($1, $2, $3, $3)
+ON CONFLICT (word) DO UPDATE
+SET action = EXCLUDED.action, updated_at = EXCLUDED.updated_at
+RETURNING *;
+
+-- name: DeleteModerationWord :execrows
+DELETE FROM moderation_words WHERE word = $1;
+
+-- name: CreateChirpFlag :one
+INSERT INTO chirp_flags (id, chirp_id, rule, created_at)
+VALUES ($1, $2, $3, $4)
+RETURNING *;
+
+-- name: ListChirpFlags :many
+SELECT * FROM chirp_flags
+ORDER BY created_at DESC;
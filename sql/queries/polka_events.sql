@@ -0,0 +1,33 @@
+-- name: CreatePolkaEvent :execrows
+INSERT INTO polka_events (id, event, payload, status, received_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (id) DO NOTHING;
+
+-- name: GetPolkaEvent :one
+SELECT * FROM polka_events WHERE id = $1;
+
+-- name: ListPolkaEvents :many
+SELECT * FROM polka_events
+WHERE sqlc.narg('status')::text IS NULL OR status = sqlc.narg('status')
+ORDER BY received_at DESC, id DESC
+LIMIT sqlc.arg('limit');
+
+-- name: ClaimPolkaEvent :one
+-- Takes a received or failed event for processing. It returns no rows when
+-- the event is settled or already being processed, so concurrent deliveries
+-- apply it at most once. Claims from before stale_before are taken to belong
+-- to a worker that died and can be taken over.
+UPDATE polka_events
+SET status = 'processing', claimed_at = sqlc.arg('now')::timestamp
+WHERE id = sqlc.arg('id')
+AND (
+	status IN ('received', 'failed')
+	OR (status = 'processing' AND claimed_at < sqlc.arg('stale_before')::timestamp)
+)
+RETURNING *;
+
+-- name: FinishPolkaEvent :one
+UPDATE polka_events
+SET status = $2, attempts = attempts + 1, last_error = $3, processed_at = $4
+WHERE id = $1
+RETURNING *;
@@ -1,6 +1,6 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id)
-VALUES ($1, $2, $2, $3, NULL, $4)
+INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id, family_id)
+VALUES ($1, $2, $2, $3, NULL, $4, $5)
 RETURNING *;
 
 -- name: GetRefreshTokenByValue :one
@@ -10,3 +10,25 @@ SELECT * FROM refresh_tokens WHERE token = $1;
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
 WHERE token = $1;
+
+-- name: RotateRefreshToken :one
+-- Retires an active token and issues its successor in the same family. It
+-- returns no rows when the old token is unknown, expired, revoked or already
+-- rotated, so only one of several concurrent rotations of a token succeeds.
+WITH rotated AS (
+	UPDATE refresh_tokens
+	SET revoked_at = sqlc.arg('now'), updated_at = sqlc.arg('now'), replaced_by = sqlc.arg('new_token')
+	WHERE token = sqlc.arg('old_token')
+	AND revoked_at IS NULL
+	AND expires_at > sqlc.arg('now')
+	RETURNING user_id, family_id
+)
+INSERT INTO refresh_tokens (token, created_at, updated_at, expires_at, revoked_at, user_id, family_id)
+SELECT sqlc.arg('new_token'), sqlc.arg('now'), sqlc.arg('now'), sqlc.arg('expires_at'), NULL, user_id, family_id
+FROM rotated
+RETURNING *;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL;
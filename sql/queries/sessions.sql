@@ -0,0 +1,39 @@
+-- name: CreateSession :one
+INSERT INTO sessions (id, user_id, created_at, user_agent, ip)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+
+-- name: ListActiveSessions :many
+SELECT
+	sessions.id,
+	sessions.created_at,
+	sessions.user_agent,
+	sessions.ip,
+	refresh_tokens.created_at AS refreshed_at,
+	refresh_tokens.expires_at
+FROM sessions
+JOIN refresh_tokens ON refresh_tokens.family_id = sessions.id
+WHERE sessions.user_id = $1
+AND refresh_tokens.revoked_at IS NULL
+AND refresh_tokens.expires_at > $2
+ORDER BY sessions.created_at DESC;
+
+-- name: RevokeSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL;
+
+-- name: RevokeUserSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = sqlc.arg('user_id')
+AND revoked_at IS NULL
+AND family_id IS DISTINCT FROM sqlc.narg('except_session_id')::uuid;
+
+-- name: IsSessionActive :one
+-- A session lasts as long as its refresh token family has an unrevoked,
+-- unexpired token; rotation retires and issues one in the same statement.
+SELECT EXISTS (
+	SELECT 1 FROM refresh_tokens
+	WHERE family_id = sqlc.arg('family_id') AND revoked_at IS NULL AND expires_at > sqlc.arg('now')
+);
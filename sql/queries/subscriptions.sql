@@ -0,0 +1,66 @@
+-- name: GetSubscription :one
+SELECT * FROM subscriptions WHERE user_id = $1;
+
+-- name: SaveSubscription :one
+-- Stores the subscription, records the event that changed it in its history
+-- and brings the user's Chirpy Red flag in line with it, all in one
+-- statement so a failure cannot leave them disagreeing. previous_updated_at
+-- is the updated_at the caller computed the change from, NULL when there was
+-- no subscription; if another change got in first nothing is saved and no row
+-- is returned.
+WITH saved AS (
+	INSERT INTO subscriptions (
+		user_id, plan, status, started_at, renewed_at, expires_at, grace_until, canceled_at, updated_at
+	)
+	VALUES (
+		sqlc.arg('user_id'), sqlc.arg('plan'), sqlc.arg('status'), sqlc.arg('started_at'),
+		sqlc.narg('renewed_at'), sqlc.arg('expires_at'), sqlc.narg('grace_until'),
+		sqlc.narg('canceled_at'), sqlc.arg('updated_at')
+	)
+	ON CONFLICT (user_id) DO UPDATE
+	SET plan = EXCLUDED.plan,
+		status = EXCLUDED.status,
+		started_at = EXCLUDED.started_at,
+		renewed_at = EXCLUDED.renewed_at,
+		expires_at = EXCLUDED.expires_at,
+		grace_until = EXCLUDED.grace_until,
+		canceled_at = EXCLUDED.canceled_at,
+		updated_at = EXCLUDED.updated_at
+	WHERE subscriptions.updated_at = sqlc.narg('previous_updated_at')
+	RETURNING *
+), recorded AS (
+	INSERT INTO subscription_events (id, user_id, event, status, expires_at, created_at)
+	SELECT sqlc.arg('event_id'), user_id, sqlc.arg('event'), status, expires_at, updated_at
+	FROM saved
+), flagged AS (
+	UPDATE users
+	SET is_chirpy_red = saved.status <> 'expired'
+	FROM saved
+	WHERE users.id = saved.user_id
+)
+SELECT * FROM saved;
+
+-- name: ExpireLapsedSubscriptions :many
+-- Ends the subscriptions whose paid and grace periods have run out, recording
+-- event in their history and taking Chirpy Red away in the same statement.
+WITH expired AS (
+	UPDATE subscriptions
+	SET status = 'expired', updated_at = sqlc.arg('now')
+	WHERE status <> 'expired' AND COALESCE(grace_until, expires_at) <= sqlc.arg('now')
+	RETURNING *
+), recorded AS (
+	INSERT INTO subscription_events (id, user_id, event, status, expires_at, created_at)
+	SELECT gen_random_uuid(), user_id, sqlc.arg('event'), status, expires_at, updated_at
+	FROM expired
+), flagged AS (
+	UPDATE users
+	SET is_chirpy_red = false
+	FROM expired
+	WHERE users.id = expired.user_id
+)
+SELECT * FROM expired;
+
+-- name: ListSubscriptionEvents :many
+SELECT * FROM subscription_events
+WHERE user_id = $1
+ORDER BY created_at DESC;
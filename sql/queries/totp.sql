@@ -0,0 +1,36 @@
+-- name: UpsertUserTOTP :exec
+INSERT INTO user_totp (user_id, secret_ciphertext, created_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO UPDATE
+SET secret_ciphertext = EXCLUDED.secret_ciphertext,
+	created_at = EXCLUDED.created_at,
+	confirmed_at = NULL,
+	last_used_step = 0;
+
+-- name: GetUserTOTP :one
+SELECT * FROM user_totp WHERE user_id = $1;
+
+-- name: ConfirmUserTOTP :exec
+UPDATE user_totp
+SET confirmed_at = $2
+WHERE user_id = $1;
+
+-- name: UseTOTPStep :execrows
+UPDATE user_totp
+SET last_used_step = $2
+WHERE user_id = $1 AND last_used_step < $2;
+
+-- name: DeleteUserTOTP :exec
+DELETE FROM user_totp WHERE user_id = $1;
+
+-- name: CreateTOTPRecoveryCode :exec
+INSERT INTO totp_recovery_codes (user_id, code_hash, created_at)
+VALUES ($1, $2, $3);
+
+-- name: UseTOTPRecoveryCode :execrows
+UPDATE totp_recovery_codes
+SET used_at = $3
+WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;
+
+-- name: DeleteTOTPRecoveryCodes :exec
+DELETE FROM totp_recovery_codes WHERE user_id = $1;
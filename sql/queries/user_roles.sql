@@ -0,0 +1,23 @@
+-- name: ListUserRoles :many
+SELECT role FROM user_roles
+WHERE user_id = $1
+ORDER BY role;
+
+-- name: GrantUserRole :exec
+INSERT INTO user_roles (user_id, role, granted_at, granted_by)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (user_id, role) DO NOTHING;
+
+-- name: RevokeUserRole :execrows
+DELETE FROM user_roles
+WHERE user_id = $1 AND role = $2;
+
+-- name: RevokeUserRoleUnlessLastAdmin :execrows
+-- Deletes nothing when it would remove the last admin. The admin rows are
+-- locked so concurrent revocations of two admins cannot both go through.
+DELETE FROM user_roles
+WHERE user_id = $1 AND role = $2
+AND (
+	role <> 'admin'
+	OR (SELECT COUNT(*) FROM (SELECT 1 FROM user_roles WHERE role = 'admin' FOR UPDATE) AS admins) > 1
+);
@@ -13,7 +13,7 @@ RETURNING *;
 DELETE FROM users;
 
 -- name: GetUserByEmail :one
-SELECT * FROM users WHERE email = $1;
+SELECT * FROM users WHERE normalized_email(email) = normalized_email($1);
 
 -- name: UpdateUser :one
 UPDATE users
@@ -21,7 +21,21 @@ SET email = $2, hashed_password = $3, updated_at = NOW()
 WHERE id = $1
 RETURNING *;
 
--- name: UpgradeUserToRed :exec
+-- name: SetUserChirpyRed :exec
 UPDATE users
-SET is_chirpy_red = true
+SET is_chirpy_red = $2
 WHERE id = $1;
+
+-- name: GetUserByID :one
+SELECT * FROM users WHERE id = $1;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: VerifyUserEmail :one
+UPDATE users
+SET email = $2, email_verified_at = $3, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
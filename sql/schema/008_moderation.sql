@@ -0,0 +1,25 @@
+-- +goose Up
+CREATE TABLE moderation_words (
+	word TEXT PRIMARY KEY,
+	action TEXT NOT NULL DEFAULT 'mask' CHECK (action IN ('mask', 'reject', 'flag')),
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO moderation_words (word, action, created_at, updated_at)
+VALUES
+	('kerfuffle', 'mask', NOW(), NOW()),
+	('sharbert', 'mask', NOW(), NOW()),
+	('fornax', 'mask', NOW(), NOW());
+
+CREATE TABLE chirp_flags (
+	id UUID PRIMARY KEY,
+	chirp_id UUID NOT NULL,
+	rule TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (chirp_id) REFERENCES chirps(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE chirp_flags;
+DROP TABLE moderation_words;
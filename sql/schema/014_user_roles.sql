@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE user_roles (
+	user_id UUID NOT NULL,
+	role TEXT NOT NULL CHECK (role IN ('moderator', 'admin')),
+	granted_at TIMESTAMP NOT NULL,
+	granted_by UUID,
+	PRIMARY KEY (user_id, role),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (granted_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- +goose Down
+DROP TABLE user_roles;
@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE user_totp (
+	user_id UUID PRIMARY KEY,
+	secret_ciphertext BYTEA NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	confirmed_at TIMESTAMP DEFAULT NULL,
+	last_used_step BIGINT NOT NULL DEFAULT 0,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE totp_recovery_codes (
+	user_id UUID NOT NULL,
+	code_hash TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP DEFAULT NULL,
+	PRIMARY KEY (user_id, code_hash),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE totp_recovery_codes;
+DROP TABLE user_totp;
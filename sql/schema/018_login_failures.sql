@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE login_failures (
+	scope TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failed_at TIMESTAMP NOT NULL,
+	blocked_until TIMESTAMP DEFAULT NULL,
+	PRIMARY KEY (scope, subject)
+);
+
+-- +goose Down
+DROP TABLE login_failures;
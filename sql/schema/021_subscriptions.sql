@@ -0,0 +1,39 @@
+-- +goose Up
+CREATE TABLE subscriptions (
+	user_id UUID PRIMARY KEY,
+	plan TEXT NOT NULL,
+	status TEXT NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	renewed_at TIMESTAMP DEFAULT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	grace_until TIMESTAMP DEFAULT NULL,
+	canceled_at TIMESTAMP DEFAULT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX subscriptions_lapses_at_idx ON subscriptions ((COALESCE(grace_until, expires_at)))
+WHERE status <> 'expired';
+
+CREATE TABLE subscription_events (
+	id UUID PRIMARY KEY,
+	user_id UUID NOT NULL,
+	event TEXT NOT NULL,
+	status TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX subscription_events_user_id_idx ON subscription_events (user_id, created_at);
+
+-- Chirpy Red used to be forever. Existing members get one period to be
+-- picked up by their next renewal.
+INSERT INTO subscriptions (user_id, plan, status, started_at, expires_at, grace_until, updated_at)
+SELECT id, 'red', 'active', NOW(), NOW() + INTERVAL '30 days', NOW() + INTERVAL '37 days', NOW()
+FROM users
+WHERE is_chirpy_red;
+
+-- +goose Down
+DROP TABLE subscription_events;
+DROP TABLE subscriptions;
@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE polka_events (
+	id TEXT PRIMARY KEY,
+	event TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT DEFAULT NULL,
+	received_at TIMESTAMP NOT NULL,
+	processed_at TIMESTAMP DEFAULT NULL
+);
+
+CREATE INDEX polka_events_received_at_idx ON polka_events (received_at);
+
+-- +goose Down
+DROP TABLE polka_events;
@@ -0,0 +1,69 @@
+-- +goose Up
+-- normalized_email mirrors mailer.NormalizeAddress for stored addresses:
+-- surrounding space is trimmed and the domain lowercased, the local part is
+-- kept as typed.
+-- +goose StatementBegin
+CREATE FUNCTION normalized_email(email TEXT) RETURNS TEXT
+LANGUAGE SQL IMMUTABLE STRICT PARALLEL SAFE
+AS $$
+	SELECT COALESCE(
+		substring(trim(email) FROM '^(.*@)') || lower(substring(trim(email) FROM '[^@]*$')),
+		trim(email)
+	)
+$$;
+-- +goose StatementEnd
+
+-- Accounts created before addresses were normalized may share an address
+-- that differs only in the case of its domain. The verified, then oldest,
+-- account keeps it; the others are parked here with a placeholder address
+-- until an admin sorts them out.
+CREATE TABLE user_email_conflicts (
+	user_id UUID PRIMARY KEY,
+	email TEXT NOT NULL,
+	kept_by UUID NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (kept_by) REFERENCES users(id) ON DELETE CASCADE
+);
+
+WITH ranked AS (
+	SELECT
+		id,
+		email,
+		first_value(id) OVER same_address AS kept_by,
+		row_number() OVER same_address AS rank
+	FROM users
+	WINDOW same_address AS (
+		PARTITION BY normalized_email(email)
+		ORDER BY email_verified_at IS NULL, created_at, id
+	)
+)
+INSERT INTO user_email_conflicts (user_id, email, kept_by, created_at)
+SELECT id, email, kept_by, NOW()
+FROM ranked
+WHERE rank > 1;
+
+UPDATE users
+SET email = 'conflict+' || users.id || '@invalid.invalid', updated_at = NOW()
+FROM user_email_conflicts
+WHERE user_email_conflicts.user_id = users.id;
+
+UPDATE users
+SET email = normalized_email(email), updated_at = NOW()
+WHERE email <> normalized_email(email);
+
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+CREATE UNIQUE INDEX users_normalized_email_key ON users (normalized_email(email));
+
+-- +goose Down
+DROP INDEX users_normalized_email_key;
+
+UPDATE users
+SET email = user_email_conflicts.email
+FROM user_email_conflicts
+WHERE user_email_conflicts.user_id = users.id;
+
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+
+DROP TABLE user_email_conflicts;
+DROP FUNCTION normalized_email;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE polka_events
+ADD COLUMN claimed_at TIMESTAMP DEFAULT NULL;
+
+-- +goose Down
+ALTER TABLE polka_events
+DROP COLUMN claimed_at;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- profile:write only ever granted following and unfollowing users.
+UPDATE personal_access_tokens
+SET scopes = array_replace(scopes, 'profile:write', 'follows:write')
+WHERE 'profile:write' = ANY(scopes);
+
+-- +goose Down
+UPDATE personal_access_tokens
+SET scopes = array_replace(scopes, 'follows:write', 'profile:write')
+WHERE 'follows:write' = ANY(scopes);
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxBodyBytes caps request bodies, which are all small JSON documents.
+const maxBodyBytes = 1 << 20
+
+// validationErrors lists every field of a request that failed validation.
+type validationErrors []fieldError
+
+func (e validationErrors) Error() string {
+	messages := []string{}
+	for _, fieldErr := range e {
+		messages = append(messages, fieldErr.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// decodeJSON reads the JSON body of r into dst, a pointer to a struct, and
+// validates it. Unknown fields are rejected. On failure it answers with a 4xx
+// and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		respondWithError(w, r, 415, errCodeUnsupportedMediaType, "Request body must be application/json")
+		log.Printf("Error decoding JSON: unsupported content type %q", r.Header.Get("Content-Type"))
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(dst)
+	if err == nil && decoder.Decode(&json.RawMessage{}) != io.EOF {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	if err != nil {
+		respondWithDecodeError(w, r, err)
+		log.Printf("Error decoding JSON: %s", err)
+		return false
+	}
+
+	err = validateStruct(dst, "json")
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error validating request: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// decodeQuery copies the query parameters named by the query tags of dst, a
+// pointer to a struct of strings, and validates them. On failure it answers
+// 400 and returns false.
+func decodeQuery(w http.ResponseWriter, r *http.Request, dst any) bool {
+	query := r.URL.Query()
+
+	v := reflect.ValueOf(dst).Elem()
+	for i := range v.NumField() {
+		if name := v.Type().Field(i).Tag.Get("query"); name != "" {
+			v.Field(i).SetString(query.Get(name))
+		}
+	}
+
+	err := validateStruct(dst, "query")
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		log.Printf("Error validating query: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// pathUUID parses the path value name as a UUID. Anything else cannot name an
+// existing resource, so it answers 404 and returns false.
+func pathUUID(w http.ResponseWriter, r *http.Request, name, resource string) (uuid.UUID, bool) {
+	id, err := uuid.Parse(r.PathValue(name))
+	if err != nil {
+		respondWithError(w, r, 404, errCodeNotFound, resource+" not found")
+		log.Printf("Error parsing UUID from URL: %s", err)
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// nullUUID converts a string that passed the uuid rule, with "" as NULL.
+func nullUUID(s string) uuid.NullUUID {
+	id, err := uuid.Parse(s)
+	return uuid.NullUUID{UUID: id, Valid: err == nil}
+}
+
+func respondWithDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		respondWithError(w, r, 413, errCodeBodyTooLarge,
+			fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit))
+	case errors.Is(err, io.EOF):
+		respondWithError(w, r, 400, errCodeInvalidJSON, "Request body is empty")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		respondWithValidationError(w, r, fieldError{Field: typeErr.Field, Code: fieldCodeInvalid,
+			Message: fmt.Sprintf("Must be %s", jsonTypeName(typeErr.Type)),
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields.
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		respondWithValidationError(w, r, fieldError{Field: field, Code: fieldCodeUnknown, Message: "Is not a known field"})
+	default:
+		respondWithError(w, r, 400, errCodeInvalidJSON, "Request body is not valid JSON")
+	}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// validateStruct checks the fields of the struct dst points to against their
+// validate tags, naming fields after their nameTag tag:
+//
+//	required   the field must not be empty
+//	max=N      a string may have at most N characters
+//	uuid       a string must be a UUID
+//	oneof=a b  a string must be one of the listed values
+//
+// All rules but required let empty values through. Nested structs are
+// checked too, their fields named parent.child.
+func validateStruct(dst any, nameTag string) error {
+	fieldErrs := validationErrors{}
+	collectFieldErrors(reflect.ValueOf(dst).Elem(), nameTag, "", &fieldErrs)
+
+	if len(fieldErrs) > 0 {
+		return fieldErrs
+	}
+
+	return nil
+}
+
+func collectFieldErrors(v reflect.Value, nameTag, prefix string, fieldErrs *validationErrors) {
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		name, _, _ := strings.Cut(field.Tag.Get(nameTag), ",")
+		if name == "" {
+			name = field.Name
+		}
+		name = prefix + name
+
+		if value.Kind() == reflect.Struct && field.Tag.Get("validate") == "" {
+			collectFieldErrors(value, nameTag, name+".", fieldErrs)
+			continue
+		}
+
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			if rule == "" {
+				continue
+			}
+
+			if fieldErr, ok := checkRule(rule, value); !ok {
+				fieldErr.Field = name
+				*fieldErrs = append(*fieldErrs, fieldErr)
+				break
+			}
+		}
+	}
+}
+
+func checkRule(rule string, value reflect.Value) (fieldError, bool) {
+	if rule == "required" {
+		return fieldError{Code: fieldCodeRequired, Message: "Is required"}, !value.IsZero() &&
+			!(value.Kind() == reflect.Slice && value.Len() == 0)
+	}
+
+	if value.Kind() != reflect.String || value.String() == "" {
+		return fieldError{}, true
+	}
+
+	s := value.String()
+	name, arg, _ := strings.Cut(rule, "=")
+
+	switch name {
+	case "max":
+		limit, _ := strconv.Atoi(arg)
+		length := utf8.RuneCountInString(s)
+		return fieldError{Code: fieldCodeTooLong, Message: fmt.Sprintf("Must be at most %d characters", limit),
+			Length: length, Limit: limit}, length <= limit
+	case "uuid":
+		_, err := uuid.Parse(s)
+		return fieldError{Code: fieldCodeInvalid, Message: "Must be a UUID"}, err == nil
+	case "oneof":
+		options := strings.Fields(arg)
+		for _, option := range options {
+			if s == option {
+				return fieldError{}, true
+			}
+		}
+
+		return fieldError{Code: fieldCodeInvalid,
+			Message: fmt.Sprintf("Must be one of %s", strings.Join(options, ", "))}, false
+	}
+
+	panic(fmt.Sprintf("unknown validation rule %q", rule))
+}